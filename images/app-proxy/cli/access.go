@@ -0,0 +1,261 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"selkies.io/connector/tunnel"
+)
+
+const remoteListenWarning = `WARNING: %s is not a loopback address. Anyone who can reach it can use
+the tunnel with your identity. Restrict access with -allow_cidr,
+-local_psk_file or -local_tls_cert, and pass -allow_remote to confirm.`
+
+// forwardAllow holds the source networks from -allow_cidr, connections from
+// other addresses are rejected by the listeners of forwards.
+var forwardAllow []*net.IPNet
+
+// configureAccess parses -allow_cidr into forwardAllow.
+func configureAccess() error {
+	if len(*allowCIDR) == 0 {
+		return nil
+	}
+	nets, err := tunnel.ParseCIDRs(strings.Split(*allowCIDR, ","))
+	if err != nil {
+		return fmt.Errorf("invalid -allow_cidr: %v", err)
+	}
+	forwardAllow = nets
+	return nil
+}
+
+// listenLocal listens on the local address of a forward with the access
+// controls from the flags. Non-loopback addresses must be confirmed with
+// -allow_remote.
+func listenLocal(addr string) (net.Listener, error) {
+	if !isLoopbackAddr(addr) {
+		if !*allowRemote {
+			return nil, fmt.Errorf(remoteListenWarning, addr)
+		}
+		log.Printf(remoteListenWarning, addr)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*localTLSCert) > 0 || len(*localTLSKey) > 0 || len(*localTLSClientCA) > 0 {
+		config, err := getLocalTLSConfig()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = tls.NewListener(l, config)
+	}
+
+	if len(*localPSKFile) > 0 {
+		key, err := readPSK(*localPSKFile)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l = tunnel.PSKListener(l, key)
+	}
+
+	return l, nil
+}
+
+// isLoopbackAddr returns true if the host of addr is localhost or a loopback
+// IP address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// getLocalTLSConfig returns the TLS config of the local listener. Clients
+// must present a certificate signed by -local_tls_client_ca.
+func getLocalTLSConfig() (*tls.Config, error) {
+	if len(*localTLSCert) == 0 || len(*localTLSKey) == 0 || len(*localTLSClientCA) == 0 {
+		return nil, fmt.Errorf("-local_tls_cert, -local_tls_key and -local_tls_client_ca are required for mTLS on the local listener")
+	}
+	cert, err := tls.LoadX509KeyPair(*localTLSCert, *localTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load local listener certificate: %v", err)
+	}
+	pem, err := ioutil.ReadFile(*localTLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read local client CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in local client CA file %s", *localTLSClientCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// readPSK reads the pre-shared key file. Surrounding whitespace is ignored.
+func readPSK(path string) ([]byte, error) {
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pre-shared key file: %v", err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("pre-shared key in %s must be at least 16 bytes", path)
+	}
+	return key, nil
+}
+
+// runDial connects stdin and stdout to a listener that requires the
+// pre-shared key handshake, TLS, or both, for use as an SSH ProxyCommand.
+func runDial(addr string) error {
+	conn, err := dialLocal(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(conn, os.Stdin)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		done <- err
+	}()
+	return <-done
+}
+
+// dialLocal connects to a listener with the access controls of the dial
+// flags, in the order of listenLocal: TLS, then the pre-shared key inside it.
+func dialLocal(addr string) (net.Conn, error) {
+	tlsEnabled := len(*dialTLSCA) > 0 || len(*dialTLSCert) > 0 || len(*dialTLSKey) > 0
+	if !tlsEnabled && len(*localPSKFile) == 0 {
+		return nil, fmt.Errorf("-local_psk_file or -dial_tls_ca is required")
+	}
+	var config *tls.Config
+	if tlsEnabled {
+		var err error
+		if config, err = getDialTLSConfig(addr); err != nil {
+			return nil, err
+		}
+	}
+	var key []byte
+	if len(*localPSKFile) > 0 {
+		var err error
+		if key, err = readPSK(*localPSKFile); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %v", addr, err)
+		}
+		conn = tlsConn
+	}
+	if key != nil {
+		conn = &pskClientConn{Conn: tunnel.PSKClient(conn, key), closeWrite: conn}
+	}
+	return conn, nil
+}
+
+// pskClientConn keeps the half-close of the connection under the pre-shared
+// key handshake.
+type pskClientConn struct {
+	net.Conn
+	closeWrite net.Conn
+}
+
+func (c *pskClientConn) CloseWrite() error {
+	if cw, ok := c.closeWrite.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// getDialTLSConfig returns the TLS config to dial a listener started with
+// -local_tls_cert, with a client certificate for -local_tls_client_ca.
+func getDialTLSConfig(addr string) (*tls.Config, error) {
+	if len(*dialTLSCA) == 0 {
+		return nil, fmt.Errorf("-dial_tls_ca is required to verify the listener certificate")
+	}
+	if (len(*dialTLSCert) > 0) != (len(*dialTLSKey) > 0) {
+		return nil, fmt.Errorf("-dial_tls_cert and -dial_tls_key must be given together")
+	}
+	pem, err := ioutil.ReadFile(*dialTLSCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dial CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in dial CA file %s", *dialTLSCA)
+	}
+	serverName := *dialTLSServerName
+	if len(serverName) == 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(*dialTLSCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(*dialTLSCert, *dialTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load dial client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,198 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a certificate and key signed by parent, or self-signed
+// if parent is nil, and returns them.
+func writeTestCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestDialLocal(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "listener"},
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	pskFile := filepath.Join(dir, "psk.txt")
+	if err := ioutil.WriteFile(pskFile, []byte("0123456789abcdef0123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	flags := []*string{localPSKFile, localTLSCert, localTLSKey, localTLSClientCA, dialTLSCA, dialTLSCert, dialTLSKey, dialTLSServerName}
+	saved := make([]string, len(flags))
+	for i, f := range flags {
+		saved[i] = *f
+	}
+	defer func() {
+		for i, f := range flags {
+			*f = saved[i]
+		}
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		listen map[*string]string
+		dial   map[*string]string
+		ok     bool
+	}{
+		{
+			name:   "psk",
+			listen: map[*string]string{localPSKFile: pskFile},
+			dial:   map[*string]string{localPSKFile: pskFile},
+			ok:     true,
+		},
+		{
+			name:   "mtls",
+			listen: map[*string]string{localTLSCert: file("server.pem"), localTLSKey: file("server-key.pem"), localTLSClientCA: file("ca.pem")},
+			dial:   map[*string]string{dialTLSCA: file("ca.pem"), dialTLSCert: file("client.pem"), dialTLSKey: file("client-key.pem")},
+			ok:     true,
+		},
+		{
+			name:   "mtls and psk",
+			listen: map[*string]string{localTLSCert: file("server.pem"), localTLSKey: file("server-key.pem"), localTLSClientCA: file("ca.pem"), localPSKFile: pskFile},
+			dial:   map[*string]string{dialTLSCA: file("ca.pem"), dialTLSCert: file("client.pem"), dialTLSKey: file("client-key.pem"), localPSKFile: pskFile},
+			ok:     true,
+		},
+		{
+			name:   "mtls without client certificate",
+			listen: map[*string]string{localTLSCert: file("server.pem"), localTLSKey: file("server-key.pem"), localTLSClientCA: file("ca.pem")},
+			dial:   map[*string]string{dialTLSCA: file("ca.pem")},
+		},
+		{
+			name:   "mtls with wrong server name",
+			listen: map[*string]string{localTLSCert: file("server.pem"), localTLSKey: file("server-key.pem"), localTLSClientCA: file("ca.pem")},
+			dial:   map[*string]string{dialTLSCA: file("ca.pem"), dialTLSCert: file("client.pem"), dialTLSKey: file("client-key.pem"), dialTLSServerName: "other"},
+		},
+		{
+			name:   "psk to mtls",
+			listen: map[*string]string{localTLSCert: file("server.pem"), localTLSKey: file("server-key.pem"), localTLSClientCA: file("ca.pem")},
+			dial:   map[*string]string{localPSKFile: pskFile},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, f := range flags {
+				*f = tc.listen[f]
+			}
+			l, err := listenLocal("127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listenLocal() failed: %v", err)
+			}
+			defer l.Close()
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						io.Copy(conn, conn)
+					}()
+				}
+			}()
+
+			for _, f := range flags {
+				*f = tc.dial[f]
+			}
+			conn, err := dialLocal(l.Addr().String())
+			if err == nil {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(2 * time.Second))
+				if _, err = conn.Write([]byte("ping")); err == nil {
+					buf := make([]byte, 4)
+					if _, err = io.ReadFull(conn, buf); err == nil && string(buf) != "ping" {
+						t.Errorf("read %q, want ping", buf)
+					}
+				}
+			}
+			if tc.ok && err != nil {
+				t.Errorf("echo through the listener failed: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("echo through the listener succeeded, want error")
+			}
+		})
+	}
+
+	for _, f := range flags {
+		*f = ""
+	}
+	if _, err := dialLocal("127.0.0.1:1"); err == nil {
+		t.Errorf("dialLocal() without a key or TLS succeeded")
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"selkies.io/connector/tunnel"
+)
+
+// Close reason of connections rejected before they were tunneled.
+const auditRejectedReason = "rejected"
+
+// AuditEntry is a line of the audit log, written when a connection closes.
+type AuditEntry struct {
+	User        string    `json:"user"`
+	Subject     string    `json:"subject,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	Endpoint    string    `json:"endpoint"`
+	App         string    `json:"app"`
+	RemotePort  int       `json:"remote_port"`
+	Conn        uint64    `json:"conn,omitempty"`
+	ClientAddr  string    `json:"client_addr"`
+	StartTime   time.Time `json:"start_time"`
+	EndTime     time.Time `json:"end_time"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	CloseReason string    `json:"close_reason"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditIdentity is the user identity from the claims of an ID token.
+type auditIdentity struct {
+	user    string
+	subject string
+	issuer  string
+}
+
+// auditLogger appends entries to the audit log file, rotating it by size,
+// and to syslog.
+type auditLogger struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+	syslog  io.Writer
+}
+
+// auditLog is set by configureAudit if -audit_log or -audit_syslog is set.
+var auditLog *auditLogger
+
+// configureAudit opens the audit log and the syslog connection.
+func configureAudit() error {
+	if len(*auditPath) == 0 && len(*auditSyslog) == 0 {
+		return nil
+	}
+	maxSize, err := parseBytes(*auditMaxSize)
+	if err != nil {
+		return fmt.Errorf("invalid -audit_log_max_size: %v", err)
+	}
+	if *auditBackups < 0 {
+		return fmt.Errorf("invalid -audit_log_backups %d", *auditBackups)
+	}
+
+	a := &auditLogger{path: *auditPath, maxSize: maxSize, backups: *auditBackups}
+	if len(a.path) > 0 {
+		if err := a.open(); err != nil {
+			return fmt.Errorf("could not open audit log: %v", err)
+		}
+	}
+	if len(*auditSyslog) > 0 {
+		w, err := dialAuditSyslog(*auditSyslog)
+		if err != nil {
+			return fmt.Errorf("could not connect to audit syslog: %v", err)
+		}
+		a.syslog = w
+	}
+	auditLog = a
+	return nil
+}
+
+// open opens the audit log for appending.
+func (a *auditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the audit log to FILE.1, shifting older logs up to
+// FILE.<backups>, and opens a new one.
+func (a *auditLogger) rotate() error {
+	a.file.Close()
+	a.file = nil
+	if a.backups == 0 {
+		os.Remove(a.path)
+	} else {
+		for i := a.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return err
+		}
+	}
+	return a.open()
+}
+
+func (a *auditLogger) write(entry AuditEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.path) > 0 {
+		line := append(b, '\n')
+		if a.file != nil && a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+			if err := a.rotate(); err != nil {
+				log.Printf("Failed to rotate audit log: %v", err)
+			}
+		}
+		if a.file == nil {
+			// Retry after a failed rotation.
+			if err := a.open(); err != nil {
+				log.Printf("Failed to open audit log: %v", err)
+			}
+		}
+		if a.file != nil {
+			n, err := a.file.Write(line)
+			a.size += int64(n)
+			if err != nil {
+				log.Printf("Failed to write audit log: %v", err)
+			}
+		}
+	}
+	if a.syslog != nil {
+		if _, err := a.syslog.Write(b); err != nil {
+			log.Printf("Failed to send audit entry to syslog: %v", err)
+		}
+	}
+}
+
+// auditClosed records a tunneled connection when it closes.
+func auditClosed(forward ForwardStatus, conn *trackedConn, reason string, err error) {
+	if auditLog == nil {
+		return
+	}
+	entry := newAuditEntry(forward, conn.endpoint, conn.status.ClientAddr, reason, err)
+	entry.Conn = conn.status.ID
+	entry.StartTime = conn.status.StartTime
+	entry.BytesIn = atomic.LoadInt64(&conn.bytesInCount)
+	entry.BytesOut = atomic.LoadInt64(&conn.bytesOutCount)
+	auditLog.write(entry)
+}
+
+// auditRejected records a connection that was rejected before it was
+// tunneled.
+func auditRejected(forward ForwardStatus, conn net.Conn, err error) {
+	if auditLog == nil {
+		return
+	}
+	entry := newAuditEntry(forward, currentEndpoint(), conn.RemoteAddr().String(), auditRejectedReason, err)
+	entry.StartTime = entry.EndTime
+	auditLog.write(entry)
+}
+
+func newAuditEntry(forward ForwardStatus, endpoint, clientAddr, reason string, err error) AuditEntry {
+	id := endpointIdentity(endpoint)
+	entry := AuditEntry{
+		User:        id.user,
+		Subject:     id.subject,
+		Issuer:      id.issuer,
+		Endpoint:    endpoint,
+		App:         forward.App,
+		RemotePort:  forward.RemotePort,
+		ClientAddr:  clientAddr,
+		EndTime:     time.Now(),
+		CloseReason: reason,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// endpointIdentity returns the identity in the ID token of the endpoint's
+// client. The token is not verified, it was issued to this connector.
+func endpointIdentity(endpoint string) auditIdentity {
+	var client *tunnel.Client
+	if failover != nil {
+		for _, c := range failover.Clients {
+			if c.Endpoint == endpoint {
+				client = c
+			}
+		}
+	}
+	if client == nil {
+		return auditIdentity{}
+	}
+	idToken, err := client.Tokens.IDToken()
+	if err != nil {
+		return auditIdentity{}
+	}
+	return tokenIdentity(idToken)
+}
+
+// tokenIdentity returns the email, or the subject if there is no email, and
+// the issuer of an ID token.
+func tokenIdentity(idToken string) auditIdentity {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(idToken, claims); err != nil {
+		return auditIdentity{}
+	}
+	str := func(name string) string {
+		s, _ := claims[name].(string)
+		return s
+	}
+	id := auditIdentity{
+		user:    str("email"),
+		subject: str("sub"),
+		issuer:  str("iss"),
+	}
+	if len(id.user) == 0 {
+		id.user = id.subject
+	}
+	return id
+}
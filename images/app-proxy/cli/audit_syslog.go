@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialAuditSyslog connects to the local syslog daemon, or to the address in
+// the form network://address.
+func dialAuditSyslog(addr string) (io.Writer, error) {
+	const priority = syslog.LOG_INFO | syslog.LOG_AUTH
+	const tag = "selkies-connector"
+	if addr == "local" {
+		return syslog.New(priority, tag)
+	}
+	u, err := url.Parse(addr)
+	if err != nil || len(u.Scheme) == 0 {
+		return nil, fmt.Errorf("invalid syslog address %q, expected local or NETWORK://ADDRESS", addr)
+	}
+	raddr := u.Host
+	if u.Scheme == "unix" || u.Scheme == "unixgram" {
+		raddr = u.Path
+	}
+	return syslog.Dial(u.Scheme, raddr, priority, tag)
+}
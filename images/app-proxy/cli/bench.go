@@ -0,0 +1,168 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"selkies.io/connector/tunnel"
+)
+
+// Size of the random block repeated in the throughput test. It is larger
+// than the deflate window so that compression does not inflate the result.
+const benchBlockSize = 1 << 20
+
+// BenchResult is the outcome of the bench command.
+type BenchResult struct {
+	Dial             time.Duration `json:"dial_ns"`
+	Pings            int           `json:"pings"`
+	RTTMin           time.Duration `json:"rtt_min_ns"`
+	RTTAvg           time.Duration `json:"rtt_avg_ns"`
+	RTTMax           time.Duration `json:"rtt_max_ns"`
+	Bytes            int64         `json:"bytes"`
+	UploadDuration   time.Duration `json:"upload_ns"`
+	EchoDuration     time.Duration `json:"echo_ns"`
+	UploadBytesPerS  float64       `json:"upload_bytes_per_second"`
+	EchoBytesPerS    float64       `json:"echo_bytes_per_second"`
+	Transport        string        `json:"transport"`
+	Compression      bool          `json:"compression"`
+	FrameSize        int           `json:"frame_size"`
+	WebsocketBuffers [2]int        `json:"websocket_buffers"`
+}
+
+// runBench measures the round trip time and throughput through the tunnel
+// to an echo service listening on the remote port in the app.
+func runBench(client *tunnel.Client) error {
+	size, err := parseBytes(*benchSize)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid -bench_size %q", *benchSize)
+	}
+
+	result := BenchResult{
+		Bytes:            size,
+		Compression:      *compression,
+		FrameSize:        websocketFrameSize,
+		WebsocketBuffers: [2]int{websocketReadBufferSize, websocketWriteBufferSize},
+	}
+
+	start := time.Now()
+	conn, err := client.Dial(context.Background(), *appName, "localhost", *remotePort)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	result.Dial = time.Since(start)
+	result.Transport = client.TransportInUse()
+
+	// Round trips of a small message.
+	ping := []byte("selkies-connector-bench-ping\n")
+	pong := make([]byte, len(ping))
+	var total time.Duration
+	for i := 0; i < *benchPings; i++ {
+		start := time.Now()
+		if _, err := conn.Write(ping); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(*waitTimeout))
+		if _, err := io.ReadFull(conn, pong); err != nil {
+			return fmt.Errorf("no echo from port %d, is an echo service listening: %v", *remotePort, err)
+		}
+		if !bytes.Equal(ping, pong) {
+			return fmt.Errorf("echo mismatch, the service on port %d is not an echo service", *remotePort)
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if result.RTTMin == 0 || rtt < result.RTTMin {
+			result.RTTMin = rtt
+		}
+		if rtt > result.RTTMax {
+			result.RTTMax = rtt
+		}
+		result.Pings++
+	}
+	if result.Pings > 0 {
+		result.RTTAvg = total / time.Duration(result.Pings)
+	}
+
+	// Throughput of a bulk transfer echoed back.
+	block := make([]byte, benchBlockSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(block)
+
+	uploadDone := make(chan error, 1)
+	start = time.Now()
+	go func() {
+		for sent := int64(0); sent < size; {
+			n := int64(len(block))
+			if size-sent < n {
+				n = size - sent
+			}
+			if _, err := conn.Write(block[:n]); err != nil {
+				uploadDone <- err
+				return
+			}
+			sent += n
+		}
+		result.UploadDuration = time.Since(start)
+		uploadDone <- nil
+	}()
+
+	conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 64*1024)
+	for received := int64(0); received < size; {
+		n, err := conn.Read(buf)
+		for i := 0; i < n; i++ {
+			if buf[i] != block[(received+int64(i))%benchBlockSize] {
+				return fmt.Errorf("echoed data differs at byte %d", received+int64(i))
+			}
+		}
+		received += int64(n)
+		if err != nil && received < size {
+			return fmt.Errorf("echo ended after %d of %d bytes: %v", received, size, err)
+		}
+	}
+	result.EchoDuration = time.Since(start)
+	if err := <-uploadDone; err != nil {
+		return err
+	}
+	result.UploadBytesPerS = float64(size) / result.UploadDuration.Seconds()
+	result.EchoBytesPerS = float64(size) / result.EchoDuration.Seconds()
+
+	if *doctorFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	printBenchResult(result)
+	return nil
+}
+
+func printBenchResult(r BenchResult) {
+	ms := func(d time.Duration) string { return d.Round(100 * time.Microsecond).String() }
+	fmt.Printf("%-12s %s\n", "dial", ms(r.Dial))
+	fmt.Printf("%-12s min %s, avg %s, max %s over %d round trips\n", "rtt", ms(r.RTTMin), ms(r.RTTAvg), ms(r.RTTMax), r.Pings)
+	fmt.Printf("%-12s %.1f MiB/s, %d bytes sent in %s\n", "upload", r.UploadBytesPerS/(1<<20), r.Bytes, ms(r.UploadDuration))
+	fmt.Printf("%-12s %.1f MiB/s, %d bytes echoed in %s\n", "echo", r.EchoBytesPerS/(1<<20), r.Bytes, ms(r.EchoDuration))
+	fmt.Printf("%-12s %s\n", "transport", r.Transport)
+	fmt.Printf("%-12s compression %v, frame size %d, websocket buffers %d/%d (0 is default)\n", "settings", r.Compression, r.FrameSize, r.WebsocketBuffers[0], r.WebsocketBuffers[1])
+}
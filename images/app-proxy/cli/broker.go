@@ -0,0 +1,170 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"selkies.io/connector/tunnel"
+)
+
+// BrokerStatus is the app status returned by the broker API.
+type BrokerStatus struct {
+	Code       int               `json:"code"`
+	Status     string            `json:"status"`
+	Nodes      []string          `json:"nodes"`
+	Containers map[string]string `json:"containers"`
+}
+
+const (
+	brokerStatusReady    = "ready"
+	brokerStatusShutdown = "shutdown"
+)
+
+// brokerRequest calls the broker API for the app with the given method and
+// returns the decoded status.
+func brokerRequest(method, idToken string) (*BrokerStatus, error) {
+	url := fmt.Sprintf("https://%s/broker/%s/", currentEndpoint(), *appName)
+	client := newHTTPClient()
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s %s: HTTP error: %s: %s", method, url, resp.Status, string(body))
+	}
+
+	var status BrokerStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("%s %s: invalid response: %v", method, url, err)
+	}
+	return &status, nil
+}
+
+// getAppStatus returns the current status of the app.
+func getAppStatus(idToken string) (*BrokerStatus, error) {
+	return brokerRequest("GET", idToken)
+}
+
+// startApp asks the broker to launch the app. Launching an app that is
+// already running is a no-op.
+func startApp(idToken string) error {
+	status, err := getAppStatus(idToken)
+	if err != nil {
+		return err
+	}
+	if status.Status == brokerStatusReady {
+		return nil
+	}
+
+	log.Printf("Starting app %s", *appName)
+	_, err = brokerRequest("POST", idToken)
+	return err
+}
+
+// stopApp asks the broker to shut down the app.
+func stopApp(idToken string) error {
+	_, err := brokerRequest("DELETE", idToken)
+	return err
+}
+
+// waitForApp polls the broker until the app reports ready or the timeout
+// expires, retrying failed requests.
+func waitForApp(idToken string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	lastStatus := ""
+	for {
+		// The broker API can fail transiently while the app starts, ex: behind
+		// a load balancer being updated, so errors are retried like a status.
+		status, err := getAppStatus(idToken)
+		if err != nil {
+			if *verbose {
+				log.Printf("Failed to get status of app %s: %v", *appName, err)
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %v: %v", timeout, err)
+			}
+			time.Sleep(*pollInterval)
+			continue
+		}
+		if status.Status == brokerStatusReady {
+			return nil
+		}
+		if status.Status != lastStatus {
+			log.Printf("Waiting for app %s, status: %s", *appName, status.Status)
+			lastStatus = status.Status
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v, last status: %s", timeout, status.Status)
+		}
+		time.Sleep(*pollInterval)
+	}
+}
+
+// waitForRemotePort dials the app proxy until the remote port accepts
+// connections or the timeout expires.
+func waitForRemotePort(client *tunnel.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := probeRemotePort(client)
+		if err == nil {
+			return nil
+		}
+		if *verbose {
+			log.Printf("Remote port %d not ready: %v", *remotePort, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v: %v", timeout, err)
+		}
+		time.Sleep(*pollInterval)
+	}
+}
+
+// probeRemotePort opens a single connection to the remote port. The proxy
+// closes the connection right away when it cannot connect to the port, so a
+// connection that delivers data or stays open counts as ready.
+func probeRemotePort(client *tunnel.Client) error {
+	conn, err := client.Dial(context.Background(), *appName, "localhost", *remotePort)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(*pollInterval))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("connection closed by the app proxy")
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture directions. Out is from the local client to the app, in is from
+// the app to the local client, like the bytes_total metric.
+const (
+	captureOut = "out"
+	captureIn  = "in"
+)
+
+var errCaptureLimit = errors.New("capture size limit reached")
+
+// captureSink writes the events of a single connection in a capture format.
+type captureSink interface {
+	start(t time.Time) error
+	data(t time.Time, direction string, b []byte) error
+	end(t time.Time) error
+}
+
+// captureConn records the bytes read from and written to a local client
+// connection until the capture is stopped or the connection is closed.
+type captureConn struct {
+	net.Conn
+	path string
+	file *os.File
+	sink captureSink
+
+	mu        sync.Mutex
+	stopped   bool
+	closeOnce sync.Once
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(captureOut, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(captureIn, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) record(direction string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return
+	}
+	if err := c.sink.data(time.Now(), direction, b); err != nil {
+		c.stop(err)
+	}
+}
+
+func (c *captureConn) stop(err error) {
+	c.stopped = true
+	if err == errCaptureLimit {
+		log.Printf("Capture %s reached -capture_max_size, later data is not captured", c.path)
+		return
+	}
+	log.Printf("Capture %s stopped: %v", c.path, err)
+}
+
+func (c *captureConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if !c.stopped {
+			if err := c.sink.end(time.Now()); err != nil {
+				c.stop(err)
+			}
+			c.stopped = true
+		}
+		c.mu.Unlock()
+		c.file.Close()
+	})
+	return c.Conn.Close()
+}
+
+// checkCaptureFlags validates the capture flags before any connection is
+// captured.
+func checkCaptureFlags() error {
+	if len(*capturePath) == 0 {
+		return nil
+	}
+	if _, err := parseBytes(*captureMaxSize); err != nil {
+		return fmt.Errorf("invalid -capture_max_size: %v", err)
+	}
+	switch *captureFormat {
+	case "pcapng", "jsonl":
+		return nil
+	}
+	return fmt.Errorf("unknown -capture_format %q, expected pcapng or jsonl", *captureFormat)
+}
+
+// startCapture creates the capture file of a connection from the -capture
+// template and returns conn wrapped to record its traffic.
+func startCapture(conn net.Conn, forward ForwardStatus, id uint64) (net.Conn, error) {
+	maxSize, err := parseBytes(*captureMaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -capture_max_size: %v", err)
+	}
+
+	path := captureFilename(*capturePath, forward, id, time.Now())
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &limitWriter{w: f, max: maxSize}
+
+	var sink captureSink
+	switch *captureFormat {
+	case "pcapng":
+		sink = newPcapngWriter(w, conn.RemoteAddr(), conn.LocalAddr(), forward.RemotePort)
+	case "jsonl":
+		sink = &jsonlCapture{w: w, id: id, client: conn.RemoteAddr().String(), target: forward.target()}
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown capture format %q, expected pcapng or jsonl", *captureFormat)
+	}
+
+	c := &captureConn{Conn: conn, path: path, file: f, sink: sink}
+	if err := sink.start(time.Now()); err != nil {
+		c.stop(err)
+	}
+	log.Printf("Capturing connection %d to %s", id, path)
+	return c, nil
+}
+
+// captureFilename expands the -capture template. {id} is replaced with the
+// connection ID, {app} and {port} with the forward target and {time} with
+// the start time. If the template has no {id}, the ID is added before the
+// extension so that connections do not overwrite each other.
+func captureFilename(template string, forward ForwardStatus, id uint64, t time.Time) string {
+	if !strings.Contains(template, "{id}") {
+		ext := filepath.Ext(template)
+		template = strings.TrimSuffix(template, ext) + "-{id}" + ext
+	}
+	return strings.NewReplacer(
+		"{id}", fmt.Sprint(id),
+		"{app}", forward.App,
+		"{port}", fmt.Sprint(forward.RemotePort),
+		"{time}", t.Format("20060102T150405"),
+	).Replace(template)
+}
+
+// limitWriter fails writes that would grow the output past max bytes, so
+// that records are never truncated. A max of zero is unlimited.
+type limitWriter struct {
+	w       io.Writer
+	max     int64
+	written int64
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.max > 0 && l.written+int64(len(b)) > l.max {
+		return 0, errCaptureLimit
+	}
+	n, err := l.w.Write(b)
+	l.written += int64(n)
+	return n, err
+}
+
+// captureEvent is a line of a JSONL capture.
+type captureEvent struct {
+	Time      time.Time `json:"time"`
+	Conn      uint64    `json:"conn"`
+	Event     string    `json:"event"`
+	Client    string    `json:"client,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Len       int       `json:"len,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+}
+
+// jsonlCapture writes an open event, a data event with the base64 encoded
+// bytes for each read and write, and a close event.
+type jsonlCapture struct {
+	w      io.Writer
+	id     uint64
+	client string
+	target string
+}
+
+func (j *jsonlCapture) write(event captureEvent) error {
+	event.Conn = j.id
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+func (j *jsonlCapture) start(t time.Time) error {
+	return j.write(captureEvent{Time: t, Event: "open", Client: j.client, Target: j.target})
+}
+
+func (j *jsonlCapture) data(t time.Time, direction string, b []byte) error {
+	return j.write(captureEvent{Time: t, Event: "data", Direction: direction, Len: len(b), Data: b})
+}
+
+func (j *jsonlCapture) end(t time.Time) error {
+	return j.write(captureEvent{Time: t, Event: "close"})
+}
@@ -18,31 +18,38 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"os"
-	"regexp"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	huproxy "github.com/google/huproxy/lib"
-	"github.com/gorilla/websocket"
 	"github.com/salrashid123/oauth2oidc"
 	"golang.org/x/oauth2"
+	"selkies.io/connector/tunnel"
 )
 
 type CredentialCache struct {
 	oauth2oidc.TokenResponse
 	BrokerCookie string `json:"broker_cookie"`
 	Endpoint     string `json:"endpoint"`
+
+	// Endpoints holds the credentials of each endpoint used, the fields
+	// above are those of the last one.
+	Endpoints map[string]EndpointCredentials `json:"endpoints,omitempty"`
+}
+
+// EndpointCredentials are the saved credentials of one broker endpoint.
+type EndpointCredentials struct {
+	IDToken      string `json:"id_token"`
+	BrokerCookie string `json:"broker_cookie"`
 }
 
 const defaultAudience = "BROKER_CLIENT_ID"
@@ -51,53 +58,140 @@ const defaultClientSecret = "DESKTOP_APP_CLIENT_SECRET"
 const defaultGCIPKey = "GCIP_API_KEY"
 
 var (
-	flCredentialFile = flag.String("credential_file", "creds.json", "Credential file with id_token, refresh_token, and broker_cookie")
-	writeTimeout     = flag.Duration("write_timeout", 10*time.Second, "Write timeout")
-	brokerAudience   = flag.String("audience", "", "Broker web app OAuth client ID")
-	appClientID      = flag.String("clientID", "", "Desktop app OAuth client ID")
-	appClientSecret  = flag.String("clientSecret", "", "Desktop app OAuth client secret")
-	endpoint         = flag.String("endpoint", "DEFAULT_ENDPOINT", "Broker base URL, ex: broker.endpoints.PROJECT_ID.cloud.goog")
-	remotePort       = flag.Int("remote_port", 22, "Remote port")
-	localPort        = flag.Int("local_port", 0, "Local port, default to remote_port")
-	localAddr        = flag.String("local_addr", "127.0.0.1", "Local address to listen on")
-	appName          = flag.String("app", "", "Name of broker app to connect to")
-	userCookie       = flag.String("cookie", "", "Broker user cookie for per-user routing")
-	gcipKeyArg       = flag.String("gcip-key", "", "API key used when endpoint uses GCIP instead of IAM.")
-	gcipProviderArg  = flag.String("gcip-provider", "google.com", "GCIP provider name.")
+	flCredentialFile  = flag.String("credential_file", "creds.json", "Credential file with id_token, refresh_token, and broker_cookie")
+	writeTimeout      = flag.Duration("write_timeout", 10*time.Second, "Write timeout")
+	brokerAudience    = flag.String("audience", "", "Broker web app OAuth client ID")
+	appClientID       = flag.String("clientID", "", "Desktop app OAuth client ID")
+	appClientSecret   = flag.String("clientSecret", "", "Desktop app OAuth client secret")
+	endpoint          = flag.String("endpoint", "DEFAULT_ENDPOINT", "Broker base URL, ex: broker.endpoints.PROJECT_ID.cloud.goog. A comma separated list of endpoints is tried in order, with failover")
+	remotePort        = flag.Int("remote_port", 22, "Remote port")
+	localPort         = flag.Int("local_port", 0, "Local port, default to remote_port")
+	localAddr         = flag.String("local_addr", "127.0.0.1", "Local address to listen on")
+	appName           = flag.String("app", "", "Name of broker app to connect to")
+	userCookie        = flag.String("cookie", "", "Broker user cookie for per-user routing")
+	gcipKeyArg        = flag.String("gcip-key", "", "API key used when endpoint uses GCIP instead of IAM.")
+	gcipProviderArg   = flag.String("gcip-provider", "google.com", "GCIP provider name.")
+	ensureRunning     = flag.Bool("ensure-running", false, "Start the app and wait for the remote port before listening (connect only)")
+	waitTimeout       = flag.Duration("wait_timeout", 5*time.Minute, "Maximum time to wait for the app and remote port to become ready")
+	pollInterval      = flag.Duration("poll_interval", 2*time.Second, "Interval between readiness checks")
+	doctorFormat      = flag.String("format", "text", "Output format of the doctor and bench commands: text or json")
+	sshUser           = flag.String("user", "", "SSH user name, default to the local user (ssh and cp only)")
+	sshIdentityFile   = flag.String("identity", "", "SSH private key file, default to the keys in ~/.ssh (ssh and cp only)")
+	sshKnownHostsFile = flag.String("known_hosts", "", "SSH known hosts file, default to ~/.ssh/known_hosts (ssh and cp only)")
+	sshForwardAgent   = flag.Bool("A", false, "Forward the SSH agent (ssh only)")
+	recursive         = flag.Bool("r", false, "Copy directories recursively (cp only)")
+	proxyURL          = flag.String("proxy", "", "HTTP proxy URL for all outbound connections, default to the HTTPS_PROXY environment variable")
+	proxyUser         = flag.String("proxy_user", "", "User name for proxy basic auth, the password is read from the SELKIES_PROXY_PASSWORD environment variable")
+	caFile            = flag.String("ca_file", "", "PEM bundle of additional CA certificates to trust, ex: for a TLS intercepting proxy")
+	clientCert        = flag.String("client_cert", "", "PEM client certificate for mTLS endpoints")
+	clientKey         = flag.String("client_key", "", "PEM client private key for mTLS endpoints")
+	controlSocket     = flag.String("control_socket", "", "Path of the daemon control socket, default to selkies-connector/control.sock in the user cache directory")
+	statusAddr        = flag.String("status_addr", "", "Local address to serve Prometheus metrics on /metrics and connection status on /status, ex: 127.0.0.1:9100. Disabled if empty")
+	uploadLimit       = flag.String("upload_limit", "", "Maximum upload rate of each forward in bytes per second, with an optional K, M or G suffix, ex: 10M. Unlimited if empty")
+	downloadLimit     = flag.String("download_limit", "", "Maximum download rate of each forward in bytes per second, with an optional K, M or G suffix. Unlimited if empty")
+	connUploadLimit   = flag.String("conn_upload_limit", "", "Maximum upload rate of each connection in bytes per second, with an optional K, M or G suffix. Unlimited if empty")
+	connDownloadLimit = flag.String("conn_download_limit", "", "Maximum download rate of each connection in bytes per second, with an optional K, M or G suffix. Unlimited if empty")
+	maxConns          = flag.Int("max_conns", 0, "Maximum number of concurrent connections of each forward. Unlimited if 0")
+	queueConns        = flag.Bool("queue_conns", false, "Queue connections over -max_conns until a connection closes instead of rejecting them")
+	allowRemote       = flag.Bool("allow_remote", false, "Confirm listening on a -local_addr that is not a loopback address")
+	allowCIDR         = flag.String("allow_cidr", "", "Comma separated source addresses or CIDRs allowed to connect to the local listener, ex: 10.0.0.0/8. All sources are allowed if empty")
+	localPSKFile      = flag.String("local_psk_file", "", "File with a pre-shared key that clients of the local listener must prove, see the dial command")
+	localTLSCert      = flag.String("local_tls_cert", "", "PEM certificate to serve TLS on the local listener")
+	localTLSKey       = flag.String("local_tls_key", "", "PEM private key to serve TLS on the local listener")
+	localTLSClientCA  = flag.String("local_tls_client_ca", "", "PEM CA bundle that signs the client certificates accepted by the local listener")
+	dialTLSCA         = flag.String("dial_tls_ca", "", "PEM CA bundle that signs the certificate of a listener started with -local_tls_cert, enables TLS (dial only)")
+	dialTLSCert       = flag.String("dial_tls_cert", "", "PEM client certificate for a listener started with -local_tls_client_ca (dial only)")
+	dialTLSKey        = flag.String("dial_tls_key", "", "PEM client private key for a listener started with -local_tls_client_ca (dial only)")
+	dialTLSServerName = flag.String("dial_tls_server_name", "", "Name to verify in the listener certificate, default to the host of HOST:PORT (dial only)")
+	capturePath       = flag.String("capture", "", "Write the traffic of each connection to a file for debugging, {id} in the path is replaced with the connection ID, ex: capture-{id}.pcapng. Disabled if empty")
+	captureFormat     = flag.String("capture_format", "pcapng", "Capture file format: pcapng with synthesized TCP packets, or jsonl")
+	captureMaxSize    = flag.String("capture_max_size", "100M", "Maximum size of each capture file, with an optional K, M or G suffix. Later data is not captured")
+	compression       = flag.Bool("compression", false, "Negotiate permessage-deflate compression of the websocket to the app proxy")
+	compressionLevel  = flag.Int("compression_level", 1, "Compression level from 1, fastest, to 9, smallest, with -compression")
+	wsReadBuffer      = flag.String("ws_read_buffer", "", "Size of the websocket read buffer, with an optional K, M or G suffix. Default if empty")
+	wsWriteBuffer     = flag.String("ws_write_buffer", "", "Size of the websocket write buffer, with an optional K, M or G suffix. Default if empty")
+	frameSize         = flag.String("frame_size", "32K", "Maximum payload of each websocket message sent to the app proxy, with an optional K, M or G suffix")
+	benchSize         = flag.String("bench_size", "64M", "Bytes echoed to measure throughput, with an optional K, M or G suffix (bench only)")
+	benchPings        = flag.Int("bench_pings", 20, "Number of round trips to measure latency (bench only)")
+	transportMode     = flag.String("transport", "auto", "Transport to the app proxy: auto, websocket or http. auto falls back to HTTP long-polling when websocket upgrades are blocked")
+	serveAddr         = flag.String("listen", "0.0.0.0:8023", "Address of the app proxy server (serve-http only)")
+	auditPath         = flag.String("audit_log", "", "Append a JSONL record of each tunneled connection to this file")
+	auditMaxSize      = flag.String("audit_log_max_size", "10M", "Rotate the audit log when it would grow past this size, with an optional K, M or G suffix. 0 disables rotation")
+	auditBackups      = flag.Int("audit_log_backups", 5, "Number of rotated audit logs to keep, as FILE.1 to FILE.N")
+	auditSyslog       = flag.String("audit_syslog", "", "Also send audit records to syslog: local, or an address like udp://HOST:514, tcp://HOST:514 or unix:///dev/log")
 
 	verbose = flag.Bool("verbose", false, "Verbose.")
 )
 
-func dialError(url string, resp *http.Response, err error) {
-	if resp != nil {
-		extra := ""
-		if *verbose {
-			b, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("Failed to read HTTP body: %v", err)
-			}
-			extra = "Body:\n" + string(b)
-		}
-		log.Fatalf("%s: HTTP error: %d %s\n%s", err, resp.StatusCode, resp.Status, extra)
+const usageText = `Usage: %s [command] [flags]
+
+Commands:
+  connect   Listen on a local port and tunnel connections to the app (default)
+  exec      Run a command with a tunnel to the app on a free local port:
+              exec [flags] -- command [args...]
+            The local port replaces {port} in the arguments and is exported
+            as SELKIES_LOCAL_PORT
+  start     Launch the app and wait until it is ready
+  stop      Shut down the app
+  wait      Wait until the app is ready
+  ssh       Open an SSH session to the app, or run a command:
+              ssh [flags] [-- command [args...]]
+  cp        Copy files to or from the app over SFTP, remote paths start with ':':
+              cp [flags] SRC :DST
+              cp [flags] :SRC DST
+  doctor    Check each stage of the connection and report the results
+  daemon    Log in once and manage forwards added through the control socket,
+            with -app a forward is added for the app
+  forward   Manage forwards of the running daemon:
+              forward add [flags]
+              forward rm [flags]
+              forward ls
+  logout    Stop the daemon and remove the saved credentials
+  bench     Measure the RTT and throughput to an echo service on the remote port
+  serve-http
+            Serve the app proxy websocket and the HTTP long-poll transport,
+            the fallback for networks that block websocket upgrades, in the
+            app pod
+  dial      Connect stdin and stdout to a listener started with -local_psk_file
+            or -local_tls_cert, for use as an SSH ProxyCommand:
+              dial [-local_psk_file FILE] [-dial_tls_ca FILE] HOST:PORT
+
+Flags:
+`
 
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usageText, os.Args[0])
+		flag.PrintDefaults()
 	}
-	log.Fatalf("Dial to %q fail: %v", url, err)
-}
 
-func main() {
-	flag.Parse()
+	command := "connect"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	forwardCommand := ""
+	if command == "forward" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		forwardCommand = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
-	if len(*endpoint) == 0 {
+	if len(endpointList()) == 0 && command != "serve-http" {
 		log.Fatalf("missing endpoint arg")
 	}
-	url := fmt.Sprintf("wss://%s/%s/connect/proxy/localhost/%d", *endpoint, *appName, *remotePort)
-	cookieUrl := fmt.Sprintf("https://%s/broker/%s/", *endpoint, *appName)
 
-	if len(*appName) == 0 {
-		log.Fatalf("missing app arg")
+	switch command {
+	case "daemon", "forward", "logout", "dial", "serve-http":
+		// The app is optional or passed to the daemon.
+	default:
+		if len(*appName) == 0 {
+			log.Fatalf("missing app arg")
+		}
 	}
 
-	if *localPort == 0 {
+	if *localPort == 0 && command != "exec" {
 		*localPort = *remotePort
 	}
 
@@ -105,37 +199,154 @@ func main() {
 		log.Printf("huproxyclient %s", huproxy.Version)
 	}
 
-	head := map[string][]string{}
-
-	audience := *brokerAudience
-	clientID := *appClientID
-	clientSecret := *appClientSecret
-	gcipKey := *gcipKeyArg
-	gcipProvider := *gcipProviderArg
+	if err := configureTransport(); err != nil {
+		log.Fatalf("invalid proxy or TLS settings: %v", err)
+	}
+	if err := configureWebsocket(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	switch *transportMode {
+	case tunnel.TransportAuto, tunnel.TransportWebsocket, tunnel.TransportHTTP:
+	default:
+		log.Fatalf("unknown -transport %q, expected auto, websocket or http", *transportMode)
+	}
+	if err := configureLimits(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := configureAccess(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := checkCaptureFlags(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := configureAudit(); err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	if len(audience) == 0 {
-		// Use default audience
-		audience = defaultAudience
-		if audience == "BROKER_CLIENT_ID" {
-			log.Fatalf("invalid audience: %v", audience)
+	switch command {
+	case "connect":
+		client := prepareConnect()
+		if len(*statusAddr) > 0 {
+			startStatusServer(*statusAddr)
+		}
+		listenAndServe(client)
+	case "exec":
+		if flag.NArg() == 0 {
+			log.Fatalf("missing command to run, usage: %s exec [flags] -- command [args...]", os.Args[0])
+		}
+		client := prepareConnect()
+		if len(*statusAddr) > 0 {
+			startStatusServer(*statusAddr)
+		}
+		os.Exit(runExec(client, flag.Args()))
+	case "start":
+		_, cache := newClient()
+		saveCredentials(cache)
+		if err := startApp(cache.IDToken); err != nil {
+			log.Fatalf("Failed to start app: %v", err)
+		}
+		if err := waitForApp(cache.IDToken, *waitTimeout); err != nil {
+			log.Fatalf("App did not become ready: %v", err)
+		}
+		log.Printf("App %s is ready", *appName)
+	case "stop":
+		_, cache := newClient()
+		saveCredentials(cache)
+		if err := stopApp(cache.IDToken); err != nil {
+			log.Fatalf("Failed to stop app: %v", err)
+		}
+		log.Printf("App %s is shutting down", *appName)
+	case "wait":
+		_, cache := newClient()
+		saveCredentials(cache)
+		if err := waitForApp(cache.IDToken, *waitTimeout); err != nil {
+			log.Fatalf("App did not become ready: %v", err)
 		}
+		log.Printf("App %s is ready", *appName)
+	case "ssh":
+		client := prepareConnect()
+		os.Exit(runSSH(client, flag.Args()))
+	case "cp":
+		if flag.NArg() != 2 {
+			log.Fatalf("usage: %s cp [flags] SRC DST", os.Args[0])
+		}
+		client := prepareConnect()
+		if err := runCopy(client, flag.Arg(0), flag.Arg(1)); err != nil {
+			log.Fatalf("Copy failed: %v", err)
+		}
+	case "bench":
+		client := prepareConnect()
+		if err := runBench(client); err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+	case "doctor":
+		if !runDoctor() {
+			os.Exit(1)
+		}
+	case "daemon":
+		runDaemon()
+	case "forward":
+		runForwardCommand(forwardCommand)
+	case "logout":
+		runLogout()
+	case "serve-http":
+		if err := runServeHTTP(*serveAddr); err != nil {
+			log.Fatalf("%v", err)
+		}
+	case "dial":
+		if flag.NArg() != 1 {
+			log.Fatalf("usage: %s dial [-local_psk_file FILE] [-dial_tls_ca FILE [-dial_tls_cert FILE -dial_tls_key FILE]] HOST:PORT", os.Args[0])
+		}
+		if err := runDial(flag.Arg(0)); err != nil {
+			log.Fatalf("%v", err)
+		}
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command: %s\n", command)
+		flag.Usage()
+		os.Exit(2)
 	}
+}
 
-	if len(clientID) == 0 {
-		// Use default client ID
-		clientID = defaultClientID
-		if clientID == "DESKTOP_APP_CLIENT_ID" {
-			log.Fatalf("invalid client ID: %v", clientID)
+// prepareConnect authenticates and returns a client with the broker cookie
+// for the app. With -ensure-running the app is started first and the call
+// blocks until the remote port accepts connections.
+func prepareConnect() *tunnel.Client {
+	client, cache := newClient()
+	if *ensureRunning {
+		if err := startApp(cache.IDToken); err != nil {
+			log.Fatalf("Failed to start app: %v", err)
+		}
+		if err := waitForApp(cache.IDToken, *waitTimeout); err != nil {
+			log.Fatalf("App did not become ready: %v", err)
 		}
 	}
 
-	if len(clientSecret) == 0 {
-		// Use default client secret
-		clientSecret = defaultClientSecret
-		if clientSecret == "DESKTOP_APP_CLIENT_SECRET" {
-			log.Fatalf("invalid client secret: %v", clientSecret)
+	brokerCookie, err := client.BrokerCookie(*appName)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cache.setEndpoint(client.Endpoint, cache.IDToken, brokerCookie)
+	saveCredentials(cache)
+
+	if *ensureRunning {
+		if err := waitForRemotePort(client, *waitTimeout); err != nil {
+			log.Fatalf("Remote port %d did not become ready: %v", *remotePort, err)
 		}
 	}
+	return client
+}
+
+// newClient loads or obtains a refresh token and returns a tunnel client that
+// refreshes ID tokens for the broker, exchanged for GCIP tokens when the
+// endpoint requires it. With several endpoints, the first healthy one is
+// returned and the others are kept in failover. The returned cache holds the
+// first ID token and any previously saved broker cookie of the endpoint,
+// which is also set on the client.
+func newClient() (*tunnel.Client, CredentialCache) {
+	audience, clientID, clientSecret, err := getOAuthClient()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	conf := &oauth2.Config{
 		ClientID:     clientID,
@@ -149,9 +360,8 @@ func main() {
 	}
 
 	var refreshToken string
-	var brokerCookie string
 	var cache CredentialCache
-	_, err := os.Stat(*flCredentialFile)
+	_, err = os.Stat(*flCredentialFile)
 	if *flCredentialFile == "" || os.IsNotExist(err) {
 		lurl := conf.AuthCodeURL("code")
 		fmt.Printf("\nVisit the URL for the auth dialog and enter the authorization code  \n\n%s\n\n", lurl)
@@ -172,256 +382,257 @@ func main() {
 		}
 		refreshToken = newTok.RefreshToken
 	} else {
-		f, err := os.Open(*flCredentialFile)
-		if err != nil {
-			log.Fatalf("Could not open credential File %v", err)
-		}
-		defer f.Close()
-
-		err = json.NewDecoder(f).Decode(&cache)
+		cache, err = loadCredentialCache(audience)
 		if err != nil {
-			log.Fatalf("Could not parse credential File %v", err)
+			log.Fatalf("%v", err)
 		}
 		refreshToken = cache.RefreshToken
+	}
 
-		var parser *jwt.Parser
-		parser = new(jwt.Parser)
-		tt, _, err := parser.ParseUnverified(cache.IDToken, &jwt.StandardClaims{})
-		if err != nil {
-			log.Fatalf("Could not parse saved id_token File %v", err)
+	var clients []*tunnel.Client
+	for _, ep := range endpointList() {
+		tokens := &tunnel.RefreshTokenSource{
+			Audience:     audience,
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RefreshToken: refreshToken,
+			HTTPClient:   newHTTPClient(),
+			OnRefresh: func(err error) {
+				authRefreshed("", err)
+			},
 		}
-
-		c, ok := tt.Claims.(*jwt.StandardClaims)
-		err = tt.Claims.Valid()
-		if ok && err == nil {
-			if c.Audience != audience {
-				log.Fatalf("Token audience does not match")
-			}
+		client := &tunnel.Client{
+			Endpoint:         ep,
+			Tokens:           tokens,
+			HTTPClient:       newHTTPClient(),
+			WebsocketDialer:  newWebsocketDialer(),
+			CompressionLevel: websocketCompressionLevel(),
+			FrameSize:        websocketFrameSize,
+			WriteTimeout:     *writeTimeout,
+			Transport:        *transportMode,
+			OnFallback: func(err error) {
+				log.Printf("Websocket upgrade failed (%v), using the HTTP long-poll transport", err)
+			},
 		}
-
-		brokerCookie = cache.BrokerCookie
+		if cookie := cache.brokerCookie(ep); len(*appName) > 0 && len(cookie) > 0 {
+			client.SetBrokerCookie(*appName, cookie)
+		}
+		clients = append(clients, client)
 	}
 
-	tok, err := oauth2oidc.GetIdToken(audience, clientID, clientSecret, refreshToken)
+	failover = &tunnel.Failover{
+		Clients:     clients,
+		HealthCheck: checkEndpoint,
+		OnSwitch: func(from, to *tunnel.Client, err error) {
+			metricEndpointSwitchesTotal.Inc()
+			log.Printf("Dials through %s keep failing (%v), moving new connections to %s", from.Endpoint, err, to.Endpoint)
+		},
+	}
+	client, err := failover.Select(context.Background(), *appName)
 	if err != nil {
-		log.Fatalf("Failed to get ID token: %v", err)
-	}
-	idToken := tok
-
-	if gcip, err := isEndpointGCIP(*endpoint); err != nil {
-		log.Fatalf("Could not detect GCIP: %v", err)
-	} else if gcip {
-		if len(gcipKey) == 0 {
-			// Use default API key
-			gcipKey = defaultGCIPKey
-			if defaultGCIPKey == "GCIP_API_KEY" {
-				log.Fatalf("invalid GCIP api key: %v", gcipKey)
-			}
-		}
-
-		if len(gcipProvider) == 0 {
-			log.Fatalf("invalid GCIP provider ID: %v", gcipProvider)
-		}
-
-		// Exchange token for GCIP token.
-		gcipTok, err := exchangeGCIP(idToken, gcipKey, gcipProvider)
-		if err != nil {
-			log.Fatalf("Failed to exchange GCIP token: %v", err)
-		}
-		idToken = gcipTok
+		log.Fatalf("No healthy endpoint: %v", err)
+	}
+	if len(clients) > 1 {
+		log.Printf("Using endpoint %s", client.Endpoint)
 	}
 
-	if len(brokerCookie) == 0 {
-		// Get broker cookie
-		client := http.Client{}
-		var cookie []*http.Cookie
-		req, _ := http.NewRequest("GET", cookieUrl, nil)
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
-		resp, err := client.Do(req)
-		if err != nil {
-			return
-		}
-		cookie = resp.Cookies()
-
-		// Find cookie
-		cookieName := fmt.Sprintf("broker_%s", *appName)
-		cookieValue := ""
-		for _, c := range cookie {
-			if c.Name == cookieName {
-				cookieValue = c.Value
-			}
-		}
-		if len(cookieValue) == 0 {
-			data, _ := io.ReadAll(resp.Body)
-			log.Fatalf("failed to get broker cookie for app: '%s' : %s", *appName, string(data))
-		}
-		brokerCookie = fmt.Sprintf("%s=%s", cookieName, cookieValue)
+	idToken, err := client.Tokens.IDToken()
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	// Cache token
-	cache.IDToken = idToken
 	cache.RefreshToken = refreshToken
-	cache.BrokerCookie = brokerCookie
-	cache.Endpoint = *endpoint
+	cache.setEndpoint(client.Endpoint, idToken, cache.brokerCookie(client.Endpoint))
 
-	f, err := os.OpenFile(*flCredentialFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Could not parse saved token File %v", err)
-	}
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "  ")
-	enc.Encode(cache)
-	f.Close()
+	return client, cache
+}
 
-	head["Authorization"] = []string{
-		fmt.Sprintf("Bearer %s", idToken),
-	}
+// getOAuthClient returns the broker audience and the desktop app OAuth client,
+// falling back to the defaults compiled into the binary.
+func getOAuthClient() (audience, clientID, clientSecret string, err error) {
+	audience = *brokerAudience
+	clientID = *appClientID
+	clientSecret = *appClientSecret
 
-	head["Cookie"] = []string{
-		brokerCookie,
+	if len(audience) == 0 {
+		// Use default audience
+		audience = defaultAudience
+		if audience == "BROKER_CLIENT_ID" {
+			return "", "", "", fmt.Errorf("invalid audience: %v", audience)
+		}
 	}
 
-	localListen := fmt.Sprintf("%s:%d", *localAddr, *localPort)
-
-	log.Printf("Listening for connections on %s to broker app %s port %d", localListen, *appName, *remotePort)
-	for {
-		// Local TCP listener
-		l, err := net.Listen("tcp", localListen)
-		if err != nil {
-			log.Fatalf("error listening on local port: %v", err)
+	if len(clientID) == 0 {
+		// Use default client ID
+		clientID = defaultClientID
+		if clientID == "DESKTOP_APP_CLIENT_ID" {
+			return "", "", "", fmt.Errorf("invalid client ID: %v", clientID)
 		}
-		defer l.Close()
+	}
 
-		for {
-			// Listen for an incoming connection.
-			l, err := l.Accept()
-			if err != nil {
-				fmt.Println("Error accepting: ", err.Error())
-				os.Exit(1)
-			}
-			// Handle connections in a new goroutine.
-			go func(lconn net.Conn) {
-				log.Printf("Creating new connection for client %s", lconn.RemoteAddr().String())
-				handleLocalConnection(lconn, url, head)
-				log.Printf("Connection closed for client %s", lconn.RemoteAddr().String())
-			}(l)
+	if len(clientSecret) == 0 {
+		// Use default client secret
+		clientSecret = defaultClientSecret
+		if clientSecret == "DESKTOP_APP_CLIENT_SECRET" {
+			return "", "", "", fmt.Errorf("invalid client secret: %v", clientSecret)
 		}
 	}
+
+	return audience, clientID, clientSecret, nil
 }
 
-func isEndpointGCIP(endpoint string) (bool, error) {
-	url := fmt.Sprintf("https://%s", endpoint)
-	client := http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-	req, _ := http.NewRequest("HEAD", url, nil)
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, err
+// getGCIPSettings returns the GCIP API key and provider ID, falling back to
+// the default API key compiled into the binary.
+func getGCIPSettings() (gcipKey, gcipProvider string, err error) {
+	gcipKey = *gcipKeyArg
+	gcipProvider = *gcipProviderArg
+
+	if len(gcipKey) == 0 {
+		// Use default API key
+		gcipKey = defaultGCIPKey
+		if defaultGCIPKey == "GCIP_API_KEY" {
+			return "", "", fmt.Errorf("invalid GCIP api key: %v", gcipKey)
+		}
 	}
 
-	if resp.StatusCode == 302 {
-		gcipLocationRE := regexp.MustCompile(".*googleapis.com/.*/gcip/resources.*")
-		return gcipLocationRE.MatchString(resp.Header.Get("location")), nil
+	if len(gcipProvider) == 0 {
+		return "", "", fmt.Errorf("invalid GCIP provider ID: %v", gcipProvider)
 	}
 
-	return false, nil
+	return gcipKey, gcipProvider, nil
 }
 
-func exchangeGCIP(token, apiKey, providerId string) (string, error) {
-	newTok := ""
+// loadCredentialCache reads the credential file and checks that the saved
+// ID token was issued for the audience.
+func loadCredentialCache(audience string) (CredentialCache, error) {
+	var cache CredentialCache
 
-	type gcipExchangeReqSpec struct {
-		PostBody          string `json:"postBody"`
-		RequestURI        string `json:"requestUri"`
-		ReturnSecureToken bool   `json:"returnSecureToken"`
+	f, err := os.Open(*flCredentialFile)
+	if err != nil {
+		return cache, fmt.Errorf("Could not open credential File %v", err)
 	}
+	defer f.Close()
 
-	type gcipExchangeRespSpec struct {
-		IDToken string `json:"idToken"`
+	err = json.NewDecoder(f).Decode(&cache)
+	if err != nil {
+		return cache, fmt.Errorf("Could not parse credential File %v", err)
 	}
 
-	data, _ := json.Marshal(&gcipExchangeReqSpec{
-		RequestURI:        "http://localhost",
-		ReturnSecureToken: true,
-		PostBody:          fmt.Sprintf("id_token=%s&providerId=%s", token, providerId),
-	})
-
-	url := fmt.Sprintf("https://identitytoolkit.googleapis.com/v1/accounts:signInWithIdp?key=%s", apiKey)
-	client := http.Client{}
-	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
+	var parser *jwt.Parser
+	parser = new(jwt.Parser)
+	tt, _, err := parser.ParseUnverified(cache.IDToken, &jwt.StandardClaims{})
 	if err != nil {
-		return newTok, err
-	}
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-	var result gcipExchangeRespSpec
-	if err := json.Unmarshal(body, &result); err != nil {
-		return newTok, err
+		return cache, fmt.Errorf("Could not parse saved id_token File %v", err)
 	}
 
-	newTok = result.IDToken
+	c, ok := tt.Claims.(*jwt.StandardClaims)
+	err = tt.Claims.Valid()
+	if ok && err == nil {
+		if c.Audience != audience {
+			return cache, fmt.Errorf("Token audience does not match")
+		}
+	}
 
-	return newTok, nil
+	return cache, nil
 }
 
-func handleLocalConnection(lconn net.Conn, url string, head map[string][]string) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// connect to huproxy websocket
-	dialer := websocket.Dialer{}
-	rconn, resp, err := dialer.Dial(url, head)
+// saveCredentials writes the credential cache to the credential file.
+func saveCredentials(cache CredentialCache) {
+	f, err := os.OpenFile(*flCredentialFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		dialError(url, resp, err)
+		log.Fatalf("Could not parse saved token File %v", err)
 	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	enc.Encode(cache)
+	f.Close()
+}
 
-	defer lconn.Close()
-	defer rconn.Close()
-
-	// websocket -> local socket
-	go func() {
-		for {
-			mt, r, err := rconn.NextReader()
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				return
-			}
-			if err != nil {
-				cancel()
-				return
-			}
-			if mt != websocket.BinaryMessage {
-				log.Println("invalid binary data from websocket")
-			}
-			if _, err := io.Copy(lconn, r); err != nil {
-				log.Printf("Reading from websocket: %v", err)
-				cancel()
-			}
-		}
-	}()
+func listenAndServe(client *tunnel.Client) {
+	localListen := fmt.Sprintf("%s:%d", *localAddr, *localPort)
 
-	// local socket -> websocket
+	log.Printf("Listening for connections on %s to broker app %s port %d", localListen, *appName, *remotePort)
 	for {
-		if err := huproxy.File2WS(ctx, cancel, lconn, rconn); err == io.EOF {
-			if err := rconn.WriteControl(websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-				time.Now().Add(*writeTimeout)); err == websocket.ErrCloseSent {
-			} else if err != nil {
-				log.Printf("Error sending close message: %v", err)
-			}
-		} else if err != nil {
-			log.Printf("reading from local socket: %v", err)
-			cancel()
+		// Local TCP listener
+		l, err := listenLocal(localListen)
+		if err != nil {
+			log.Fatalf("error listening on local port: %v", err)
 		}
+		defer l.Close()
 
-		if ctx.Err() != nil {
-			cancel()
-			return
+		if err := serveForward(l, client, *appName, *remotePort, forwardLimits); err != nil {
+			fmt.Println("Error accepting: ", err.Error())
+			os.Exit(1)
 		}
 	}
 }
+
+// newForward describes a listener that forwards to the app's remote port.
+func newForward(l net.Listener, app string, port int) ForwardStatus {
+	return ForwardStatus{
+		Name:       fmt.Sprintf("%s->%s:%d", l.Addr().String(), app, port),
+		LocalAddr:  l.Addr().String(),
+		App:        app,
+		RemotePort: port,
+	}
+}
+
+// serveForward accepts connections on l and tunnels each one to the app's
+// remote port until Accept fails. Connections are reported by the status
+// API and metrics.
+func serveForward(l net.Listener, client *tunnel.Client, app string, port int, limits tunnel.Limits) error {
+	forward := newForward(l, app, port)
+	tracker.addForward(forward)
+	defer tracker.removeForward(forward.Name)
+
+	tl := &tunnel.Listener{
+		Listener: l,
+		Client:   client,
+		Failover: failover,
+		Allow:    forwardAllow,
+		App:      app,
+		Host:     "localhost",
+		Port:     port,
+		Limits:   limits,
+		Hooks: tunnel.Hooks{
+			Accepted: func(lconn net.Conn) (net.Conn, error) {
+				log.Printf("Creating new connection for client %s", lconn.RemoteAddr().String())
+				conn := tracker.track(forward, lconn)
+				if len(*capturePath) > 0 {
+					captured, err := startCapture(conn.Conn, forward, conn.status.ID)
+					if err != nil {
+						log.Printf("Failed to capture connection %d: %v", conn.status.ID, err)
+					} else {
+						conn.Conn = captured
+					}
+				}
+				return conn, nil
+			},
+			Rejected: func(lconn net.Conn, reason error) {
+				metricRejectedConnectionsTotal.WithLabelValues(forward.Name).Inc()
+				auditRejected(forward, lconn, reason)
+			},
+			Dialed: func(conn net.Conn, endpoint string, d time.Duration, err error) {
+				conn.(*trackedConn).endpoint = endpoint
+				if err != nil {
+					metricDialFailuresTotal.WithLabelValues(forward.Name).Inc()
+					var dialErr *tunnel.DialError
+					if *verbose && errors.As(err, &dialErr) && dialErr.StatusCode != 0 {
+						log.Printf("Body:\n%s", dialErr.Body)
+					}
+					return
+				}
+				metricDialSeconds.WithLabelValues(forward.Name).Observe(d.Seconds())
+			},
+			AuthRefreshed: func(err error) {
+				authRefreshed(forward.Name, err)
+			},
+			Closed: func(conn net.Conn, reason string, err error) {
+				tracker.untrack(conn.(*trackedConn))
+				auditClosed(forward, conn.(*trackedConn), reason, err)
+				log.Printf("Connection closed for client %s", conn.RemoteAddr().String())
+			},
+		},
+	}
+	return tl.Serve()
+}
@@ -0,0 +1,237 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/term"
+	"selkies.io/connector/tunnel"
+)
+
+// Remote paths passed to the cp command start with this prefix.
+const remotePathPrefix = ":"
+
+// runCopy copies files between the local machine and the app over SFTP.
+// Exactly one of src and dst must be a remote path.
+func runCopy(tc *tunnel.Client, src, dst string) error {
+	srcRemote := strings.HasPrefix(src, remotePathPrefix)
+	dstRemote := strings.HasPrefix(dst, remotePathPrefix)
+	if srcRemote == dstRemote {
+		return fmt.Errorf("exactly one of the source and destination must be a remote path starting with %q", remotePathPrefix)
+	}
+
+	client, err := dialSSH(tc)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SSH server: %v", err)
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("failed to start SFTP session: %v", err)
+	}
+	defer sftpClient.Close()
+
+	if srcRemote {
+		return download(sftpClient, remotePath(src), dst)
+	}
+	return upload(sftpClient, src, remotePath(dst))
+}
+
+func remotePath(p string) string {
+	p = strings.TrimPrefix(p, remotePathPrefix)
+	if len(p) == 0 {
+		return "."
+	}
+	return p
+}
+
+// upload copies the local file or directory src to dst on the app. If dst is
+// an existing directory, src is copied into it.
+func upload(client *sftp.Client, src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() && !*recursive {
+		return fmt.Errorf("%s is a directory, use -r to copy directories", src)
+	}
+	if st, err := client.Stat(dst); err == nil && st.IsDir() {
+		dst = path.Join(dst, filepath.Base(src))
+	}
+
+	if !info.IsDir() {
+		return uploadFile(client, src, dst, info)
+	}
+
+	return filepath.Walk(src, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, localPath)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return client.MkdirAll(target)
+		}
+		if !info.Mode().IsRegular() {
+			log.Printf("Skipping %s: not a regular file", localPath)
+			return nil
+		}
+		return uploadFile(client, localPath, target, info)
+	})
+}
+
+func uploadFile(client *sftp.Client, src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := client.Create(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", dst, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, newProgressReader(in, dst, info.Size())); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", src, err)
+	}
+	return client.Chmod(dst, info.Mode().Perm())
+}
+
+// download copies the file or directory src on the app to the local path
+// dst. If dst is an existing directory, src is copied into it.
+func download(client *sftp.Client, src, dst string) error {
+	info, err := client.Stat(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	if info.IsDir() && !*recursive {
+		return fmt.Errorf("%s is a directory, use -r to copy directories", src)
+	}
+	if st, err := os.Stat(dst); err == nil && st.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	if !info.IsDir() {
+		return downloadFile(client, src, dst, info)
+	}
+
+	walker := client.Walk(src)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		remote := walker.Path()
+		info := walker.Stat()
+		rel := strings.TrimPrefix(strings.TrimPrefix(remote, src), "/")
+		target := filepath.Join(dst, filepath.FromSlash(rel))
+		if info.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			log.Printf("Skipping %s: not a regular file", remote)
+			continue
+		}
+		if err := downloadFile(client, remote, target, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadFile(client *sftp.Client, src, dst string, info os.FileInfo) error {
+	in, err := client.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, newProgressReader(in, dst, info.Size())); err != nil {
+		return fmt.Errorf("failed to download %s: %v", src, err)
+	}
+	return nil
+}
+
+// progressReader prints the transfer progress of a file to stderr.
+type progressReader struct {
+	r         io.Reader
+	name      string
+	size      int64
+	done      int64
+	lastPrint time.Time
+	tty       bool
+}
+
+func newProgressReader(r io.Reader, name string, size int64) *progressReader {
+	return &progressReader{
+		r:    r,
+		name: name,
+		size: size,
+		tty:  term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if err == io.EOF {
+		p.print(true)
+	} else if p.tty && time.Since(p.lastPrint) > 200*time.Millisecond {
+		p.print(false)
+	}
+	return n, err
+}
+
+func (p *progressReader) print(final bool) {
+	p.lastPrint = time.Now()
+	percent := int64(100)
+	if p.size > 0 {
+		percent = p.done * 100 / p.size
+	}
+	line := fmt.Sprintf("%s  %d/%d bytes  %d%%", p.name, p.done, p.size, percent)
+	switch {
+	case p.tty && final:
+		fmt.Fprintf(os.Stderr, "\r%s\n", line)
+	case p.tty:
+		fmt.Fprintf(os.Stderr, "\r%s", line)
+	case final:
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
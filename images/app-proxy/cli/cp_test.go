@@ -0,0 +1,106 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCopyRoundTrip(t *testing.T) {
+	s := newTestSSHServer(t)
+	confirmHostKey = func(hostname string, key ssh.PublicKey) bool { return true }
+
+	// The SFTP server of the test serves the local file system, remote is
+	// the file system of the app.
+	src := filepath.Join(t.TempDir(), "src")
+	remote := t.TempDir()
+	out := t.TempDir()
+
+	large := make([]byte, 256*1024)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{"a.txt", []byte("hello\n"), 0644},
+		{"empty", nil, 0644},
+		{"sub/large.bin", large, 0600},
+		{"sub/deeper/run.sh", []byte("#!/bin/sh\n"), 0755},
+	}
+	for _, f := range files {
+		name := filepath.Join(src, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, f.data, f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(name, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	*recursive = false
+	if err := runCopy(s.client, src, remotePathPrefix+remote); err == nil {
+		t.Fatalf("runCopy() of a directory without -r succeeded")
+	}
+	if err := runCopy(s.client, src, out); err == nil {
+		t.Fatalf("runCopy() between local paths succeeded")
+	}
+
+	*recursive = true
+	if err := runCopy(s.client, src, remotePathPrefix+remote); err != nil {
+		t.Fatalf("runCopy() upload failed: %v", err)
+	}
+	if err := runCopy(s.client, remotePathPrefix+filepath.ToSlash(filepath.Join(remote, "src")), out); err != nil {
+		t.Fatalf("runCopy() download failed: %v", err)
+	}
+
+	for _, dir := range []string{filepath.Join(remote, "src"), filepath.Join(out, "src")} {
+		for _, f := range files {
+			name := filepath.Join(dir, filepath.FromSlash(f.name))
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatalf("failed to read copied file: %v", err)
+			}
+			if !bytes.Equal(data, f.data) {
+				t.Errorf("%s has %d bytes different from the %d bytes of the source", name, len(data), len(f.data))
+			}
+			if runtime.GOOS == "windows" {
+				continue
+			}
+			info, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != f.mode {
+				t.Errorf("%s has mode %v, want %v", name, info.Mode().Perm(), f.mode)
+			}
+		}
+	}
+}
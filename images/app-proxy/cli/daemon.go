@@ -0,0 +1,440 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"selkies.io/connector/tunnel"
+)
+
+// ForwardRequest is the body of a request to add a forward to the daemon.
+type ForwardRequest struct {
+	App        string `json:"app"`
+	RemotePort int    `json:"remote_port"`
+	LocalAddr  string `json:"local_addr"`
+	LocalPort  int    `json:"local_port"`
+
+	// Limits of the forward, default to the limits of the daemon.
+	Limits *tunnel.Limits `json:"limits,omitempty"`
+}
+
+// controlError is the body of a failed control socket response.
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// forwarder is a local listener managed by the daemon.
+type forwarder struct {
+	status   ForwardStatus
+	listener net.Listener
+}
+
+type daemon struct {
+	sync.Mutex
+	client   *tunnel.Client
+	forwards map[string]*forwarder
+	shutdown chan struct{}
+	stopOnce sync.Once
+}
+
+func (d *daemon) addForward(req ForwardRequest) (ForwardStatus, error) {
+	if len(req.App) == 0 {
+		return ForwardStatus{}, fmt.Errorf("missing app")
+	}
+	if req.RemotePort == 0 {
+		return ForwardStatus{}, fmt.Errorf("missing remote port")
+	}
+	if len(req.LocalAddr) == 0 {
+		req.LocalAddr = "127.0.0.1"
+	}
+	if req.LocalPort == 0 {
+		req.LocalPort = req.RemotePort
+	}
+
+	l, err := listenLocal(net.JoinHostPort(req.LocalAddr, fmt.Sprint(req.LocalPort)))
+	if err != nil {
+		return ForwardStatus{}, fmt.Errorf("error listening on local port: %v", err)
+	}
+
+	f := &forwarder{
+		status:   newForward(l, req.App, req.RemotePort),
+		listener: l,
+	}
+
+	d.Lock()
+	d.forwards[f.status.LocalAddr] = f
+	d.Unlock()
+
+	log.Printf("Listening for connections on %s to broker app %s port %d", f.status.LocalAddr, req.App, req.RemotePort)
+	go func() {
+		limits := forwardLimits
+		if req.Limits != nil {
+			limits = *req.Limits
+		}
+		err := serveForward(l, d.client, req.App, req.RemotePort, limits)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error accepting on %s: %v", f.status.LocalAddr, err)
+		}
+		d.Lock()
+		if d.forwards[f.status.LocalAddr] == f {
+			delete(d.forwards, f.status.LocalAddr)
+		}
+		d.Unlock()
+	}()
+
+	return f.status, nil
+}
+
+// removeForward closes the forward listening on localAddr. The host is
+// resolved, ex: localhost:9000 removes the forward on 127.0.0.1:9000.
+func (d *daemon) removeForward(localAddr string) error {
+	ips, port, err := resolveLocalAddr(localAddr)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	var f *forwarder
+	for key, forward := range d.forwards {
+		if forward.listensOn(ips, port) {
+			f = forward
+			delete(d.forwards, key)
+			break
+		}
+	}
+	d.Unlock()
+	if f == nil {
+		return fmt.Errorf("no forward listening on %s", localAddr)
+	}
+	log.Printf("Removing forward %s", f.status.Name)
+	return f.listener.Close()
+}
+
+// resolveLocalAddr returns the IP addresses and port of a host:port address.
+// An empty host is the unspecified address.
+func resolveLocalAddr(addr string) ([]net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid local address %s: %v", addr, err)
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid local port %s: %v", portStr, err)
+	}
+	if len(host) == 0 {
+		return []net.IP{net.IPv6unspecified}, port, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, port, nil
+	}
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to resolve local address %s: %v", addr, err)
+	}
+	var ips []net.IP
+	for _, ipAddr := range ipAddrs {
+		ips = append(ips, ipAddr.IP)
+	}
+	return ips, port, nil
+}
+
+// listensOn returns whether the forward listens on port and one of the ips.
+// The unspecified IPv4 and IPv6 addresses match each other.
+func (f *forwarder) listensOn(ips []net.IP, port int) bool {
+	host, portStr, err := net.SplitHostPort(f.status.LocalAddr)
+	if err != nil || portStr != fmt.Sprint(port) {
+		return false
+	}
+	listenIP := net.ParseIP(host)
+	if listenIP == nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(listenIP) || ip.IsUnspecified() && listenIP.IsUnspecified() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *daemon) listForwards() []ForwardStatus {
+	d.Lock()
+	defer d.Unlock()
+	forwards := []ForwardStatus{}
+	for _, f := range d.forwards {
+		forwards = append(forwards, f.status)
+	}
+	return forwards
+}
+
+func (d *daemon) closeAll() {
+	d.Lock()
+	defer d.Unlock()
+	for localAddr, f := range d.forwards {
+		f.listener.Close()
+		delete(d.forwards, localAddr)
+	}
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forwards", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeControlResponse(w, http.StatusOK, d.listForwards())
+		case "POST":
+			var req ForwardRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeControlResponse(w, http.StatusBadRequest, controlError{err.Error()})
+				return
+			}
+			status, err := d.addForward(req)
+			if err != nil {
+				writeControlResponse(w, http.StatusBadRequest, controlError{err.Error()})
+				return
+			}
+			writeControlResponse(w, http.StatusCreated, status)
+		case "DELETE":
+			if err := d.removeForward(r.URL.Query().Get("local_addr")); err != nil {
+				writeControlResponse(w, http.StatusNotFound, controlError{err.Error()})
+				return
+			}
+			writeControlResponse(w, http.StatusOK, struct{}{})
+		default:
+			writeControlResponse(w, http.StatusMethodNotAllowed, controlError{"method not allowed"})
+		}
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeControlResponse(w, http.StatusMethodNotAllowed, controlError{"method not allowed"})
+			return
+		}
+		d.closeAll()
+		if err := removeCredentials(); err != nil {
+			writeControlResponse(w, http.StatusInternalServerError, controlError{err.Error()})
+			return
+		}
+		writeControlResponse(w, http.StatusOK, struct{}{})
+		d.stopOnce.Do(func() { close(d.shutdown) })
+	})
+	return mux
+}
+
+func writeControlResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// runDaemon logs in once, serves the control socket and manages forwards
+// until it is interrupted or logged out. If -app is set, a forward is added
+// for it from the -local_addr, -local_port and -remote_port flags.
+func runDaemon() {
+	socketPath := getControlSocket()
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		log.Fatalf("a daemon is already listening on %s", socketPath)
+	}
+	os.Remove(socketPath)
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		log.Fatalf("Could not create control socket directory: %v", err)
+	}
+
+	client, cache := newClient()
+	saveCredentials(cache)
+
+	d := &daemon{
+		client:   client,
+		forwards: make(map[string]*forwarder),
+		shutdown: make(chan struct{}),
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatalf("error listening on control socket: %v", err)
+	}
+	os.Chmod(socketPath, 0600)
+	defer os.Remove(socketPath)
+
+	server := &http.Server{Handler: d.handler()}
+	go server.Serve(l)
+	log.Printf("Daemon listening on control socket %s", socketPath)
+
+	if len(*statusAddr) > 0 {
+		startStatusServer(*statusAddr)
+	}
+
+	if len(*appName) > 0 {
+		if _, err := d.addForward(ForwardRequest{
+			App:        *appName,
+			RemotePort: *remotePort,
+			LocalAddr:  *localAddr,
+			LocalPort:  *localPort,
+		}); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sigs:
+		log.Printf("Shutting down daemon")
+	case <-d.shutdown:
+		log.Printf("Logged out, shutting down daemon")
+	}
+
+	d.closeAll()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// getControlSocket returns the path of the daemon control socket.
+func getControlSocket() string {
+	if len(*controlSocket) > 0 {
+		return *controlSocket
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "selkies-connector", "control.sock")
+}
+
+// controlRequest sends a request to the daemon over the control socket and
+// decodes the response into out.
+func controlRequest(method, path string, body interface{}, out interface{}) error {
+	socketPath := getControlSocket()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reqBody = bytes.NewReader(data)
+	}
+	req, _ := http.NewRequest(method, "http://daemon"+path, reqBody)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach the daemon on %s, start it with the daemon command: %v", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var cerr controlError
+		json.NewDecoder(resp.Body).Decode(&cerr)
+		return fmt.Errorf("%s", cerr.Error)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// runForwardCommand runs the forward add, rm and ls commands against the
+// daemon.
+func runForwardCommand(command string) {
+	switch command {
+	case "add":
+		if len(*appName) == 0 {
+			log.Fatalf("missing app arg")
+		}
+		req := ForwardRequest{
+			App:        *appName,
+			RemotePort: *remotePort,
+			LocalAddr:  *localAddr,
+			LocalPort:  *localPort,
+		}
+		if forwardLimits != (tunnel.Limits{}) {
+			req.Limits = &forwardLimits
+		}
+		var status ForwardStatus
+		err := controlRequest("POST", "/forwards", req, &status)
+		if err != nil {
+			log.Fatalf("Failed to add forward: %v", err)
+		}
+		fmt.Printf("Listening for connections on %s to broker app %s port %d\n", status.LocalAddr, status.App, status.RemotePort)
+	case "rm":
+		port := *localPort
+		if port == 0 {
+			port = *remotePort
+		}
+		addr := net.JoinHostPort(*localAddr, fmt.Sprint(port))
+		if err := controlRequest("DELETE", "/forwards?"+url.Values{"local_addr": {addr}}.Encode(), nil, nil); err != nil {
+			log.Fatalf("Failed to remove forward: %v", err)
+		}
+	case "ls":
+		var forwards []ForwardStatus
+		if err := controlRequest("GET", "/forwards", nil, &forwards); err != nil {
+			log.Fatalf("Failed to list forwards: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "LOCAL\tAPP\tREMOTE PORT")
+		for _, f := range forwards {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", f.LocalAddr, f.App, f.RemotePort)
+		}
+		w.Flush()
+	default:
+		log.Fatalf("unknown forward command: %q, expected add, rm or ls", command)
+	}
+}
+
+// runLogout asks the daemon to log out and shut down. If no daemon is
+// running, the credential file is removed directly.
+func runLogout() {
+	if err := controlRequest("POST", "/logout", nil, nil); err != nil {
+		if *verbose {
+			log.Printf("%v", err)
+		}
+		if err := removeCredentials(); err != nil {
+			log.Fatalf("Failed to remove credentials: %v", err)
+		}
+	}
+	log.Printf("Logged out")
+}
+
+// removeCredentials deletes the credential file.
+func removeCredentials() error {
+	if err := os.Remove(*flCredentialFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDaemonRemoveForward(t *testing.T) {
+	for _, tc := range []struct {
+		listen string
+		rm     string
+		found  bool
+	}{
+		{"127.0.0.1:0", "127.0.0.1:%d", true},
+		{"127.0.0.1:0", "localhost:%d", true},
+		{"0.0.0.0:0", ":%d", true},
+		{"0.0.0.0:0", "[::]:%d", true},
+		{"127.0.0.1:0", "127.0.0.2:%d", false},
+		{"127.0.0.1:0", "127.0.0.1:1", false},
+	} {
+		l, err := net.Listen("tcp", tc.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &daemon{forwards: make(map[string]*forwarder)}
+		f := &forwarder{status: newForward(l, "app", 22), listener: l}
+		d.forwards[f.status.LocalAddr] = f
+
+		rm := fmt.Sprintf(tc.rm, l.Addr().(*net.TCPAddr).Port)
+		err = d.removeForward(rm)
+		if tc.found != (err == nil) {
+			t.Errorf("removeForward(%q) of forward on %s returned %v, want found %v", rm, f.status.LocalAddr, err, tc.found)
+		}
+		if tc.found != (len(d.forwards) == 0) {
+			t.Errorf("removeForward(%q) left %d forwards", rm, len(d.forwards))
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"selkies.io/connector/tunnel"
+)
+
+const (
+	doctorStatusOK   = "ok"
+	doctorStatusFail = "fail"
+	doctorStatusSkip = "skip"
+)
+
+// DoctorResult is the outcome of a single diagnostic stage.
+type DoctorResult struct {
+	Stage    string        `json:"stage"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration_ns"`
+	Detail   string        `json:"detail,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Hint     string        `json:"hint,omitempty"`
+}
+
+// doctorStage is a single diagnostic step. It returns a detail message on
+// success, or an error and a hint for the user on failure.
+type doctorStage struct {
+	name string
+	run  func() (detail string, hint string, err error)
+}
+
+// runDoctor runs each connection stage on its own, prints the results and
+// returns false if any stage failed.
+func runDoctor() bool {
+	var (
+		host            = currentEndpoint()
+		gcip            bool
+		gcipChecked     bool
+		idToken         string
+		brokerCookie    string
+		client          *tunnel.Client
+		websocketFailed bool
+	)
+
+	stages := []doctorStage{
+		{"dns", func() (string, string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return "", "Check the -endpoint value and your DNS settings.", err
+			}
+			return strings.Join(addrs, ", "), "", nil
+		}},
+		{"tls", func() (string, string, error) {
+			client := newHTTPClient()
+			client.Timeout = 10 * time.Second
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			}
+			resp, err := client.Head(fmt.Sprintf("https://%s", host))
+			if err != nil {
+				var unknownAuthority x509.UnknownAuthorityError
+				if errors.As(err, &unknownAuthority) {
+					return "", "The certificate is not trusted by this system. If a proxy intercepts TLS, pass its CA bundle with -ca_file.", err
+				}
+				return "", "Check that outbound HTTPS to the endpoint is allowed by your network, and set -proxy or HTTPS_PROXY if a proxy is required.", err
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusProxyAuthRequired {
+				return "", "Set -proxy_user and SELKIES_PROXY_PASSWORD, or add the credentials to the proxy URL.", fmt.Errorf("proxy authentication required")
+			}
+			detail := "direct"
+			if u, err := httpTransport.Proxy(resp.Request); err == nil && u != nil {
+				detail = fmt.Sprintf("via proxy %s", u.Redacted())
+			}
+			if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+				cert := resp.TLS.PeerCertificates[0]
+				detail += fmt.Sprintf(", issuer %q, expires %s", cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339))
+			}
+			return detail, "", nil
+		}},
+		{"endpoints", func() (string, string, error) {
+			endpoints := endpointList()
+			if len(endpoints) < 2 {
+				return "", "", doctorSkip("single endpoint")
+			}
+			var down []string
+			for _, ep := range endpoints[1:] {
+				if _, err := tunnel.IsEndpointGCIP(newHTTPClient(), ep); err != nil {
+					down = append(down, fmt.Sprintf("%s: %v", ep, err))
+				}
+			}
+			if len(down) > 0 {
+				return "", "Failover to these endpoints would not work.", fmt.Errorf("%s", strings.Join(down, "; "))
+			}
+			return fmt.Sprintf("%d failover endpoints reachable, stages below check %s", len(endpoints)-1, host), "", nil
+		}},
+		{"auth_mode", func() (string, string, error) {
+			var err error
+			gcip, err = tunnel.IsEndpointGCIP(newHTTPClient(), host)
+			if err != nil {
+				return "", "Could not reach the endpoint to detect IAP or GCIP.", err
+			}
+			gcipChecked = true
+			if gcip {
+				return "GCIP", "", nil
+			}
+			return "IAP", "", nil
+		}},
+		{"token", func() (string, string, error) {
+			audience, clientID, clientSecret, err := getOAuthClient()
+			if err != nil {
+				return "", "Pass -audience, -clientID and -clientSecret or use a connector downloaded from the broker.", err
+			}
+			if _, err := os.Stat(*flCredentialFile); err != nil {
+				return "", "Run the connect command once to log in and create the credential file.", err
+			}
+			cache, err := loadCredentialCache(audience)
+			if err != nil {
+				return "", fmt.Sprintf("Delete %s and run the connect command to log in again.", *flCredentialFile), err
+			}
+			tokens := &tunnel.RefreshTokenSource{
+				Audience:     audience,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				RefreshToken: cache.RefreshToken,
+				HTTPClient:   newHTTPClient(),
+			}
+			idToken, err = tokens.IDToken()
+			if err != nil {
+				idToken = ""
+				return "", fmt.Sprintf("The refresh token may have been revoked. Delete %s and log in again.", *flCredentialFile), err
+			}
+			brokerCookie = cache.BrokerCookie
+			return "refreshed ID token", "", nil
+		}},
+		{"gcip_exchange", func() (string, string, error) {
+			if !gcipChecked || len(idToken) == 0 {
+				return "", "", errDoctorSkip
+			}
+			if !gcip {
+				return "not required for IAP", "", nil
+			}
+			gcipKey, gcipProvider, err := getGCIPSettings()
+			if err != nil {
+				return "", "Pass -gcip-key or use a connector downloaded from the broker.", err
+			}
+			gcipTok, err := tunnel.ExchangeGCIP(newHTTPClient(), idToken, gcipKey, gcipProvider)
+			if err == nil && len(gcipTok) == 0 {
+				err = fmt.Errorf("empty GCIP token returned")
+			}
+			if err != nil {
+				idToken = ""
+				return "", "Check the -gcip-key and -gcip-provider values.", err
+			}
+			idToken = gcipTok
+			return fmt.Sprintf("exchanged with provider %s", gcipProvider), "", nil
+		}},
+		{"broker_cookie", func() (string, string, error) {
+			if len(idToken) == 0 {
+				return "", "", errDoctorSkip
+			}
+			cookie, err := tunnel.BrokerCookie(newHTTPClient(), host, idToken, *appName)
+			if err != nil {
+				return "", "Check that your account has access to the app in the broker.", err
+			}
+			if len(brokerCookie) > 0 && brokerCookie != cookie {
+				brokerCookie = cookie
+				return "fetched, the cached cookie is out of date", "", nil
+			}
+			brokerCookie = cookie
+			return "fetched", "", nil
+		}},
+		{"websocket", func() (string, string, error) {
+			if len(idToken) == 0 || len(brokerCookie) == 0 {
+				return "", "", errDoctorSkip
+			}
+			c := newDoctorClient(host, idToken, brokerCookie, tunnel.TransportWebsocket)
+			rconn, err := c.DialWebsocket(context.Background(), *appName, "localhost", *remotePort)
+			if err != nil {
+				websocketFailed = true
+				var dialErr *tunnel.DialError
+				if errors.As(err, &dialErr) && dialErr.StatusCode != 0 {
+					return "", websocketHint(dialErr.StatusCode), fmt.Errorf("HTTP error: %s", dialErr.Status)
+				}
+				return "", "Your network may block websocket upgrades.", err
+			}
+			client = c
+			rconn.Close()
+			return "upgraded", "", nil
+		}},
+		{"http_fallback", func() (string, string, error) {
+			if !websocketFailed {
+				if client != nil {
+					return "not needed, the websocket was upgraded", "", nil
+				}
+				return "", "", errDoctorSkip
+			}
+			c := newDoctorClient(host, idToken, brokerCookie, tunnel.TransportHTTP)
+			conn, err := c.DialHTTP(context.Background(), *appName, "localhost", *remotePort)
+			if err != nil {
+				return "", "The app proxy may not serve the HTTP transport. Update the app-proxy image.", err
+			}
+			conn.Close()
+			client = c
+			return "HTTP long-poll works, -transport auto falls back to it", "", nil
+		}},
+		{"remote_port", func() (string, string, error) {
+			if client == nil {
+				return "", "", errDoctorSkip
+			}
+			if err := probeRemotePort(client); err != nil {
+				return "", fmt.Sprintf("Check that a service is listening on port %d inside the app.", *remotePort), err
+			}
+			return fmt.Sprintf("port %d accepts connections", *remotePort), "", nil
+		}},
+	}
+
+	ok := true
+	var results []DoctorResult
+	for _, stage := range stages {
+		start := time.Now()
+		detail, hint, err := stage.run()
+		result := DoctorResult{
+			Stage:    stage.name,
+			Status:   doctorStatusOK,
+			Duration: time.Since(start),
+			Detail:   detail,
+		}
+		var skip doctorSkip
+		if errors.As(err, &skip) {
+			result.Status = doctorStatusSkip
+			result.Detail = string(skip)
+		} else if err != nil {
+			ok = false
+			result.Status = doctorStatusFail
+			result.Error = err.Error()
+			result.Hint = hint
+		}
+		results = append(results, result)
+		if *doctorFormat != "json" {
+			printDoctorResult(result)
+		}
+	}
+
+	if *doctorFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+	}
+
+	return ok
+}
+
+// doctorSkip is returned by a stage that did not run, with the reason.
+type doctorSkip string
+
+func (s doctorSkip) Error() string {
+	return string(s)
+}
+
+// errDoctorSkip is returned by stages that need the result of an earlier
+// stage that failed.
+var errDoctorSkip = doctorSkip("skipped because an earlier stage failed")
+
+func printDoctorResult(result DoctorResult) {
+	fmt.Printf("%-14s %-5s %8s  %s\n", result.Stage, strings.ToUpper(result.Status), result.Duration.Round(time.Millisecond), result.Detail)
+	if len(result.Error) > 0 {
+		fmt.Printf("%-14s error: %s\n", "", result.Error)
+	}
+	if len(result.Hint) > 0 {
+		fmt.Printf("%-14s hint:  %s\n", "", result.Hint)
+	}
+}
+
+// websocketHint returns advice for an HTTP error returned by the websocket
+// upgrade request.
+func websocketHint(code int) string {
+	switch {
+	case code == 401 || code == 403:
+		return "The token or broker cookie was rejected. Delete the credential file and log in again."
+	case code == 404:
+		return "The app was not found. Check the -app value and that enableAppProxy is set for the app."
+	case code >= 500:
+		return "The app may not be running. Start it with the start command and try again."
+	}
+	return ""
+}
+
+// newDoctorClient returns a tunnel client for the websocket and transport
+// stages with the token and cookie from the earlier stages.
+func newDoctorClient(host, idToken, brokerCookie, transport string) *tunnel.Client {
+	c := &tunnel.Client{
+		Endpoint:         host,
+		Tokens:           tunnel.StaticTokenSource(idToken),
+		HTTPClient:       newHTTPClient(),
+		WebsocketDialer:  newWebsocketDialer(),
+		CompressionLevel: websocketCompressionLevel(),
+		FrameSize:        websocketFrameSize,
+		WriteTimeout:     *writeTimeout,
+		Transport:        transport,
+	}
+	c.SetBrokerCookie(*appName, brokerCookie)
+	return c
+}
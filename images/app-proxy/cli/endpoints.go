@@ -0,0 +1,95 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"selkies.io/connector/tunnel"
+)
+
+// failover holds a client for each endpoint of -endpoint once newClient
+// selected one.
+var failover *tunnel.Failover
+
+// endpointList returns the endpoints of -endpoint in priority order.
+func endpointList() []string {
+	var endpoints []string
+	for _, ep := range strings.Split(*endpoint, ",") {
+		if ep = strings.TrimSpace(ep); len(ep) > 0 {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+// currentEndpoint returns the endpoint used for broker requests and new
+// connections.
+func currentEndpoint() string {
+	if failover != nil {
+		return failover.Current().Endpoint
+	}
+	if endpoints := endpointList(); len(endpoints) > 0 {
+		return endpoints[0]
+	}
+	return ""
+}
+
+// checkEndpoint is the health check of the failover. The HEAD probe also
+// detects whether the endpoint uses GCIP, which configures the token
+// exchange before the broker is pinged with a token.
+func checkEndpoint(ctx context.Context, c *tunnel.Client, app string) error {
+	gcip, err := tunnel.IsEndpointGCIP(c.HTTPClient, c.Endpoint)
+	if err != nil {
+		return err
+	}
+	if tokens, ok := c.Tokens.(*tunnel.RefreshTokenSource); ok && gcip {
+		gcipKey, gcipProvider, err := getGCIPSettings()
+		if err != nil {
+			return err
+		}
+		tokens.SetGCIP(&tunnel.GCIPConfig{APIKey: gcipKey, ProviderID: gcipProvider})
+	}
+	if len(app) == 0 {
+		return nil
+	}
+	return c.Ping(ctx, app)
+}
+
+// brokerCookie returns the saved broker cookie of the endpoint. Caches saved
+// before endpoints were tracked hold a single cookie.
+func (c *CredentialCache) brokerCookie(endpoint string) string {
+	if creds, ok := c.Endpoints[endpoint]; ok {
+		return creds.BrokerCookie
+	}
+	if c.Endpoint == endpoint || len(c.Endpoint) == 0 {
+		return c.BrokerCookie
+	}
+	return ""
+}
+
+// setEndpoint records the credentials of the endpoint in use.
+func (c *CredentialCache) setEndpoint(endpoint, idToken, brokerCookie string) {
+	c.Endpoint = endpoint
+	c.IDToken = idToken
+	c.BrokerCookie = brokerCookie
+	if c.Endpoints == nil {
+		c.Endpoints = make(map[string]EndpointCredentials)
+	}
+	c.Endpoints[endpoint] = EndpointCredentials{IDToken: idToken, BrokerCookie: brokerCookie}
+}
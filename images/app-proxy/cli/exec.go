@@ -0,0 +1,116 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"selkies.io/connector/tunnel"
+)
+
+// runExec starts a tunnel on a local port, runs the command with the port
+// substituted for {port} and exported as SELKIES_LOCAL_PORT, and returns the
+// exit code of the command. The tunnel is closed when the command exits.
+func runExec(client *tunnel.Client, args []string) int {
+	localListen := fmt.Sprintf("%s:%d", *localAddr, *localPort)
+	l, err := listenLocal(localListen)
+	if err != nil {
+		log.Fatalf("error listening on local port: %v", err)
+	}
+	defer l.Close()
+
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	if *verbose {
+		log.Printf("Listening for connections on %s to broker app %s port %d", l.Addr().String(), *appName, *remotePort)
+	}
+
+	go func() {
+		if err := serveForward(l, client, *appName, *remotePort, forwardLimits); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error accepting: %v", err)
+		}
+	}()
+
+	cmdArgs := make([]string, len(args))
+	for i, arg := range args {
+		cmdArgs[i] = strings.ReplaceAll(arg, "{port}", port)
+	}
+
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SELKIES_LOCAL_PORT="+port,
+		"SELKIES_LOCAL_ADDR="+*localAddr,
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Forward signals to the command while it runs.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		log.Printf("Failed to run %s: %v", cmdArgs[0], err)
+		return 127
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if code, ok := exitCode(exitErr); ok {
+				return code
+			}
+		}
+		log.Printf("Failed to wait for %s: %v", cmdArgs[0], err)
+		return 1
+	}
+	return 0
+}
+
+// exitCode returns the exit code of a command, or 128+signal if the command
+// was killed by a signal, like ssh and the shell do.
+func exitCode(exitErr *exec.ExitError) (int, bool) {
+	if code := exitErr.ExitCode(); code >= 0 {
+		return code, true
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,83 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"selkies.io/connector/tunnel"
+)
+
+// forwardLimits holds the bandwidth and connection limits from the flags,
+// applied to the forwards of the connect, exec and daemon commands.
+var forwardLimits tunnel.Limits
+
+// configureLimits parses the limit flags into forwardLimits.
+func configureLimits() error {
+	rates := []struct {
+		name  string
+		value string
+		dst   *int64
+	}{
+		{"upload_limit", *uploadLimit, &forwardLimits.UploadRate},
+		{"download_limit", *downloadLimit, &forwardLimits.DownloadRate},
+		{"conn_upload_limit", *connUploadLimit, &forwardLimits.ConnUploadRate},
+		{"conn_download_limit", *connDownloadLimit, &forwardLimits.ConnDownloadRate},
+	}
+	for _, r := range rates {
+		rate, err := parseBytes(r.value)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %v", r.name, err)
+		}
+		*r.dst = rate
+	}
+	if *maxConns < 0 {
+		return fmt.Errorf("invalid -max_conns: must not be negative")
+	}
+	forwardLimits.MaxConns = *maxConns
+	forwardLimits.QueueConns = *queueConns
+	return nil
+}
+
+// parseBytes parses a number of bytes, or bytes per second, with an optional
+// K, M or G suffix for powers of 1024, ex: 512K or 10M. An empty string is
+// zero, which means unlimited.
+func parseBytes(value string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(value))
+	if len(s) == 0 {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a number of bytes", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,267 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "selkies_connector_active_connections",
+		Help: "Number of open connections.",
+	}, []string{"forward"})
+
+	metricConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "selkies_connector_connections_total",
+		Help: "Total number of accepted connections.",
+	}, []string{"forward"})
+
+	metricBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "selkies_connector_bytes_total",
+		Help: "Total bytes transferred. Direction in is from the app to the local client, out is from the local client to the app.",
+	}, []string{"forward", "direction"})
+
+	metricRejectedConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "selkies_connector_rejected_connections_total",
+		Help: "Total number of connections rejected because of the connection limit or a failed local handshake.",
+	}, []string{"forward"})
+
+	metricDialSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "selkies_connector_dial_seconds",
+		Help:    "Time to open the websocket to the app proxy.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"forward"})
+
+	metricDialFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "selkies_connector_dial_failures_total",
+		Help: "Total number of failed websocket dials to the app proxy.",
+	}, []string{"forward"})
+
+	metricAuthRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "selkies_connector_auth_refreshes_total",
+		Help: "Total number of ID token refreshes and GCIP exchanges. The forward is empty for refreshes not made to dial a connection, ex: at startup.",
+	}, []string{"forward"})
+
+	metricAuthFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "selkies_connector_auth_failures_total",
+		Help: "Total number of failed ID token refreshes and GCIP exchanges. The forward is empty for refreshes not made to dial a connection.",
+	}, []string{"forward"})
+
+	metricEndpointSwitchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "selkies_connector_endpoint_switches_total",
+		Help: "Total number of times new connections moved to another endpoint.",
+	})
+)
+
+// ForwardStatus describes a local listener and the app port it forwards to.
+type ForwardStatus struct {
+	Name       string `json:"name"`
+	LocalAddr  string `json:"local_addr"`
+	App        string `json:"app"`
+	RemotePort int    `json:"remote_port"`
+}
+
+// ConnectionStatus describes a live connection through a forward.
+type ConnectionStatus struct {
+	ID         uint64    `json:"id"`
+	Forward    string    `json:"forward"`
+	ClientAddr string    `json:"client_addr"`
+	Target     string    `json:"target"`
+	StartTime  time.Time `json:"start_time"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+// trackedConn counts the bytes read from and written to a local client
+// connection.
+type trackedConn struct {
+	// The byte counts are updated atomically, first in the struct to be 64-bit
+	// aligned on 32-bit platforms. The BytesIn and BytesOut of status are
+	// unused.
+	bytesInCount  int64
+	bytesOutCount int64
+
+	net.Conn
+	status   ConnectionStatus
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+
+	// endpoint is the broker endpoint the connection was dialed through.
+	endpoint string
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesOutCount, int64(n))
+	c.bytesOut.Add(float64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesInCount, int64(n))
+	c.bytesIn.Add(float64(n))
+	return n, err
+}
+
+// connectionStatus returns the status of the connection with the current
+// byte counts.
+func (c *trackedConn) connectionStatus() ConnectionStatus {
+	return ConnectionStatus{
+		ID:         c.status.ID,
+		Forward:    c.status.Forward,
+		ClientAddr: c.status.ClientAddr,
+		Target:     c.status.Target,
+		StartTime:  c.status.StartTime,
+		BytesIn:    atomic.LoadInt64(&c.bytesInCount),
+		BytesOut:   atomic.LoadInt64(&c.bytesOutCount),
+	}
+}
+
+// statusTracker holds the forwards and live connections reported by the
+// status API.
+type statusTracker struct {
+	sync.Mutex
+	nextID      uint64
+	forwards    map[string]ForwardStatus
+	connections map[uint64]*trackedConn
+}
+
+var tracker = &statusTracker{
+	forwards:    make(map[string]ForwardStatus),
+	connections: make(map[uint64]*trackedConn),
+}
+
+func (t *statusTracker) addForward(forward ForwardStatus) {
+	t.Lock()
+	defer t.Unlock()
+	t.forwards[forward.Name] = forward
+}
+
+func (t *statusTracker) removeForward(name string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.forwards, name)
+}
+
+// track wraps a newly accepted client connection so that it is listed by the
+// status API and counted in the metrics until untrack is called.
+func (t *statusTracker) track(forward ForwardStatus, lconn net.Conn) *trackedConn {
+	t.Lock()
+	defer t.Unlock()
+	t.nextID++
+	conn := &trackedConn{
+		Conn: lconn,
+		status: ConnectionStatus{
+			ID:         t.nextID,
+			Forward:    forward.Name,
+			ClientAddr: lconn.RemoteAddr().String(),
+			Target:     forward.target(),
+			StartTime:  time.Now(),
+		},
+		bytesIn:  metricBytesTotal.WithLabelValues(forward.Name, "in"),
+		bytesOut: metricBytesTotal.WithLabelValues(forward.Name, "out"),
+	}
+	t.connections[conn.status.ID] = conn
+
+	metricConnectionsTotal.WithLabelValues(forward.Name).Inc()
+	metricActiveConnections.WithLabelValues(forward.Name).Inc()
+	return conn
+}
+
+func (t *statusTracker) untrack(conn *trackedConn) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.connections, conn.status.ID)
+	metricActiveConnections.WithLabelValues(conn.status.Forward).Dec()
+}
+
+// StatusResponse is returned by the /status endpoint.
+type StatusResponse struct {
+	Endpoint    string             `json:"endpoint"`
+	Forwards    []ForwardStatus    `json:"forwards"`
+	Connections []ConnectionStatus `json:"connections"`
+}
+
+func (t *statusTracker) status() StatusResponse {
+	t.Lock()
+	defer t.Unlock()
+	resp := StatusResponse{
+		Endpoint:    currentEndpoint(),
+		Forwards:    []ForwardStatus{},
+		Connections: []ConnectionStatus{},
+	}
+	for _, forward := range t.forwards {
+		resp.Forwards = append(resp.Forwards, forward)
+	}
+	for _, conn := range t.connections {
+		resp.Connections = append(resp.Connections, conn.connectionStatus())
+	}
+	sort.Slice(resp.Forwards, func(i, j int) bool { return resp.Forwards[i].Name < resp.Forwards[j].Name })
+	sort.Slice(resp.Connections, func(i, j int) bool { return resp.Connections[i].ID < resp.Connections[j].ID })
+	return resp
+}
+
+// authRefreshed counts a token refresh made for the forward, or for no
+// forward if empty.
+func authRefreshed(forward string, err error) {
+	metricAuthRefreshesTotal.WithLabelValues(forward).Inc()
+	if err != nil {
+		metricAuthFailuresTotal.WithLabelValues(forward).Inc()
+	}
+}
+
+func (f ForwardStatus) target() string {
+	return net.JoinHostPort(f.App, fmt.Sprint(f.RemotePort))
+}
+
+// startStatusServer serves Prometheus metrics on /metrics and the forwards and
+// live connections on /status.
+func startStatusServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(tracker.status())
+	})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("error listening on status address: %v", err)
+	}
+	log.Printf("Serving metrics on http://%s/metrics and status on http://%s/status", l.Addr(), l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("Status server stopped: %v", err)
+		}
+	}()
+}
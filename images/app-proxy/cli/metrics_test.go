@@ -0,0 +1,70 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestStatusTrackerCounts(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	st := &statusTracker{
+		forwards:    make(map[string]ForwardStatus),
+		connections: make(map[uint64]*trackedConn),
+	}
+	conn := st.track(ForwardStatus{Name: "test"}, server)
+	defer st.untrack(conn)
+
+	// The counts are read while the connection is in use.
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, io.LimitReader(zeroReader{}, n))
+		conn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(io.Discard, client)
+	}()
+	for i := 0; i < 10; i++ {
+		st.status()
+	}
+	wg.Wait()
+
+	resp := st.status()
+	if len(resp.Connections) != 1 {
+		t.Fatalf("status() returned %d connections, want 1", len(resp.Connections))
+	}
+	if got := resp.Connections[0]; got.BytesIn != n || got.BytesOut != 0 || got.Forward != "test" {
+		t.Errorf("status() returned %+v, want %d bytes in", got, n)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
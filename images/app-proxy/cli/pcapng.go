@@ -0,0 +1,205 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// pcapng block types and the raw IPv4 link type.
+const (
+	pcapngSectionHeader    = 0x0A0D0D0A
+	pcapngInterface        = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngLinkTypeRaw      = 101
+	pcapngMaxSegment       = 65535 - 40
+	pcapngClientInitialSeq = 1000
+	pcapngServerInitialSeq = 5000
+)
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapngWriter writes the stream of a connection as IPv4 TCP packets in a
+// pcapng file, with a synthesized handshake and close, so that it can be
+// dissected and followed in Wireshark. The server is the local address of
+// the listener with the remote port of the app, so that the protocol is
+// detected from the port.
+type pcapngWriter struct {
+	w      io.Writer
+	client *net.TCPAddr
+	server *net.TCPAddr
+	// Next sequence number sent by the client and the server.
+	seq [2]uint32
+}
+
+func newPcapngWriter(w io.Writer, client, local net.Addr, remotePort int) *pcapngWriter {
+	return &pcapngWriter{
+		w:      w,
+		client: captureAddr(client, net.IPv4(127, 0, 0, 1)),
+		server: &net.TCPAddr{IP: captureAddr(local, net.IPv4(127, 0, 0, 2)).IP, Port: remotePort},
+		seq:    [2]uint32{pcapngClientInitialSeq, pcapngServerInitialSeq},
+	}
+}
+
+// captureAddr returns addr as an IPv4 TCP address, or the fallback IP for
+// addresses that are not IPv4.
+func captureAddr(addr net.Addr, fallback net.IP) *net.TCPAddr {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return &net.TCPAddr{IP: fallback.To4()}
+	}
+	ip := tcpAddr.IP.To4()
+	if ip == nil {
+		ip = fallback.To4()
+	}
+	return &net.TCPAddr{IP: ip, Port: tcpAddr.Port}
+}
+
+func (p *pcapngWriter) start(t time.Time) error {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapngLinkTypeRaw)
+
+	var b []byte
+	b = append(b, pcapngBlock(pcapngSectionHeader, shb)...)
+	b = append(b, pcapngBlock(pcapngInterface, idb)...)
+	b = append(b, p.packet(t, true, tcpSYN, nil)...)
+	b = append(b, p.packet(t, false, tcpSYN|tcpACK, nil)...)
+	b = append(b, p.packet(t, true, tcpACK, nil)...)
+	_, err := p.w.Write(b)
+	return err
+}
+
+func (p *pcapngWriter) data(t time.Time, direction string, data []byte) error {
+	fromClient := direction == captureOut
+	var b []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+		b = append(b, p.packet(t, fromClient, tcpPSH|tcpACK, data[:n])...)
+		data = data[n:]
+	}
+	_, err := p.w.Write(b)
+	return err
+}
+
+func (p *pcapngWriter) end(t time.Time) error {
+	var b []byte
+	b = append(b, p.packet(t, true, tcpFIN|tcpACK, nil)...)
+	b = append(b, p.packet(t, false, tcpFIN|tcpACK, nil)...)
+	b = append(b, p.packet(t, true, tcpACK, nil)...)
+	_, err := p.w.Write(b)
+	return err
+}
+
+// packet returns an enhanced packet block with an IPv4 TCP segment and
+// advances the sequence number of the sender.
+func (p *pcapngWriter) packet(t time.Time, fromClient bool, flags byte, payload []byte) []byte {
+	src, dst := p.client, p.server
+	from, to := 0, 1
+	if !fromClient {
+		src, dst = dst, src
+		from, to = to, from
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], p.seq[from])
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], p.seq[to])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:], src.IP)
+	copy(pseudo[4:], dst.IP)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], src.IP)
+	copy(ip[16:], dst.IP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+	advance := uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		advance++
+	}
+	p.seq[from] += advance
+
+	pkt := append(ip, tcp...)
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	epb := make([]byte, 20, 20+len(pkt))
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(pkt)))
+	return pcapngBlock(pcapngEnhancedPacket, append(epb, pkt...))
+}
+
+// pcapngBlock frames the body as a pcapng block, padded to 32 bits.
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	padded := (len(body) + 3) &^ 3
+	total := 12 + padded
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	return b
+}
+
+// checksum returns the internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
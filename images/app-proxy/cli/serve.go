@@ -0,0 +1,42 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"selkies.io/connector/tunnel"
+)
+
+// runServeHTTP serves the app proxy websocket under /proxy/ and the HTTP
+// long-poll transport under /poll/ on addr. It runs in the app pod, where
+// /<app>/connect/proxy/ and /<app>/connect/poll/ are routed to it.
+func runServeHTTP(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/proxy/", &tunnel.ProxyHandler{
+		ReadBufferSize:  websocketReadBufferSize,
+		WriteBufferSize: websocketWriteBufferSize,
+		FrameSize:       websocketFrameSize,
+	})
+	mux.Handle("/poll/", &tunnel.PollHandler{})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	log.Printf("Serving the app proxy on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
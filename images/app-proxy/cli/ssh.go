@@ -0,0 +1,339 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+	"selkies.io/connector/tunnel"
+)
+
+var defaultIdentityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// dialSSH opens an SSH client connection to the remote port over the tunnel.
+func dialSSH(tc *tunnel.Client) (*ssh.Client, error) {
+	hostKeyCallback, err := getHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            getSSHUser(),
+		Auth:            getSSHAuthMethods(),
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	conn, err := tc.Dial(context.Background(), *appName, "localhost", *remotePort)
+	if err != nil {
+		return nil, err
+	}
+
+	// The host key is known by app and endpoint host, a port in the endpoint
+	// would make an invalid known hosts entry.
+	endpointHost := tc.Endpoint
+	if host, _, err := net.SplitHostPort(tc.Endpoint); err == nil {
+		endpointHost = host
+	}
+	addr := net.JoinHostPort(fmt.Sprintf("%s.%s", *appName, endpointHost), fmt.Sprint(*remotePort))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// runSSH opens an interactive shell, or runs the command if one is given,
+// and returns the exit status of the remote command.
+func runSSH(tc *tunnel.Client, args []string) int {
+	client, err := dialSSH(tc)
+	if err != nil {
+		log.Fatalf("Failed to connect to SSH server: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		log.Fatalf("Failed to create SSH session: %v", err)
+	}
+	defer session.Close()
+
+	if *sshForwardAgent {
+		if agentClient := getSSHAgent(); agentClient != nil {
+			if err := agent.ForwardToAgent(client, agentClient); err != nil {
+				log.Fatalf("Failed to forward SSH agent: %v", err)
+			}
+			if err := agent.RequestAgentForwarding(session); err != nil {
+				log.Printf("Failed to request agent forwarding: %v", err)
+			}
+		} else {
+			log.Printf("No SSH agent found, agent forwarding is disabled")
+		}
+	}
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	fd := int(os.Stdin.Fd())
+	if len(args) == 0 && term.IsTerminal(fd) {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil {
+			width, height = 80, 24
+		}
+		termType := os.Getenv("TERM")
+		if len(termType) == 0 {
+			termType = "xterm-256color"
+		}
+		if err := session.RequestPty(termType, height, width, ssh.TerminalModes{}); err != nil {
+			log.Fatalf("Failed to request PTY: %v", err)
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Fatalf("Failed to set terminal to raw mode: %v", err)
+		}
+		defer term.Restore(fd, state)
+
+		stopResize := watchWindowSize(session)
+		defer stopResize()
+
+		if err := session.Shell(); err != nil {
+			log.Fatalf("Failed to start shell: %v", err)
+		}
+		err = session.Wait()
+		return sshExitStatus(err)
+	}
+
+	err = session.Run(strings.Join(args, " "))
+	return sshExitStatus(err)
+}
+
+func sshExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	var missingErr *ssh.ExitMissingError
+	if errors.As(err, &missingErr) {
+		return 255
+	}
+	log.Printf("SSH session failed: %v", err)
+	return 255
+}
+
+func getSSHUser() string {
+	if len(*sshUser) > 0 {
+		return *sshUser
+	}
+	if user := os.Getenv("USER"); len(user) > 0 {
+		return user
+	}
+	return os.Getenv("USERNAME")
+}
+
+// getSSHAgent returns a client for the agent at SSH_AUTH_SOCK, or nil if
+// there is no agent.
+func getSSHAgent() agent.ExtendedAgent {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		if *verbose {
+			log.Printf("Failed to connect to SSH agent: %v", err)
+		}
+		return nil
+	}
+	return agent.NewClient(conn)
+}
+
+// getSSHAuthMethods returns the agent, identity file, password and
+// keyboard-interactive auth methods, in that order.
+func getSSHAuthMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if agentClient := getSSHAgent(); agentClient != nil {
+		methods = append(methods, ssh.PublicKeysCallback(agentClient.Signers))
+	}
+
+	var signers []ssh.Signer
+	for _, path := range getIdentityFiles() {
+		signer, err := loadIdentityFile(path)
+		if err != nil {
+			log.Printf("Skipping identity file %s: %v", path, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	methods = append(methods,
+		ssh.PasswordCallback(func() (string, error) {
+			return readSecret(fmt.Sprintf("%s's password: ", getSSHUser()))
+		}),
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			if len(instruction) > 0 {
+				fmt.Fprintln(os.Stderr, instruction)
+			}
+			answers := make([]string, len(questions))
+			for i, question := range questions {
+				answer, err := readSecret(question)
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = answer
+			}
+			return answers, nil
+		}),
+	)
+
+	return methods
+}
+
+// getIdentityFiles returns the -identity file, or the default identity files
+// that exist in ~/.ssh.
+func getIdentityFiles() []string {
+	if len(*sshIdentityFile) > 0 {
+		return []string{*sshIdentityFile}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, name := range defaultIdentityFiles {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+func loadIdentityFile(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var passErr *ssh.PassphraseMissingError
+	if errors.As(err, &passErr) {
+		passphrase, err := readSecret(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	return signer, err
+}
+
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("cannot prompt for %q: stdin is not a terminal", strings.TrimSpace(prompt))
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(secret), err
+}
+
+// getHostKeyCallback checks host keys against the known hosts file. Unknown
+// hosts are added after the user confirms the fingerprint.
+func getHostKeyCallback() (ssh.HostKeyCallback, error) {
+	path := *sshKnownHostsFile
+	if len(path) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts file %s: %v", path, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key for %s does not match %s, the key may have changed or the connection was intercepted: %v", hostname, path, err)
+		}
+
+		if !confirmHostKey(hostname, key) {
+			return fmt.Errorf("host key verification failed for %s", hostname)
+		}
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}, nil
+}
+
+// confirmHostKey asks the user to accept the key of an unknown host,
+// replaced in tests.
+var confirmHostKey = promptHostKey
+
+func promptHostKey(hostname string, key ssh.PublicKey) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.Printf("Host key for %s is not known and stdin is not a terminal, add it to the known hosts file first", hostname)
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n", hostname)
+	fmt.Fprintf(os.Stderr, "%s key fingerprint is %s.\n", key.Type(), ssh.FingerprintSHA256(key))
+	fmt.Fprint(os.Stderr, "Are you sure you want to continue connecting (yes/no)? ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(strings.ToLower(answer)) == "yes"
+}
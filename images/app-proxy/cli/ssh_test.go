@@ -0,0 +1,270 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"selkies.io/connector/tunnel"
+)
+
+// testSSHServer is an in-process SSH server with SFTP, reached through a
+// websocket tunnel like the app proxy.
+type testSSHServer struct {
+	client    *tunnel.Client
+	clientKey ssh.PublicKey
+
+	mu      sync.Mutex
+	hostKey ssh.Signer
+}
+
+// newTestSSHServer starts the server and points the ssh and cp flags at it,
+// with a new client identity and an empty known hosts file.
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	dir := t.TempDir()
+	s := &testSSHServer{hostKey: newTestSigner(t)}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFile := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(identityFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.clientKey, err = ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go s.serve(tunnel.NewConn(ws, time.Second))
+	}))
+	t.Cleanup(ts.Close)
+
+	s.client = &tunnel.Client{
+		Endpoint:        ts.Listener.Addr().String(),
+		Tokens:          tunnel.StaticTokenSource("token"),
+		Transport:       tunnel.TransportWebsocket,
+		WebsocketDialer: &websocket.Dialer{TLSClientConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig},
+	}
+	s.client.SetBrokerCookie("app", "cookie")
+
+	app, port, user, identity, knownHosts, recurse, confirm := *appName, *remotePort, *sshUser, *sshIdentityFile, *sshKnownHostsFile, *recursive, confirmHostKey
+	t.Cleanup(func() {
+		*appName, *remotePort, *sshUser, *sshIdentityFile, *sshKnownHostsFile, *recursive, confirmHostKey = app, port, user, identity, knownHosts, recurse, confirm
+	})
+	*appName = "app"
+	*remotePort = 22
+	*sshUser = "test"
+	*sshIdentityFile = identityFile
+	*sshKnownHostsFile = filepath.Join(dir, "known_hosts")
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return s
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (s *testSSHServer) setHostKey(key ssh.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hostKey = key
+}
+
+func (s *testSSHServer) serve(conn net.Conn) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() != "test" || !bytes.Equal(key.Marshal(), s.clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", meta.User())
+			}
+			return nil, nil
+		},
+	}
+	s.mu.Lock()
+	config.AddHostKey(s.hostKey)
+	s.mu.Unlock()
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go serveTestSession(ch, chReqs)
+	}
+}
+
+// serveTestSession runs "exit N" commands and the sftp subsystem, on the
+// local file system.
+func serveTestSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			var status uint32
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			if _, err := fmt.Sscanf(payload.Command, "exit %d", &status); err != nil {
+				status = 127
+			}
+			req.Reply(true, nil)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func TestSSHKnownHosts(t *testing.T) {
+	s := newTestSSHServer(t)
+
+	// An unknown host is rejected unless the user accepts it.
+	confirmHostKey = func(hostname string, key ssh.PublicKey) bool { return false }
+	if _, err := dialSSH(s.client); err == nil || !strings.Contains(err.Error(), "host key verification failed") {
+		t.Fatalf("dialSSH() with rejected host key returned %v, want host key verification failure", err)
+	}
+	if data, _ := ioutil.ReadFile(*sshKnownHostsFile); len(data) > 0 {
+		t.Fatalf("known hosts file has %q after the host key was rejected, want empty", data)
+	}
+
+	// An accepted host is added to the known hosts file.
+	confirmed := 0
+	confirmHostKey = func(hostname string, key ssh.PublicKey) bool {
+		confirmed++
+		return true
+	}
+	client, err := dialSSH(s.client)
+	if err != nil {
+		t.Fatalf("dialSSH() with accepted host key failed: %v", err)
+	}
+	client.Close()
+	if confirmed != 1 {
+		t.Fatalf("host key confirmed %d times, want 1", confirmed)
+	}
+
+	// A known host connects without asking.
+	client, err = dialSSH(s.client)
+	if err != nil {
+		t.Fatalf("dialSSH() with known host key failed: %v", err)
+	}
+	client.Close()
+	if confirmed != 1 {
+		t.Fatalf("known host key confirmed again, %d times", confirmed)
+	}
+
+	// A changed key is rejected without asking.
+	s.setHostKey(newTestSigner(t))
+	if _, err := dialSSH(s.client); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("dialSSH() with changed host key returned %v, want mismatch error", err)
+	}
+	if confirmed != 1 {
+		t.Fatalf("changed host key confirmed, %d times", confirmed)
+	}
+}
+
+func TestSSHExitStatus(t *testing.T) {
+	s := newTestSSHServer(t)
+	confirmHostKey = func(hostname string, key ssh.PublicKey) bool { return true }
+
+	client, err := dialSSH(s.client)
+	if err != nil {
+		t.Fatalf("dialSSH() failed: %v", err)
+	}
+	defer client.Close()
+
+	for _, status := range []int{0, 3} {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = session.Run(fmt.Sprintf("exit %d", status))
+		session.Close()
+		if got := sshExitStatus(err); got != status {
+			t.Errorf("sshExitStatus() of exit %d = %d", status, got)
+		}
+	}
+}
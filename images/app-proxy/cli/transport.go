@@ -0,0 +1,188 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// httpTransport carries every outbound request: token refresh, GCIP
+// exchange, broker API and the websocket to the app proxy.
+var httpTransport *http.Transport
+
+// Websocket buffer and frame sizes from the flags, zero for the defaults.
+var (
+	websocketReadBufferSize  int
+	websocketWriteBufferSize int
+	websocketFrameSize       int
+)
+
+// configureTransport builds the shared transport from the proxy and TLS
+// flags. It also replaces http.DefaultTransport so that libraries using the
+// default client, like the OAuth token refresh, use the same settings.
+func configureTransport() error {
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	proxy, err := getProxyFunc()
+	if err != nil {
+		return err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	t.TLSClientConfig = tlsConfig
+
+	httpTransport = t
+	http.DefaultTransport = t
+	return nil
+}
+
+// configureWebsocket parses the websocket buffer and frame size flags.
+func configureWebsocket() error {
+	sizes := []struct {
+		name  string
+		value string
+		dst   *int
+	}{
+		{"ws_read_buffer", *wsReadBuffer, &websocketReadBufferSize},
+		{"ws_write_buffer", *wsWriteBuffer, &websocketWriteBufferSize},
+		{"frame_size", *frameSize, &websocketFrameSize},
+	}
+	for _, s := range sizes {
+		n, err := parseBytes(s.value)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %v", s.name, err)
+		}
+		if n > 64<<20 {
+			return fmt.Errorf("invalid -%s: must be at most 64M", s.name)
+		}
+		*s.dst = int(n)
+	}
+	if *compression && (*compressionLevel < 1 || *compressionLevel > 9) {
+		return fmt.Errorf("invalid -compression_level: must be from 1 to 9")
+	}
+	return nil
+}
+
+// websocketCompressionLevel returns the compression level of messages sent,
+// or zero if compression is disabled.
+func websocketCompressionLevel() int {
+	if !*compression {
+		return 0
+	}
+	return *compressionLevel
+}
+
+// newHTTPClient returns a client that uses the shared transport.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: httpTransport}
+}
+
+// newWebsocketDialer returns a websocket dialer with the proxy and TLS
+// settings of the shared transport, and the compression and buffer settings
+// from the flags.
+func newWebsocketDialer() *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:             httpTransport.Proxy,
+		TLSClientConfig:   httpTransport.TLSClientConfig,
+		ReadBufferSize:    websocketReadBufferSize,
+		WriteBufferSize:   websocketWriteBufferSize,
+		EnableCompression: *compression,
+	}
+}
+
+// getProxyFunc returns the proxy for each request. The -proxy flag overrides
+// the HTTPS_PROXY environment variable, NO_PROXY is honoured in both cases.
+// Credentials for proxy basic auth are taken from the proxy URL, or from
+// -proxy_user and the SELKIES_PROXY_PASSWORD environment variable.
+func getProxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	config := httpproxy.FromEnvironment()
+	if len(*proxyURL) > 0 {
+		config.HTTPProxy = *proxyURL
+		config.HTTPSProxy = *proxyURL
+	}
+
+	if len(*proxyUser) > 0 {
+		for _, p := range []*string{&config.HTTPProxy, &config.HTTPSProxy} {
+			if len(*p) == 0 {
+				continue
+			}
+			u, err := url.Parse(*p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy URL %q: %v", *p, err)
+			}
+			u.User = url.UserPassword(*proxyUser, os.Getenv("SELKIES_PROXY_PASSWORD"))
+			*p = u.String()
+		}
+	}
+
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxyFunc(req.URL)
+		if err == nil && u != nil && *verbose {
+			log.Printf("Using proxy %s for %s", u.Redacted(), req.URL.Host)
+		}
+		return u, err
+	}, nil
+}
+
+// getTLSConfig returns the TLS config with the -ca_file bundle added to the
+// system roots and the -client_cert key pair for mTLS endpoints.
+func getTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if len(*caFile) > 0 {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", *caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(*clientCert) > 0 || len(*clientKey) > 0 {
+		if len(*clientCert) == 0 || len(*clientKey) == 0 {
+			return nil, fmt.Errorf("both -client_cert and -client_key are required for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,258 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/salrashid123/oauth2oidc"
+)
+
+// Refresh ID tokens when they expire within this margin.
+const tokenRefreshMargin = 5 * time.Minute
+
+// TokenSource returns ID tokens accepted by the broker endpoint.
+type TokenSource interface {
+	IDToken() (string, error)
+}
+
+// StaticTokenSource always returns the same ID token.
+type StaticTokenSource string
+
+func (s StaticTokenSource) IDToken() (string, error) {
+	return string(s), nil
+}
+
+// GCIPConfig holds the settings to exchange Google ID tokens for GCIP tokens
+// on endpoints that use GCIP instead of IAP.
+type GCIPConfig struct {
+	APIKey     string
+	ProviderID string
+}
+
+// RefreshTokenSource exchanges an OAuth refresh token of the desktop app
+// client for ID tokens for the broker audience. Tokens are cached and
+// refreshed shortly before they expire.
+type RefreshTokenSource struct {
+	Audience     string
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+
+	// GCIP, if set, exchanges each ID token for a GCIP token.
+	GCIP *GCIPConfig
+
+	// HTTPClient is used for the GCIP exchange. The default client is used if nil.
+	HTTPClient *http.Client
+
+	// OnRefresh, if set, is called after each token refresh or GCIP exchange
+	// with its error, unless the token is refreshed to dial a connection of
+	// a Listener with a Hooks.AuthRefreshed hook, which is called instead.
+	OnRefresh func(err error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (s *RefreshTokenSource) IDToken() (string, error) {
+	return s.IDTokenContext(context.Background())
+}
+
+// IDTokenContext returns an ID token like IDToken, reporting a refresh to the
+// refresh hook of the context, if any.
+func (s *RefreshTokenSource) IDTokenContext(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.token) > 0 && time.Until(s.expiry) > tokenRefreshMargin {
+		return s.token, nil
+	}
+
+	idToken, err := oauth2oidc.GetIdToken(s.Audience, s.ClientID, s.ClientSecret, s.RefreshToken)
+	s.refreshed(ctx, err)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get ID token: %v", err)
+	}
+
+	if s.GCIP != nil {
+		// Exchange token for GCIP token.
+		idToken, err = ExchangeGCIP(s.HTTPClient, idToken, s.GCIP.APIKey, s.GCIP.ProviderID)
+		s.refreshed(ctx, err)
+		if err != nil {
+			return "", fmt.Errorf("Failed to exchange GCIP token: %v", err)
+		}
+	}
+
+	s.token = idToken
+	s.expiry = TokenExpiry(idToken)
+	return idToken, nil
+}
+
+// SetGCIP sets the GCIP settings, ex: after detecting that the endpoint uses
+// GCIP, and drops the cached token.
+func (s *RefreshTokenSource) SetGCIP(gcip *GCIPConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.GCIP = gcip
+	s.token = ""
+}
+
+func (s *RefreshTokenSource) refreshed(ctx context.Context, err error) {
+	if hook, ok := ctx.Value(refreshHookKey{}).(func(error)); ok {
+		hook(err)
+		return
+	}
+	if s.OnRefresh != nil {
+		s.OnRefresh(err)
+	}
+}
+
+// contextTokenSource is a TokenSource that takes the context of the request
+// the token is for.
+type contextTokenSource interface {
+	IDTokenContext(ctx context.Context) (string, error)
+}
+
+type refreshHookKey struct{}
+
+// withRefreshHook returns a context whose token refreshes are reported to
+// hook.
+func withRefreshHook(ctx context.Context, hook func(err error)) context.Context {
+	return context.WithValue(ctx, refreshHookKey{}, hook)
+}
+
+// TokenExpiry returns the expiry time of a JWT, or the zero time if it cannot
+// be parsed.
+func TokenExpiry(token string) time.Time {
+	claims := &jwt.StandardClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+// IsEndpointGCIP reports whether the endpoint redirects to GCIP sign in
+// instead of using IAP.
+func IsEndpointGCIP(client *http.Client, endpoint string) (bool, error) {
+	url := fmt.Sprintf("https://%s", endpoint)
+	c := httpClient(client)
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	req, _ := http.NewRequest("HEAD", url, nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == 302 {
+		gcipLocationRE := regexp.MustCompile(".*googleapis.com/.*/gcip/resources.*")
+		return gcipLocationRE.MatchString(resp.Header.Get("location")), nil
+	}
+
+	return false, nil
+}
+
+// ExchangeGCIP exchanges a Google ID token for a GCIP token.
+func ExchangeGCIP(client *http.Client, token, apiKey, providerId string) (string, error) {
+	newTok := ""
+
+	type gcipExchangeReqSpec struct {
+		PostBody          string `json:"postBody"`
+		RequestURI        string `json:"requestUri"`
+		ReturnSecureToken bool   `json:"returnSecureToken"`
+	}
+
+	type gcipExchangeRespSpec struct {
+		IDToken string `json:"idToken"`
+	}
+
+	data, _ := json.Marshal(&gcipExchangeReqSpec{
+		RequestURI:        "http://localhost",
+		ReturnSecureToken: true,
+		PostBody:          fmt.Sprintf("id_token=%s&providerId=%s", token, providerId),
+	})
+
+	url := fmt.Sprintf("https://identitytoolkit.googleapis.com/v1/accounts:signInWithIdp?key=%s", apiKey)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient(client).Do(req)
+	if err != nil {
+		return newTok, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	var result gcipExchangeRespSpec
+	if err := json.Unmarshal(body, &result); err != nil {
+		return newTok, err
+	}
+
+	newTok = result.IDToken
+
+	return newTok, nil
+}
+
+// BrokerCookie fetches the broker cookie that routes requests for the app to
+// the user's pod, in the form name=value.
+func BrokerCookie(client *http.Client, endpoint, idToken, app string) (string, error) {
+	cookieUrl := fmt.Sprintf("https://%s/broker/%s/", endpoint, app)
+	var cookie []*http.Cookie
+	req, _ := http.NewRequest("GET", cookieUrl, nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
+	resp, err := httpClient(client).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get broker cookie for app: '%s' : %v", app, err)
+	}
+	defer resp.Body.Close()
+	cookie = resp.Cookies()
+
+	// Find cookie
+	cookieName := fmt.Sprintf("broker_%s", app)
+	cookieValue := ""
+	for _, c := range cookie {
+		if c.Name == cookieName {
+			cookieValue = c.Value
+		}
+	}
+	if len(cookieValue) == 0 {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("failed to get broker cookie for app: '%s' : %s", app, string(data))
+	}
+	return fmt.Sprintf("%s=%s", cookieName, cookieValue), nil
+}
+
+// httpClient returns a copy of client, or of the default client if nil, so
+// that callers can change its settings.
+func httpClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := *client
+	return &c
+}
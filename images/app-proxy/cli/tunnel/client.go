@@ -0,0 +1,321 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package tunnel opens connections to ports inside Selkies app pods through
+// the broker endpoint and the app proxy sidecar.
+//
+// A Client authenticates to the endpoint and dials the app proxy over a
+// websocket. The returned net.Conn can be used anywhere a network connection
+// is expected, for example as the DialContext of an http.Transport:
+//
+//	client := &tunnel.Client{Endpoint: endpoint, Tokens: tokens}
+//	transport := &http.Transport{DialContext: client.DialContext}
+//	resp, err := (&http.Client{Transport: transport}).Get("http://myapp:8080/")
+//
+// A Listener accepts local connections and tunnels each one to a port of an
+// app.
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultWriteTimeout = 10 * time.Second
+	defaultFrameSize    = 32 * 1024
+)
+
+// Transports selected by Client.Transport.
+const (
+	// TransportAuto tries the websocket first and falls back to HTTP if the
+	// upgrade is blocked.
+	TransportAuto      = "auto"
+	TransportWebsocket = "websocket"
+	TransportHTTP      = "http"
+)
+
+// Client opens tunnels to apps behind a broker endpoint.
+type Client struct {
+	// Endpoint is the broker host name, ex: broker.endpoints.PROJECT_ID.cloud.goog
+	Endpoint string
+
+	// Tokens returns the ID tokens sent to the endpoint.
+	Tokens TokenSource
+
+	// HTTPClient is used for broker requests. The default client is used if nil.
+	HTTPClient *http.Client
+
+	// WebsocketDialer opens the websocket to the app proxy. A dialer with the
+	// default settings is used if nil. Set EnableCompression to negotiate
+	// permessage-deflate, and the buffer sizes for bulk transfers.
+	WebsocketDialer *websocket.Dialer
+
+	// CompressionLevel is the flate level of messages sent when compression
+	// is negotiated, from -2 to 9. The websocket default is used if zero.
+	CompressionLevel int
+
+	// FrameSize is the maximum payload of each websocket message, or HTTP
+	// upload request, sent to the app proxy, default to 32 KiB.
+	FrameSize int
+
+	// Transport is TransportAuto, the default if empty, TransportWebsocket
+	// or TransportHTTP.
+	Transport string
+
+	// OnFallback is called when TransportAuto falls back to HTTP because the
+	// websocket upgrade failed with err. Later dials use HTTP directly.
+	OnFallback func(err error)
+
+	// WriteTimeout is the timeout for websocket control messages, default to
+	// 10 seconds.
+	WriteTimeout time.Duration
+
+	mu       sync.Mutex
+	cookies  map[string]string
+	fellBack bool
+}
+
+// DialError is returned when the websocket to the app proxy cannot be opened.
+type DialError struct {
+	URL string
+
+	// StatusCode, Status and Body are set if the endpoint returned an HTTP
+	// response instead of upgrading to a websocket.
+	StatusCode int
+	Status     string
+	Body       string
+
+	Err error
+}
+
+func (e *DialError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: HTTP error: %d %s", e.Err, e.StatusCode, e.Status)
+	}
+	return fmt.Sprintf("Dial to %q fail: %v", e.URL, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// SetBrokerCookie sets the broker cookie used for the app, ex: from a
+// credential cache. Cookies that are not set are fetched from the broker.
+func (c *Client) SetBrokerCookie(app, cookie string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cookies == nil {
+		c.cookies = make(map[string]string)
+	}
+	c.cookies[app] = cookie
+}
+
+// BrokerCookie returns the broker cookie for the app, fetching it from the
+// broker the first time.
+func (c *Client) BrokerCookie(app string) (string, error) {
+	return c.brokerCookie(context.Background(), app)
+}
+
+func (c *Client) brokerCookie(ctx context.Context, app string) (string, error) {
+	c.mu.Lock()
+	cookie, ok := c.cookies[app]
+	c.mu.Unlock()
+	if ok {
+		return cookie, nil
+	}
+
+	idToken, err := c.idToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	cookie, err = BrokerCookie(c.HTTPClient, c.Endpoint, idToken, app)
+	if err != nil {
+		return "", err
+	}
+	c.SetBrokerCookie(app, cookie)
+	return cookie, nil
+}
+
+// Headers returns the headers used to open the websocket to the app.
+func (c *Client) Headers(app string) (http.Header, error) {
+	return c.headers(context.Background(), app)
+}
+
+func (c *Client) headers(ctx context.Context, app string) (http.Header, error) {
+	idToken, err := c.idToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cookie, err := c.brokerCookie(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	head := http.Header{}
+	head.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
+	head.Set("Cookie", cookie)
+	return head, nil
+}
+
+// idToken returns an ID token, with the context of the request if the token
+// source takes one.
+func (c *Client) idToken(ctx context.Context) (string, error) {
+	if tokens, ok := c.Tokens.(contextTokenSource); ok {
+		return tokens.IDTokenContext(ctx)
+	}
+	return c.Tokens.IDToken()
+}
+
+// URL returns the websocket URL of the app proxy for host and port in the app.
+func (c *Client) URL(app, host string, port int) string {
+	return fmt.Sprintf("wss://%s/%s/connect/proxy/%s/%d", c.Endpoint, app, host, port)
+}
+
+// DialWebsocket opens the websocket to the app proxy for host and port in
+// the app. Errors from the endpoint are returned as a *DialError.
+func (c *Client) DialWebsocket(ctx context.Context, app, host string, port int) (*websocket.Conn, error) {
+	head, err := c.headers(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := c.WebsocketDialer
+	if dialer == nil {
+		dialer = &websocket.Dialer{}
+	}
+
+	url := c.URL(app, host, port)
+	rconn, resp, err := dialer.DialContext(ctx, url, head)
+	if err != nil {
+		dialErr := &DialError{URL: url, Err: err}
+		if resp != nil {
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			dialErr.StatusCode = resp.StatusCode
+			dialErr.Status = resp.Status
+			dialErr.Body = string(b)
+		}
+		return nil, dialErr
+	}
+	if c.CompressionLevel != 0 {
+		if err := rconn.SetCompressionLevel(c.CompressionLevel); err != nil {
+			rconn.Close()
+			return nil, err
+		}
+	}
+	return rconn, nil
+}
+
+// Dial opens a connection to host and port in the app with the configured
+// transport. Use localhost as the host for ports of the app containers.
+func (c *Client) Dial(ctx context.Context, app, host string, port int) (net.Conn, error) {
+	if c.TransportInUse() == TransportHTTP {
+		return c.DialHTTP(ctx, app, host, port)
+	}
+
+	rconn, err := c.DialWebsocket(ctx, app, host, port)
+	if err != nil {
+		if c.Transport == TransportWebsocket || !upgradeBlocked(err) {
+			return nil, err
+		}
+		conn, httpErr := c.DialHTTP(ctx, app, host, port)
+		if httpErr != nil {
+			return nil, fmt.Errorf("%v, HTTP fallback failed: %v", err, httpErr)
+		}
+		c.mu.Lock()
+		fellBack := c.fellBack
+		c.fellBack = true
+		c.mu.Unlock()
+		if !fellBack && c.OnFallback != nil {
+			c.OnFallback(err)
+		}
+		return conn, nil
+	}
+	return &wsConn{ws: rconn, writeTimeout: c.writeTimeout(), frameSize: c.frameSize()}, nil
+}
+
+// TransportInUse returns TransportHTTP if the client uses the HTTP transport,
+// configured or after a fallback, and TransportWebsocket otherwise.
+func (c *Client) TransportInUse() string {
+	if c.Transport == TransportHTTP {
+		return TransportHTTP
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fellBack {
+		return TransportHTTP
+	}
+	return TransportWebsocket
+}
+
+// upgradeBlocked returns true if a websocket dial error means that the
+// upgrade request was answered without switching protocols, ex: by a proxy
+// that strips the Upgrade header, rather than rejected by the endpoint.
+func upgradeBlocked(err error) bool {
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) || dialErr.StatusCode == 0 {
+		return false
+	}
+	switch dialErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false
+	}
+	return errors.Is(err, websocket.ErrBadHandshake)
+}
+
+// DialContext connects to the address app:port on localhost in the app. It
+// has the signature of net.Dialer.DialContext so that it can be used by HTTP
+// transports, gRPC and database drivers. Only TCP networks are supported.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	app, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in address %q", addr)
+	}
+	return c.Dial(ctx, app, "localhost", port)
+}
+
+func (c *Client) frameSize() int {
+	if c.FrameSize > 0 {
+		return c.FrameSize
+	}
+	return defaultFrameSize
+}
+
+func (c *Client) writeTimeout() time.Duration {
+	if c.WriteTimeout > 0 {
+		return c.WriteTimeout
+	}
+	return defaultWriteTimeout
+}
@@ -0,0 +1,199 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Consecutive dial failures before Failover moves to another client.
+const defaultMaxFailures = 3
+
+// Failover dials apps through the first healthy of several clients, ex: for
+// broker endpoints in different regions that serve the same apps. When dials
+// keep failing, new connections move to the next healthy client.
+type Failover struct {
+	// Clients in priority order, one per endpoint.
+	Clients []*Client
+
+	// MaxFailures is the number of dials in a row that must fail before new
+	// connections move to another client, default to 3.
+	MaxFailures int
+
+	// HealthCheck reports whether a client can be used for the app. Client.Check
+	// is used if nil.
+	HealthCheck func(ctx context.Context, c *Client, app string) error
+
+	// OnSwitch, if set, is called when new connections move from one client
+	// to another because of err.
+	OnSwitch func(from, to *Client, err error)
+
+	mu       sync.Mutex
+	current  int
+	failures int
+}
+
+// Current returns the client used for new connections.
+func (f *Failover) Current() *Client {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Clients[f.current]
+}
+
+// Select health checks the clients in priority order and uses the first
+// healthy one for new connections. The error of the last client is returned
+// if none is healthy.
+func (f *Failover) Select(ctx context.Context, app string) (*Client, error) {
+	if len(f.Clients) == 0 {
+		return nil, fmt.Errorf("no endpoints")
+	}
+	var lastErr error
+	for i, c := range f.Clients {
+		if err := f.check(ctx, c, app); err != nil {
+			lastErr = fmt.Errorf("%s: %v", c.Endpoint, err)
+			continue
+		}
+		f.mu.Lock()
+		f.current = i
+		f.failures = 0
+		f.mu.Unlock()
+		return c, nil
+	}
+	return nil, lastErr
+}
+
+// Dial opens a connection through the current client. After MaxFailures
+// failed dials in a row, the next healthy client becomes current and the
+// dial is retried once with it. The client of the last dial is returned with
+// its result.
+func (f *Failover) Dial(ctx context.Context, app, host string, port int) (net.Conn, *Client, error) {
+	c := f.Current()
+	conn, err := c.Dial(ctx, app, host, port)
+	if err == nil {
+		f.mu.Lock()
+		f.failures = 0
+		f.mu.Unlock()
+		return conn, c, nil
+	}
+	if ctx.Err() != nil || !f.failed(c) {
+		return nil, c, err
+	}
+
+	next := f.next(ctx, c, app)
+	if next == nil {
+		return nil, c, err
+	}
+	if f.OnSwitch != nil {
+		f.OnSwitch(c, next, err)
+	}
+	conn, err = next.Dial(ctx, app, host, port)
+	return conn, next, err
+}
+
+// failed counts a failed dial of c and reports whether the limit is reached.
+func (f *Failover) failed(c *Client) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Clients[f.current] != c {
+		// Another dial already moved on.
+		return false
+	}
+	f.failures++
+	max := f.MaxFailures
+	if max <= 0 {
+		max = defaultMaxFailures
+	}
+	return f.failures >= max
+}
+
+// next makes the first healthy client after from current and returns it, or
+// returns nil if no other client is healthy.
+func (f *Failover) next(ctx context.Context, from *Client, app string) *Client {
+	start := 0
+	for i, c := range f.Clients {
+		if c == from {
+			start = i
+		}
+	}
+	for n := 1; n < len(f.Clients); n++ {
+		i := (start + n) % len(f.Clients)
+		c := f.Clients[i]
+		if err := f.check(ctx, c, app); err != nil {
+			continue
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.Clients[f.current] != from {
+			// Another dial already moved on.
+			return f.Clients[f.current]
+		}
+		f.current = i
+		f.failures = 0
+		return c
+	}
+	return nil
+}
+
+func (f *Failover) check(ctx context.Context, c *Client, app string) error {
+	if f.HealthCheck != nil {
+		return f.HealthCheck(ctx, c, app)
+	}
+	return c.Check(ctx, app)
+}
+
+// Check reports whether the endpoint is reachable with the HEAD probe of
+// IsEndpointGCIP and, if app is set, whether the broker accepts a status
+// request for the app with the client's token.
+func (c *Client) Check(ctx context.Context, app string) error {
+	if _, err := IsEndpointGCIP(c.HTTPClient, c.Endpoint); err != nil {
+		return err
+	}
+	if len(app) == 0 {
+		return nil
+	}
+	return c.Ping(ctx, app)
+}
+
+// Ping requests the broker status of the app and returns an error unless the
+// broker answers it.
+func (c *Client) Ping(ctx context.Context, app string) error {
+	idToken, err := c.Tokens.IDToken()
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://%s/broker/%s/", c.Endpoint, app)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
+	resp, err := httpClient(c.HTTPClient).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("broker status for app %s: HTTP error: %s: %s", app, resp.Status, string(body))
+	}
+	return nil
+}
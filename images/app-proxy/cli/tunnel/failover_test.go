@@ -0,0 +1,87 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newProxyClient returns a client of an app proxy served by ts.
+func newProxyClient(ts *httptest.Server) *Client {
+	c := &Client{
+		Endpoint:   strings.TrimPrefix(ts.URL, "https://"),
+		Tokens:     StaticTokenSource("token"),
+		HTTPClient: ts.Client(),
+		WebsocketDialer: &websocket.Dialer{
+			TLSClientConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+		Transport: TransportWebsocket,
+	}
+	c.SetBrokerCookie("app", "broker_app=cookie")
+	return c
+}
+
+func TestFailoverDial(t *testing.T) {
+	down := httptest.NewTLSServer(http.NotFoundHandler())
+	defer down.Close()
+	up := httptest.NewTLSServer(&ProxyHandler{})
+	defer up.Close()
+	target, _ := startTarget(t)
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	var switched []string
+	f := &Failover{
+		Clients:     []*Client{newProxyClient(down), newProxyClient(up)},
+		MaxFailures: 2,
+		HealthCheck: func(ctx context.Context, c *Client, app string) error {
+			return nil
+		},
+		OnSwitch: func(from, to *Client, err error) {
+			switched = append(switched, from.Endpoint+"->"+to.Endpoint)
+		},
+	}
+
+	// Dials fail through the first client until MaxFailures is reached,
+	// then the dial is retried with the next one.
+	for i, want := range []*Client{f.Clients[0], f.Clients[1], f.Clients[1]} {
+		conn, c, err := f.Dial(context.Background(), "app", host, portNum)
+		if c != want {
+			t.Errorf("dial %d used %s, want %s", i, c.Endpoint, want.Endpoint)
+		}
+		if (err == nil) != (want == f.Clients[1]) {
+			t.Errorf("dial %d through %s returned %v", i, c.Endpoint, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	if len(switched) != 1 || switched[0] != f.Clients[0].Endpoint+"->"+f.Clients[1].Endpoint {
+		t.Errorf("switched %v, want once from the first client to the second", switched)
+	}
+	if f.Current() != f.Clients[1] {
+		t.Errorf("Current() is %s after the switch", f.Current().Endpoint)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// Smallest burst of a rate limiter, so that small rates still move full
+// websocket frames.
+const minBurst = 32 * 1024
+
+// Limits caps the bandwidth and concurrent connections of a Listener. Rates
+// are in bytes per second and zero means unlimited. Upload is from the local
+// client to the app, download is from the app to the local client.
+type Limits struct {
+	// Rates shared by all connections of the listener.
+	UploadRate   int64 `json:"upload_rate,omitempty"`
+	DownloadRate int64 `json:"download_rate,omitempty"`
+
+	// Rates applied to each connection on its own.
+	ConnUploadRate   int64 `json:"conn_upload_rate,omitempty"`
+	ConnDownloadRate int64 `json:"conn_download_rate,omitempty"`
+
+	// MaxConns is the maximum number of concurrent connections.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// QueueConns makes connections over MaxConns wait for a free slot
+	// instead of being rejected.
+	QueueConns bool `json:"queue_conns,omitempty"`
+}
+
+// ErrTooManyConns is passed to the Rejected hook when a connection is
+// rejected because MaxConns connections are open.
+var ErrTooManyConns = errors.New("too many connections")
+
+// newLimiter returns a token bucket for the rate, or nil if unlimited.
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSec)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// waitN blocks until n bytes are allowed by each limiter. Waits larger than
+// the burst are split so that WaitN does not fail.
+func waitN(ctx context.Context, n int, limiters ...*rate.Limiter) error {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		for remaining := n; remaining > 0; {
+			chunk := remaining
+			if chunk > l.Burst() {
+				chunk = l.Burst()
+			}
+			if err := l.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+	}
+	return nil
+}
+
+// limitedConn throttles reads, the upload direction, and writes, the
+// download direction, of a local connection.
+type limitedConn struct {
+	net.Conn
+	ctx      context.Context
+	upload   []*rate.Limiter
+	download []*rate.Limiter
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := waitN(c.ctx, n, c.upload...); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if err := waitN(c.ctx, len(b), c.download...); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// connLimiter holds the shared limiters and connection slots of a Listener.
+type connLimiter struct {
+	limits   Limits
+	upload   *rate.Limiter
+	download *rate.Limiter
+	slots    chan struct{}
+}
+
+func newConnLimiter(limits Limits) *connLimiter {
+	cl := &connLimiter{
+		limits:   limits,
+		upload:   newLimiter(limits.UploadRate),
+		download: newLimiter(limits.DownloadRate),
+	}
+	if limits.MaxConns > 0 {
+		cl.slots = make(chan struct{}, limits.MaxConns)
+	}
+	return cl
+}
+
+// acquire takes a connection slot. If all slots are in use it waits when
+// QueueConns is set, and returns ErrTooManyConns otherwise. queued is called
+// before waiting.
+func (cl *connLimiter) acquire(ctx context.Context, queued func()) error {
+	if cl.slots == nil {
+		return nil
+	}
+	select {
+	case cl.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if !cl.limits.QueueConns {
+		return fmt.Errorf("%w, limit is %d", ErrTooManyConns, cl.limits.MaxConns)
+	}
+	queued()
+	select {
+	case cl.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cl *connLimiter) release() {
+	if cl.slots != nil {
+		<-cl.slots
+	}
+}
+
+// wrap returns conn throttled by the shared and per connection rates, or
+// conn itself if no rate is set.
+func (cl *connLimiter) wrap(ctx context.Context, conn net.Conn) net.Conn {
+	var upload, download []*rate.Limiter
+	for _, l := range []*rate.Limiter{newLimiter(cl.limits.ConnUploadRate), cl.upload} {
+		if l != nil {
+			upload = append(upload, l)
+		}
+	}
+	for _, l := range []*rate.Limiter{newLimiter(cl.limits.ConnDownloadRate), cl.download} {
+		if l != nil {
+			download = append(download, l)
+		}
+	}
+	if len(upload) == 0 && len(download) == 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, ctx: ctx, upload: upload, download: download}
+}
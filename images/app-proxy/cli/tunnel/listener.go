@@ -0,0 +1,360 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum time for the local side handshake of a connection, ex: TLS.
+	handshakeTimeout = 10 * time.Second
+
+	// Most data buffered from a queued client, the client is no longer
+	// watched for a close when it sends more.
+	maxQueuedClientData = 64 * 1024
+)
+
+// errClientGone is passed to the Rejected hook when a queued client closes
+// its connection before a slot is free.
+var errClientGone = errors.New("client closed the connection while queued")
+
+// Hooks observe and wrap the connections of a Listener. Any field may be nil.
+type Hooks struct {
+	// Accepted is called for each accepted connection. It returns the
+	// connection to tunnel, which may wrap conn, or an error to close it
+	// without dialing the app.
+	Accepted func(conn net.Conn) (net.Conn, error)
+
+	// Rejected is called when a connection is closed before Accepted
+	// because its source address is not allowed, its handshake failed or
+	// because of the Listener limits.
+	Rejected func(conn net.Conn, reason error)
+
+	// Dialed is called after the websocket to the app proxy is opened, or
+	// fails to open, with the endpoint dialed and the time it took.
+	Dialed func(conn net.Conn, endpoint string, d time.Duration, err error)
+
+	// Closed is called after the connection is closed with the reason, one
+	// of the Closed constants, and the error for ClosedOnError and
+	// ClosedDialFailed.
+	Closed func(conn net.Conn, reason string, err error)
+
+	// AuthRefreshed is called when the ID token is refreshed to dial a
+	// connection, with the error of the refresh.
+	AuthRefreshed func(err error)
+}
+
+// Listener accepts local connections and tunnels each one to a port in an
+// app.
+type Listener struct {
+	net.Listener
+
+	Client *Client
+	App    string
+	Host   string
+	Port   int
+
+	// Failover, if set, dials connections instead of Client.
+	Failover *Failover
+
+	// Allow, if not empty, restricts the source addresses of connections.
+	// Connections from other addresses are rejected before their handshake.
+	Allow []*net.IPNet
+
+	Hooks  Hooks
+	Limits Limits
+
+	// ErrorLog logs connection errors. The standard logger is used if nil.
+	ErrorLog *log.Logger
+
+	limiterOnce sync.Once
+	limiter     *connLimiter
+
+	doneOnce  sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen listens on the local TCP address and returns a Listener that tunnels
+// connections to port on localhost in the app.
+func (c *Client) Listen(addr, app string, port int) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		Listener: l,
+		Client:   c,
+		App:      app,
+		Host:     "localhost",
+		Port:     port,
+	}, nil
+}
+
+// Serve accepts connections and tunnels each one in a new goroutine until
+// Accept fails. The error from Accept is returned, and the queued
+// connections are rejected.
+func (l *Listener) Serve() error {
+	defer l.shutdown()
+	for {
+		lconn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go l.ServeConn(lconn)
+	}
+}
+
+// Close closes the listener and rejects the queued connections.
+func (l *Listener) Close() error {
+	l.shutdown()
+	return l.Listener.Close()
+}
+
+func (l *Listener) shutdown() {
+	l.closeOnce.Do(func() {
+		close(l.closed())
+	})
+}
+
+// closed returns a channel closed when the listener is closed.
+func (l *Listener) closed() chan struct{} {
+	l.doneOnce.Do(func() {
+		l.done = make(chan struct{})
+	})
+	return l.done
+}
+
+// ServeConn tunnels a single local connection to the app and closes it when
+// either side is done. Connections with a handshake, like *tls.Conn, must
+// complete it before the app is dialed.
+func (l *Listener) ServeConn(lconn net.Conn) {
+	defer lconn.Close()
+
+	if len(l.Allow) > 0 && !allowed(l.Allow, lconn.RemoteAddr()) {
+		l.logf("Rejected connection from %s: %v", lconn.RemoteAddr().String(), ErrNotAllowed)
+		if l.Hooks.Rejected != nil {
+			l.Hooks.Rejected(lconn, ErrNotAllowed)
+		}
+		return
+	}
+
+	if err := handshake(lconn); err != nil {
+		l.logf("Handshake failed for client %s: %v", lconn.RemoteAddr().String(), err)
+		if l.Hooks.Rejected != nil {
+			l.Hooks.Rejected(lconn, err)
+		}
+		return
+	}
+
+	limiter := l.connLimiter()
+	lconn, err := l.acquire(limiter, lconn)
+	if err != nil {
+		l.logf("Rejected connection from %s: %v", lconn.RemoteAddr().String(), err)
+		if l.Hooks.Rejected != nil {
+			l.Hooks.Rejected(lconn, err)
+		}
+		return
+	}
+	defer limiter.release()
+
+	if l.Hooks.Accepted != nil {
+		conn, err := l.Hooks.Accepted(lconn)
+		if err != nil {
+			l.logf("Rejected connection from %s: %v", lconn.RemoteAddr().String(), err)
+			return
+		}
+		lconn = conn
+		defer lconn.Close()
+	}
+	reason, reasonErr := ClosedCanceled, error(nil)
+	if l.Hooks.Closed != nil {
+		defer func() {
+			l.Hooks.Closed(lconn, reason, reasonErr)
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if l.Hooks.AuthRefreshed != nil {
+		ctx = withRefreshHook(ctx, l.Hooks.AuthRefreshed)
+	}
+
+	// connect to huproxy websocket, or the HTTP transport
+	client := l.Client
+	dialStart := time.Now()
+	var rconn net.Conn
+	if l.Failover != nil {
+		rconn, client, err = l.Failover.Dial(ctx, l.App, l.host(), l.Port)
+	} else {
+		rconn, err = client.Dial(ctx, l.App, l.host(), l.Port)
+	}
+	if l.Hooks.Dialed != nil {
+		l.Hooks.Dialed(lconn, client.Endpoint, time.Since(dialStart), err)
+	}
+	if err != nil {
+		l.logf("Connection failed for client %s: %v", lconn.RemoteAddr().String(), err)
+		reason, reasonErr = ClosedDialFailed, err
+		return
+	}
+	defer rconn.Close()
+
+	opts := PumpOptions{
+		WriteTimeout: client.writeTimeout(),
+		FrameSize:    client.frameSize(),
+		ErrorLog:     l.ErrorLog,
+	}
+	if ws, ok := rconn.(*wsConn); ok {
+		reason, reasonErr = Pump(ctx, limiter.wrap(ctx, lconn), ws.ws, opts)
+		return
+	}
+	reason, reasonErr = PumpConn(ctx, limiter.wrap(ctx, lconn), rconn, opts)
+}
+
+// acquire takes a connection slot for lconn. A queued connection waits while
+// the client stays connected and the listener open, the data the client sends
+// meanwhile is returned by the returned connection.
+func (l *Listener) acquire(limiter *connLimiter, lconn net.Conn) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.closed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var watcher *clientWatcher
+	err := limiter.acquire(ctx, func() {
+		l.logf("Queued connection from %s, limit of %d connections reached", lconn.RemoteAddr().String(), l.Limits.MaxConns)
+		watcher = watchClient(lconn, cancel)
+	})
+	if watcher == nil {
+		return lconn, err
+	}
+	conn, gone := watcher.stop()
+	if err != nil {
+		if gone {
+			return conn, errClientGone
+		}
+		select {
+		case <-l.closed():
+			return conn, net.ErrClosed
+		default:
+		}
+	}
+	return conn, err
+}
+
+func (l *Listener) connLimiter() *connLimiter {
+	l.limiterOnce.Do(func() {
+		l.limiter = newConnLimiter(l.Limits)
+	})
+	return l.limiter
+}
+
+// handshake completes the handshake of connections that have one within
+// handshakeTimeout.
+func handshake(conn net.Conn) error {
+	h, ok := conn.(interface{ Handshake() error })
+	if !ok {
+		return nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := h.Handshake(); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func (l *Listener) host() string {
+	if len(l.Host) > 0 {
+		return l.Host
+	}
+	return "localhost"
+}
+
+func (l *Listener) logf(format string, args ...interface{}) {
+	if l.ErrorLog != nil {
+		l.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// clientWatcher reads from a queued client connection to notice when the
+// client closes it.
+type clientWatcher struct {
+	conn net.Conn
+	buf  bytes.Buffer
+	done chan struct{}
+	gone bool
+}
+
+// watchClient reads conn until it fails, calling gone if it is not because of
+// stop, or until maxQueuedClientData is buffered.
+func watchClient(conn net.Conn, gone func()) *clientWatcher {
+	w := &clientWatcher{conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		b := make([]byte, 4096)
+		for w.buf.Len() < maxQueuedClientData {
+			n, err := conn.Read(b)
+			w.buf.Write(b[:n])
+			if err != nil {
+				var netErr net.Error
+				if !errors.As(err, &netErr) || !netErr.Timeout() {
+					w.gone = true
+					gone()
+				}
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// stop interrupts the read and returns the connection with the buffered data
+// in front, and whether the client closed it.
+func (w *clientWatcher) stop() (net.Conn, bool) {
+	w.conn.SetReadDeadline(time.Unix(1, 0))
+	<-w.done
+	w.conn.SetReadDeadline(time.Time{})
+	if w.buf.Len() == 0 {
+		return w.conn, w.gone
+	}
+	return &bufferedConn{Conn: w.conn, r: io.MultiReader(&w.buf, w.conn)}, w.gone
+}
+
+// bufferedConn is a connection whose reads start with buffered data.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
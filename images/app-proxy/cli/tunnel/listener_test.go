@@ -0,0 +1,169 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerQueuedConn(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// event happens while the connection is queued.
+		event func(l *Listener, limiter *connLimiter, client net.Conn)
+		err   error
+	}{
+		{
+			name: "slot freed",
+			event: func(l *Listener, limiter *connLimiter, client net.Conn) {
+				client.Write([]byte("hello"))
+				limiter.release()
+			},
+		},
+		{
+			name: "client gone",
+			event: func(l *Listener, limiter *connLimiter, client net.Conn) {
+				client.Write([]byte("hello"))
+				client.Close()
+			},
+			err: errClientGone,
+		},
+		{
+			name: "listener closed",
+			event: func(l *Listener, limiter *connLimiter, client net.Conn) {
+				l.Close()
+			},
+			err: net.ErrClosed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nl, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &Listener{Listener: nl, Limits: Limits{MaxConns: 1, QueueConns: true}}
+			defer l.Close()
+			limiter := l.connLimiter()
+			if _, err := l.acquire(limiter, nil); err != nil {
+				t.Fatalf("acquire() of a free slot failed: %v", err)
+			}
+
+			client, server := net.Pipe()
+			defer client.Close()
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				conn, err := l.acquire(limiter, server)
+				results <- result{conn, err}
+			}()
+			select {
+			case r := <-results:
+				t.Fatalf("acquire() of a full listener returned %v", r.err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			tc.event(l, limiter, client)
+			var r result
+			select {
+			case r = <-results:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("acquire() did not return")
+			}
+			if !errors.Is(r.err, tc.err) {
+				t.Fatalf("acquire() returned %v, want %v", r.err, tc.err)
+			}
+			if r.err != nil {
+				return
+			}
+
+			// The data sent while queued is read first, then the rest.
+			go client.Write([]byte(" world"))
+			buf := make([]byte, 11)
+			if _, err := io.ReadFull(r.conn, buf); err != nil {
+				t.Fatalf("failed to read queued connection: %v", err)
+			}
+			if string(buf) != "hello world" {
+				t.Errorf("read %q from queued connection, want %q", buf, "hello world")
+			}
+		})
+	}
+}
+
+func TestListenerAllow(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		allow []string
+		err   error
+	}{
+		{"no allowlist", nil, nil},
+		{"allowed", []string{"10.0.0.0/8", "127.0.0.1"}, nil},
+		{"not allowed", []string{"10.0.0.0/8"}, ErrNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nets, err := ParseCIDRs(tc.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nl, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nl.Close()
+			rejected := make(chan error, 1)
+			l := &Listener{
+				Listener: nl,
+				Allow:    nets,
+				Hooks: Hooks{
+					// Stop before dialing the app.
+					Accepted: func(conn net.Conn) (net.Conn, error) {
+						return nil, errors.New("accepted")
+					},
+					Rejected: func(conn net.Conn, reason error) {
+						rejected <- reason
+					},
+				},
+			}
+
+			client, err := net.Dial("tcp", nl.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			lconn, err := nl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.ServeConn(lconn)
+
+			var reason error
+			select {
+			case reason = <-rejected:
+			default:
+			}
+			if reason != tc.err {
+				t.Errorf("Rejected hook got %v, want %v", reason, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of attempts for each request of the HTTP transport before the
+// connection fails.
+const pollAttempts = 3
+
+// PollURL returns the base URL of the HTTP transport of the app.
+func (c *Client) PollURL(app string) string {
+	return fmt.Sprintf("https://%s/%s/connect/poll/", c.Endpoint, app)
+}
+
+// DialHTTP opens a connection to host and port in the app over the HTTP
+// long-poll transport, for networks that block websocket upgrades.
+func (c *Client) DialHTTP(ctx context.Context, app, host string, port int) (net.Conn, error) {
+	head, err := c.headers(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	base := c.PollURL(app)
+	query := url.Values{"host": {host}, "port": {strconv.Itoa(port)}}
+	req, err := http.NewRequestWithContext(ctx, "POST", base+"open?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = head.Clone()
+
+	client := httpClient(c.HTTPClient)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &DialError{URL: req.URL.String(), Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, &DialError{
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(b),
+			Err:        fmt.Errorf("HTTP error: %s", resp.Status),
+		}
+	}
+	var open struct {
+		Session string `json:"session"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&open); err != nil || len(open.Session) == 0 {
+		return nil, &DialError{URL: req.URL.String(), Err: fmt.Errorf("invalid open response: %v", err)}
+	}
+
+	pctx, cancel := context.WithCancel(context.Background())
+	conn := &pollConn{
+		client:    client,
+		base:      base,
+		head:      head,
+		session:   open.Session,
+		frameSize: c.frameSize(),
+		addr:      pollAddr(fmt.Sprintf("%s/%s:%d", c.Endpoint, app, port)),
+		down:      make(chan []byte, 16),
+		ctx:       pctx,
+		cancel:    cancel,
+	}
+	go conn.pollLoop()
+	return conn, nil
+}
+
+// pollAddr is the address of a connection over the HTTP transport.
+type pollAddr string
+
+func (a pollAddr) Network() string { return "https" }
+func (a pollAddr) String() string  { return string(a) }
+
+// pollConn is the client side of a connection over the HTTP transport.
+type pollConn struct {
+	client    *http.Client
+	base      string
+	head      http.Header
+	session   string
+	frameSize int
+	addr      net.Addr
+
+	writeMu  sync.Mutex
+	upSeq    uint64
+	writeErr error
+
+	down    chan []byte
+	buf     []byte
+	readErr error
+
+	readDeadline  pollDeadline
+	writeDeadline pollDeadline
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+func (c *pollConn) url(op string, params url.Values) string {
+	params.Set("session", c.session)
+	return c.base + op + "?" + params.Encode()
+}
+
+// pollDeadline is a deadline of a pollConn. Waiters are woken when it
+// changes so that they can wait for the new deadline.
+type pollDeadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *pollDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+}
+
+// get returns the deadline, and a channel closed when it changes.
+func (d *pollDeadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+// exceeded returns whether the deadline has passed.
+func (d *pollDeadline) exceeded() bool {
+	t, _ := d.get()
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+// deadlineTimer returns a channel that fires when the deadline passes, nil without a
+// deadline, and a function to stop it.
+func deadlineTimer(t time.Time) (<-chan time.Time, func() bool) {
+	if t.IsZero() {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, timer.Stop
+}
+
+// writeContext returns the context of the requests of a Write, canceled when
+// the connection closes or the write deadline passes.
+func (c *pollConn) writeContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	go func() {
+		for {
+			deadline, changed := c.writeDeadline.get()
+			timeout, stop := deadlineTimer(deadline)
+			select {
+			case <-timeout:
+				cancel()
+				return
+			case <-changed:
+				stop()
+			case <-ctx.Done():
+				stop()
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// ctxErr returns the error of a request canceled with ctx.
+func (c *pollConn) ctxErr(ctx context.Context) error {
+	if c.ctx.Err() != nil {
+		return net.ErrClosed
+	}
+	return os.ErrDeadlineExceeded
+}
+
+// do sends a request, retrying transport errors and server errors.
+func (c *pollConn) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < pollAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return nil, c.ctxErr(ctx)
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = c.head.Clone()
+		resp, err := c.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, c.ctxErr(ctx)
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("HTTP error: %s", resp.Status)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// pollLoop long-polls for data and queues it for Read until the remote side
+// closes or a request fails.
+func (c *pollConn) pollLoop() {
+	var err error
+	defer func() {
+		c.readErr = err
+		close(c.down)
+	}()
+
+	var ack uint64
+	for {
+		var resp *http.Response
+		resp, err = c.do(c.ctx, "GET", c.url("down", url.Values{"ack": {strconv.FormatUint(ack, 10)}}), nil)
+		if err != nil {
+			return
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				// Poll again from the same chunk.
+				err = nil
+				continue
+			}
+			next, perr := strconv.ParseUint(resp.Header.Get(pollHeaderNext), 10, 64)
+			if perr != nil {
+				err = fmt.Errorf("invalid poll response: %v", perr)
+				return
+			}
+			select {
+			case c.down <- body:
+			case <-c.ctx.Done():
+				err = net.ErrClosed
+				return
+			}
+			ack = next
+		case http.StatusNoContent:
+			resp.Body.Close()
+		case http.StatusGone:
+			resp.Body.Close()
+			err = io.EOF
+			return
+		default:
+			resp.Body.Close()
+			err = fmt.Errorf("HTTP error: %s", resp.Status)
+			return
+		}
+	}
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.readDeadline.exceeded() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		deadline, changed := c.readDeadline.get()
+		timeout, stop := deadlineTimer(deadline)
+		select {
+		case data, ok := <-c.down:
+			stop()
+			if !ok {
+				return 0, c.readErr
+			}
+			c.buf = data
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+			// Wait again with the new deadline.
+			stop()
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Write sends b in chunks of at most frameSize bytes, one request each.
+func (c *pollConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	if c.writeDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > c.frameSize {
+			n = c.frameSize
+		}
+		params := url.Values{"seq": {strconv.FormatUint(c.upSeq, 10)}}
+		resp, err := c.do(ctx, "POST", c.url("up", params), b[written:written+n])
+		if err == os.ErrDeadlineExceeded {
+			// The chunk may have been written, the stream cannot resume.
+			c.writeErr = err
+		}
+		if err != nil {
+			return written, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return written, fmt.Errorf("HTTP error: %s", resp.Status)
+		}
+		c.upSeq++
+		written += n
+	}
+	return written, nil
+}
+
+func (c *pollConn) Close() error {
+	c.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "DELETE", c.url("close", url.Values{}), nil)
+		if err == nil {
+			req.Header = c.head.Clone()
+			if resp, err := c.client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *pollConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pollConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pollConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read calls, including one that is
+// already waiting.
+func (c *pollConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write calls, including the request
+// of one in progress. Once a request was cut off by the deadline, later
+// Write calls fail too since its chunk may or may not have been written.
+func (c *pollConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,388 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTarget starts a TCP target and returns its address and the accepted
+// connections.
+func startTarget(t *testing.T) (string, <-chan net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns <- conn
+		}
+	}()
+	return l.Addr().String(), conns
+}
+
+// newPollClient returns a client of the HTTP transport served by h, with
+// small upload chunks.
+func newPollClient(t *testing.T, h http.Handler) *Client {
+	ts := httptest.NewTLSServer(h)
+	t.Cleanup(ts.Close)
+	c := &Client{
+		Endpoint:   strings.TrimPrefix(ts.URL, "https://"),
+		Tokens:     StaticTokenSource("token"),
+		HTTPClient: ts.Client(),
+		FrameSize:  1000,
+		Transport:  TransportHTTP,
+	}
+	c.SetBrokerCookie("app", "broker_app=cookie")
+	return c
+}
+
+// dialPoll opens a connection to the target over the HTTP transport.
+func dialPoll(t *testing.T, c *Client, target string) *pollConn {
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	conn, err := c.DialHTTP(context.Background(), "app", host, portNum)
+	if err != nil {
+		t.Fatalf("DialHTTP() failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*pollConn)
+}
+
+// faultHandler fails the first successful response to an operation with a
+// server error after the PollHandler handled it, so the client retries a
+// request that took effect.
+type faultHandler struct {
+	*PollHandler
+	op string
+
+	mu      sync.Mutex
+	faulted bool
+}
+
+func (h *faultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/"+h.op) {
+		h.PollHandler.ServeHTTP(w, r)
+		return
+	}
+	rec := httptest.NewRecorder()
+	h.PollHandler.ServeHTTP(rec, r)
+	h.mu.Lock()
+	fault := !h.faulted && rec.Code == http.StatusOK
+	if fault {
+		h.faulted = true
+	}
+	h.mu.Unlock()
+	if fault {
+		http.Error(w, "injected fault", http.StatusServiceUnavailable)
+		return
+	}
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+func TestPollRoundTrip(t *testing.T) {
+	payload := make([]byte, 5500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// faultOp is the operation whose first response fails.
+		faultOp string
+	}{
+		{name: "no faults"},
+		{name: "retried upload", faultOp: "up"},
+		{name: "retried poll", faultOp: "down"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &PollHandler{}
+			c := newPollClient(t, &faultHandler{PollHandler: h, op: tc.faultOp})
+			target, conns := startTarget(t)
+			conn := dialPoll(t, c, target)
+			tconn := <-conns
+			go io.Copy(tconn, tconn)
+
+			go conn.Write(payload)
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("reading the echo failed: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("echo differs from the data sent")
+			}
+
+			conn.Close()
+			h.mu.Lock()
+			sessions := len(h.sessions)
+			h.mu.Unlock()
+			if sessions != 0 {
+				t.Errorf("%d sessions left after Close()", sessions)
+			}
+		})
+	}
+}
+
+// pollServer sends requests of the HTTP transport to a PollHandler.
+type pollServer struct {
+	t   *testing.T
+	h   *PollHandler
+	url string
+}
+
+func newPollServer(t *testing.T) *pollServer {
+	h := &PollHandler{}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &pollServer{t: t, h: h, url: ts.URL + "/poll/"}
+}
+
+func (s *pollServer) do(method, op, query, body string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, s.url+op+"?"+query, strings.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s %s failed: %v", method, op, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return resp, b
+}
+
+// open opens a session to the target and returns its ID.
+func (s *pollServer) open(target string) string {
+	host, port, _ := net.SplitHostPort(target)
+	resp, b := s.do("POST", "open", "host="+host+"&port="+port, "")
+	var open struct {
+		Session string `json:"session"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(b, &open) != nil {
+		s.t.Fatalf("open returned %s %q", resp.Status, b)
+	}
+	return open.Session
+}
+
+func TestPollHandlerProtocol(t *testing.T) {
+	s := newPollServer(t)
+	target, conns := startTarget(t)
+	id := s.open(target)
+	tconn := <-conns
+	tconn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	expect := func(method, op, query, body string, status int, want string) {
+		t.Helper()
+		resp, b := s.do(method, op, "session="+id+"&"+query, body)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s?%s returned %s, want %d", method, op, query, resp.Status, status)
+		}
+		if len(want) > 0 && string(b) != want {
+			t.Errorf("%s %s?%s returned %q, want %q", method, op, query, b, want)
+		}
+	}
+	readTarget := func(want string) {
+		t.Helper()
+		buf := make([]byte, len(want))
+		if _, err := io.ReadFull(tconn, buf); err != nil || string(buf) != want {
+			t.Fatalf("target read %q, %v, want %q", buf, err, want)
+		}
+	}
+
+	// Chunks ahead are rejected, retried chunks are not written again.
+	expect("POST", "up", "seq=1", "world", http.StatusConflict, "")
+	expect("POST", "up", "seq=0", "hello", http.StatusOK, "")
+	expect("POST", "up", "seq=0", "hello", http.StatusOK, "")
+	expect("POST", "up", "seq=1", "!", http.StatusOK, "")
+	readTarget("hello!")
+
+	// Chunks are kept until acknowledged.
+	tconn.Write([]byte("reply"))
+	expect("GET", "down", "ack=1", "", http.StatusConflict, "")
+	expect("GET", "down", "ack=0", "", http.StatusOK, "reply")
+	expect("GET", "down", "ack=0", "", http.StatusOK, "reply")
+
+	// The end of the stream is reported once all data was acknowledged.
+	tconn.Write([]byte("bye"))
+	tconn.Close()
+	expect("GET", "down", "ack=1", "", http.StatusOK, "bye")
+	expect("GET", "down", "ack=2", "", http.StatusGone, "")
+
+	expect("DELETE", "close", "", "", http.StatusOK, "")
+	expect("GET", "down", "ack=2", "", http.StatusGone, "")
+	expect("POST", "up", "seq=2", "late", http.StatusGone, "")
+	expect("GET", "down", "ack=0", "", http.StatusGone, "")
+	expect("GET", "up", "seq=2", "", http.StatusMethodNotAllowed, "")
+}
+
+func TestPollHandlerAckWindow(t *testing.T) {
+	s := newPollServer(t)
+	target, conns := startTarget(t)
+	id := s.open(target)
+	tconn := <-conns
+	const size = 3 * pollMaxBuffered
+	go func() {
+		tconn.Write(make([]byte, size))
+		tconn.Close()
+	}()
+
+	// Without acknowledgements the target is read up to the window.
+	time.Sleep(200 * time.Millisecond)
+	resp, b := s.do("GET", "down", "session="+id+"&ack=0", "")
+	if resp.StatusCode != http.StatusOK || len(b) > pollMaxBuffered+pollReadBufferSize {
+		t.Fatalf("poll without acknowledgements returned %s with %d bytes, want at most %d", resp.Status, len(b), pollMaxBuffered+pollReadBufferSize)
+	}
+
+	// Acknowledging moves the window to the end of the stream.
+	ack, total := "0", 0
+	for {
+		resp, b := s.do("GET", "down", "session="+id+"&ack="+ack, "")
+		if resp.StatusCode == http.StatusGone {
+			break
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("poll returned %s", resp.Status)
+		}
+		total += len(b)
+		ack = resp.Header.Get(pollHeaderNext)
+	}
+	if total != size {
+		t.Errorf("received %d bytes, want %d", total, size)
+	}
+}
+
+func TestPollHandlerIdle(t *testing.T) {
+	s := newPollServer(t)
+	target, conns := startTarget(t)
+	id := s.open(target)
+	tconn := <-conns
+
+	// Sessions with recent requests are kept.
+	s.h.closeIdle()
+	if resp, _ := s.do("POST", "up", "session="+id+"&seq=0", "x"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("up to an active session returned %s", resp.Status)
+	}
+
+	s.h.mu.Lock()
+	session := s.h.sessions[id]
+	s.h.mu.Unlock()
+	session.mu.Lock()
+	session.lastSeen = time.Now().Add(-pollIdleTimeout - time.Second)
+	session.mu.Unlock()
+	s.h.closeIdle()
+
+	if resp, _ := s.do("GET", "down", "session="+id+"&ack=0", ""); resp.StatusCode != http.StatusGone {
+		t.Errorf("poll of an idle session returned %s, want 410", resp.Status)
+	}
+	tconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ioutil.ReadAll(tconn); err != nil || string(b) != "x" {
+		t.Errorf("target read %q, %v, want %q and EOF", b, err, "x")
+	}
+}
+
+func TestPollConnDeadlines(t *testing.T) {
+	h := &PollHandler{}
+	gaveUp := make(chan struct{}, 1)
+	c := newPollClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/up") && r.URL.Query().Get("seq") == "1" {
+			// Hang the second upload until the client gives up.
+			io.Copy(ioutil.Discard, r.Body)
+			<-r.Context().Done()
+			gaveUp <- struct{}{}
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	target, conns := startTarget(t)
+	conn := dialPoll(t, c, target)
+	tconn := <-conns
+
+	// A deadline set while Read waits wakes it.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.SetReadDeadline(time.Now())
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read() returned %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read() was not woken by the deadline")
+	}
+
+	// Clearing the deadline lets reads continue.
+	conn.SetReadDeadline(time.Time{})
+	tconn.Write([]byte("x"))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read() after clearing the deadline failed: %v", err)
+	}
+
+	if _, err := conn.Write([]byte("a")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if _, err := conn.Write([]byte("b")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() of a hanging upload returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Write() returned after %v", d)
+	}
+	// The chunk may have been written, later writes fail too.
+	conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write([]byte("c")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() after a timed out write returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the timed out upload was not canceled")
+	}
+}
@@ -0,0 +1,366 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The HTTP transport carries the byte stream of a connection over ordinary
+// requests for networks that block websocket upgrades:
+//
+//	POST   open?host=H&port=P    dials H:P and returns {"session": ID}
+//	POST   up?session=ID&seq=N   writes the body, chunk N, to the connection
+//	GET    down?session=ID&ack=N waits for data from chunk N, the body holds
+//	                             chunks N to X-Selkies-Next minus one
+//	DELETE close?session=ID      closes the connection
+//
+// Upload chunks are numbered from zero and written in order, retried chunks
+// are acknowledged without being written twice. Download chunks are kept
+// until a later poll acknowledges them. A poll returns 204 when no data
+// arrived within the poll timeout and 410 after the remote side closed and
+// all data was delivered.
+const (
+	pollHeaderNext     = "X-Selkies-Next"
+	pollTimeout        = 25 * time.Second
+	pollIdleTimeout    = 2 * time.Minute
+	pollMaxBuffered    = 1 << 20
+	pollMaxChunk       = 1 << 20
+	pollReadBufferSize = 32 * 1024
+)
+
+// PollHandler serves the HTTP transport in the app pod. It is the
+// counterpart of the app proxy websocket for clients that fall back to HTTP.
+type PollHandler struct {
+	// Dial connects to the target of a session. net.Dial is used if nil.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// ErrorLog logs session errors. The standard logger is used if nil.
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+	gcOnce   sync.Once
+}
+
+// pollSession is a connection to a target and its buffered download chunks.
+type pollSession struct {
+	conn net.Conn
+
+	upMu   sync.Mutex
+	nextUp uint64
+
+	mu       sync.Mutex
+	notify   chan struct{}
+	down     [][]byte
+	downBase uint64
+	buffered int
+	eof      bool
+	closed   bool
+	lastSeen time.Time
+}
+
+func (h *PollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.gcOnce.Do(func() { go h.gc() })
+
+	switch path.Base(r.URL.Path) {
+	case "open":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.open(w, r)
+	case "up":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s := h.session(w, r); s != nil {
+			h.up(w, r, s)
+		}
+	case "down":
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if s := h.session(w, r); s != nil {
+			h.poll(w, r, s)
+		}
+	case "close":
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.close(r.URL.Query().Get("session"))
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *PollHandler) open(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	port := r.URL.Query().Get("port")
+	if len(host) == 0 || len(port) == 0 {
+		http.Error(w, "missing host or port", http.StatusBadRequest)
+		return
+	}
+
+	dial := h.Dial
+	if dial == nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, 10*time.Second)
+		}
+	}
+	conn, err := dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		h.logf("Failed to dial %s:%s: %v", host, port, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		conn.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s := &pollSession{
+		conn:     conn,
+		notify:   make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+	sessionID := hex.EncodeToString(id)
+
+	h.mu.Lock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]*pollSession)
+	}
+	h.sessions[sessionID] = s
+	h.mu.Unlock()
+
+	go s.readLoop()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"session": sessionID})
+}
+
+func (h *PollHandler) session(w http.ResponseWriter, r *http.Request) *pollSession {
+	h.mu.Lock()
+	s, ok := h.sessions[r.URL.Query().Get("session")]
+	h.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown session", http.StatusGone)
+		return nil
+	}
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+	return s
+}
+
+func (h *PollHandler) up(w http.ResponseWriter, r *http.Request, s *pollSession) {
+	seq, err := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, pollMaxChunk+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > pollMaxChunk {
+		http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.upMu.Lock()
+	defer s.upMu.Unlock()
+	switch {
+	case seq < s.nextUp:
+		// A retry of a chunk that was already written.
+	case seq > s.nextUp:
+		http.Error(w, fmt.Sprintf("expected chunk %d", s.nextUp), http.StatusConflict)
+		return
+	default:
+		if _, err := s.conn.Write(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		s.nextUp++
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *PollHandler) poll(w http.ResponseWriter, r *http.Request, s *pollSession) {
+	ack, err := strconv.ParseUint(r.URL.Query().Get("ack"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid ack", http.StatusBadRequest)
+		return
+	}
+
+	timer := time.NewTimer(pollTimeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		next := s.downBase + uint64(len(s.down))
+		if ack < s.downBase || ack > next {
+			s.mu.Unlock()
+			http.Error(w, fmt.Sprintf("ack %d outside of %d to %d", ack, s.downBase, next), http.StatusConflict)
+			return
+		}
+		// Drop acknowledged chunks.
+		for s.downBase < ack {
+			s.buffered -= len(s.down[0])
+			s.down = s.down[1:]
+			s.downBase++
+		}
+		if len(s.down) > 0 {
+			var body []byte
+			for _, chunk := range s.down {
+				body = append(body, chunk...)
+			}
+			s.signal()
+			s.mu.Unlock()
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set(pollHeaderNext, strconv.FormatUint(next, 10))
+			w.Write(body)
+			return
+		}
+		// Wake the read loop for the dropped chunks, then wait for data.
+		s.signal()
+		eof := s.eof
+		notify := s.notify
+		s.mu.Unlock()
+
+		if eof {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *PollHandler) close(id string) {
+	h.mu.Lock()
+	s, ok := h.sessions[id]
+	delete(h.sessions, id)
+	h.mu.Unlock()
+	if ok {
+		s.conn.Close()
+		s.mu.Lock()
+		s.closed = true
+		s.signal()
+		s.mu.Unlock()
+	}
+}
+
+// gc closes idle sessions periodically.
+func (h *PollHandler) gc() {
+	for range time.Tick(pollIdleTimeout / 4) {
+		h.closeIdle()
+	}
+}
+
+// closeIdle closes sessions without requests for pollIdleTimeout.
+func (h *PollHandler) closeIdle() {
+	var idle []string
+	h.mu.Lock()
+	for id, s := range h.sessions {
+		s.mu.Lock()
+		if time.Since(s.lastSeen) > pollIdleTimeout {
+			idle = append(idle, id)
+		}
+		s.mu.Unlock()
+	}
+	h.mu.Unlock()
+	for _, id := range idle {
+		h.logf("Closing idle session %s", id)
+		h.close(id)
+	}
+}
+
+func (h *PollHandler) logf(format string, args ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// readLoop buffers data from the target until it closes, pausing while more
+// than pollMaxBuffered bytes are unacknowledged.
+func (s *pollSession) readLoop() {
+	for {
+		s.mu.Lock()
+		for s.buffered >= pollMaxBuffered && !s.closed {
+			notify := s.notify
+			s.mu.Unlock()
+			<-notify
+			s.mu.Lock()
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+
+		buf := make([]byte, pollReadBufferSize)
+		n, err := s.conn.Read(buf)
+
+		s.mu.Lock()
+		if n > 0 {
+			s.down = append(s.down, buf[:n])
+			s.buffered += n
+		}
+		if err != nil {
+			s.eof = true
+		}
+		s.signal()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// signal wakes goroutines waiting for data or acknowledgements. s.mu must be
+// held.
+func (s *pollSession) signal() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
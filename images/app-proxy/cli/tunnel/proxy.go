@@ -0,0 +1,162 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProxyHandler serves the app proxy websocket in the app pod. A request to
+// /proxy/HOST/PORT dials HOST:PORT and carries its byte stream in binary
+// messages. It negotiates permessage-deflate when the client asks for it.
+//
+// A close message from the client only closes the write side of the
+// connection to HOST:PORT, data sent back is delivered until the remote side
+// closes too, then the handler sends its own close message.
+type ProxyHandler struct {
+	// Dial connects to the target. net.Dial is used if nil.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// ReadBufferSize and WriteBufferSize are the websocket I/O buffer
+	// sizes, the gorilla/websocket defaults are used if zero.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// FrameSize is the maximum payload of each message sent, default to
+	// 32 KiB.
+	FrameSize int
+
+	// ErrorLog logs connection errors. The standard logger is used if nil.
+	ErrorLog *log.Logger
+}
+
+func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || len(parts[len(parts)-2]) == 0 || len(parts[len(parts)-1]) == 0 {
+		http.Error(w, "missing host or port", http.StatusBadRequest)
+		return
+	}
+	host, port := parts[len(parts)-2], parts[len(parts)-1]
+
+	dial := h.Dial
+	if dial == nil {
+		dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, 10*time.Second)
+		}
+	}
+	conn, err := dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		h.logf("Failed to dial %s:%s: %v", host, port, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    h.ReadBufferSize,
+		WriteBufferSize:   h.WriteBufferSize,
+		EnableCompression: true,
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade replied with the error.
+		return
+	}
+	defer ws.Close()
+	h.proxy(ws, conn)
+}
+
+// proxy copies data between the websocket and the target until both sides
+// closed, or either failed.
+func (h *ProxyHandler) proxy(ws *websocket.Conn, conn net.Conn) {
+	// Reply to the close message of the client once the target closed,
+	// instead of right away.
+	ws.SetCloseHandler(func(code int, text string) error {
+		return nil
+	})
+
+	// websocket -> target
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			mt, r, err := ws.NextReader()
+			if err != nil {
+				if _, ok := err.(*websocket.CloseError); ok {
+					if cw, ok := conn.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+						return
+					}
+				}
+				conn.Close()
+				return
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			if _, err := io.Copy(conn, r); err != nil {
+				h.logf("Writing to target: %v", err)
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// target -> websocket
+	frameSize := h.FrameSize
+	if frameSize <= 0 {
+		frameSize = defaultFrameSize
+	}
+	buf := make([]byte, frameSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				conn.Close()
+				break
+			}
+		}
+		if err != nil {
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(defaultWriteTimeout))
+			break
+		}
+	}
+
+	// Give the client time to reply to the close message.
+	select {
+	case <-done:
+	case <-time.After(defaultWriteTimeout):
+		ws.Close()
+		<-done
+	}
+}
+
+func (h *ProxyHandler) logf(format string, args ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,158 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startReplyTarget starts a target that reads until the client half closes,
+// then replies with the number of bytes read and closes.
+func startReplyTarget(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(ioutil.Discard, conn)
+				// Late data, sent after the client is done.
+				time.Sleep(50 * time.Millisecond)
+				fmt.Fprintf(conn, "read %d bytes", n)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// localConnPair returns both ends of a loopback TCP connection, so that the
+// client end can be half closed.
+func localConnPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestProxyHandlerHalfClose(t *testing.T) {
+	srv := httptest.NewServer(&ProxyHandler{})
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(startReplyTarget(t))
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/proxy/" + host + "/" + port
+	payload := strings.Repeat("compressible ", 10000)
+
+	for _, tc := range []struct {
+		name        string
+		compression bool
+		// pump copies between the local connection and the websocket.
+		pump func(ctx context.Context, lconn net.Conn, ws *websocket.Conn) (string, error)
+	}{
+		{"Pump", false, func(ctx context.Context, lconn net.Conn, ws *websocket.Conn) (string, error) {
+			return Pump(ctx, lconn, ws, PumpOptions{})
+		}},
+		{"Pump compressed", true, func(ctx context.Context, lconn net.Conn, ws *websocket.Conn) (string, error) {
+			return Pump(ctx, lconn, ws, PumpOptions{})
+		}},
+		{"PumpConn", false, func(ctx context.Context, lconn net.Conn, ws *websocket.Conn) (string, error) {
+			return PumpConn(ctx, lconn, NewConn(ws, time.Second), PumpOptions{})
+		}},
+		{"PumpConn compressed", true, func(ctx context.Context, lconn net.Conn, ws *websocket.Conn) (string, error) {
+			return PumpConn(ctx, lconn, NewConn(ws, time.Second), PumpOptions{})
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer := &websocket.Dialer{EnableCompression: tc.compression}
+			ws, resp, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatalf("Dial() failed: %v", err)
+			}
+			defer ws.Close()
+			negotiated := strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+			if negotiated != tc.compression {
+				t.Errorf("negotiated compression %v, want %v", negotiated, tc.compression)
+			}
+
+			client, lconn := localConnPair(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			type result struct {
+				reason string
+				err    error
+			}
+			results := make(chan result, 1)
+			go func() {
+				reason, err := tc.pump(ctx, lconn, ws)
+				lconn.Close()
+				results <- result{reason, err}
+			}()
+
+			if _, err := io.WriteString(client, payload); err != nil {
+				t.Fatal(err)
+			}
+			client.CloseWrite()
+			reply, err := ioutil.ReadAll(client)
+			if err != nil {
+				t.Fatalf("reading the reply failed: %v", err)
+			}
+			if want := fmt.Sprintf("read %d bytes", len(payload)); string(reply) != want {
+				t.Errorf("read reply %q, want %q", reply, want)
+			}
+
+			r := <-results
+			if r.reason != ClosedByClient || r.err != nil {
+				t.Errorf("pump returned %s, %v, want %s", r.reason, r.err, ClosedByClient)
+			}
+		})
+	}
+
+	// A target that cannot be dialed fails before the upgrade.
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/proxy/127.0.0.1/1", nil)
+	if err == nil || resp == nil || resp.StatusCode != 502 {
+		t.Errorf("Dial() of a closed port returned %v, want status 502", err)
+	}
+}
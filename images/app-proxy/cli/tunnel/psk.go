@@ -0,0 +1,142 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// The pre-shared key handshake is a challenge and response: the listener
+// sends a version byte and a random nonce, the client replies with the
+// HMAC-SHA256 of the nonce keyed with the pre-shared key. It authenticates
+// the client but does not encrypt the stream, combine it with TLS for that.
+const (
+	pskVersion   = 1
+	pskNonceSize = 32
+	pskContext   = "selkies-connector-psk-client"
+)
+
+// ErrPSKMismatch is returned by the listener side of the handshake when the
+// client does not know the pre-shared key.
+var ErrPSKMismatch = errors.New("pre-shared key mismatch")
+
+// pskConn runs the pre-shared key handshake before the first read or write.
+type pskConn struct {
+	net.Conn
+	key    []byte
+	server bool
+
+	once sync.Once
+	err  error
+}
+
+// PSKListener returns a listener whose connections must complete the
+// pre-shared key handshake before data is exchanged. The handshake runs on
+// the first Read or Write, or when Handshake is called.
+func PSKListener(l net.Listener, key []byte) net.Listener {
+	return &pskListener{Listener: l, key: key}
+}
+
+type pskListener struct {
+	net.Listener
+	key []byte
+}
+
+func (l *pskListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &pskConn{Conn: conn, key: l.key, server: true}, nil
+}
+
+// PSKClient returns the client side of a connection to a PSKListener.
+func PSKClient(conn net.Conn, key []byte) net.Conn {
+	return &pskConn{Conn: conn, key: key}
+}
+
+// Handshake runs the pre-shared key handshake if it has not run yet.
+func (c *pskConn) Handshake() error {
+	c.once.Do(func() {
+		if c.server {
+			c.err = c.serverHandshake()
+		} else {
+			c.err = c.clientHandshake()
+		}
+	})
+	return c.err
+}
+
+func (c *pskConn) serverHandshake() error {
+	challenge := make([]byte, 1+pskNonceSize)
+	challenge[0] = pskVersion
+	if _, err := rand.Read(challenge[1:]); err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(challenge); err != nil {
+		return err
+	}
+
+	response := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(c.Conn, response); err != nil {
+		return fmt.Errorf("reading pre-shared key response: %v", err)
+	}
+	if !hmac.Equal(response, pskMAC(c.key, challenge[1:])) {
+		return ErrPSKMismatch
+	}
+	return nil
+}
+
+func (c *pskConn) clientHandshake() error {
+	challenge := make([]byte, 1+pskNonceSize)
+	if _, err := io.ReadFull(c.Conn, challenge); err != nil {
+		return fmt.Errorf("reading pre-shared key challenge: %v", err)
+	}
+	if challenge[0] != pskVersion {
+		return fmt.Errorf("unsupported pre-shared key handshake version %d", challenge[0])
+	}
+	_, err := c.Conn.Write(pskMAC(c.key, challenge[1:]))
+	return err
+}
+
+func pskMAC(key, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pskContext))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func (c *pskConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *pskConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
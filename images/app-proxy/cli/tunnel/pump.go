@@ -0,0 +1,201 @@
+/*
+ Copyright 2020 Google Inc. All rights reserved.
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// PumpOptions configures Pump.
+type PumpOptions struct {
+	// WriteTimeout is the timeout for the close message, default to 10
+	// seconds.
+	WriteTimeout time.Duration
+
+	// FrameSize is the maximum payload of each websocket message, and the
+	// size of the copy buffers, default to 32 KiB.
+	FrameSize int
+
+	// ErrorLog logs copy errors. The standard logger is used if nil.
+	ErrorLog *log.Logger
+}
+
+// Reasons passed to Hooks.Closed and returned by Pump.
+const (
+	ClosedByClient   = "client_closed"
+	ClosedByRemote   = "remote_closed"
+	ClosedOnError    = "error"
+	ClosedDialFailed = "dial_failed"
+	ClosedCanceled   = "canceled"
+)
+
+// closeReason keeps the first reason a pump stopped for.
+type closeReason struct {
+	once   sync.Once
+	reason string
+	err    error
+}
+
+func (c *closeReason) set(reason string, err error) {
+	c.once.Do(func() {
+		c.reason = reason
+		c.err = err
+	})
+}
+
+// Pump copies data between a local connection and a websocket to the app
+// proxy until either side closes or ctx is done. It returns why it stopped
+// and the error for ClosedOnError.
+func Pump(ctx context.Context, lconn net.Conn, rconn *websocket.Conn, opts PumpOptions) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logf := log.Printf
+	if opts.ErrorLog != nil {
+		logf = opts.ErrorLog.Printf
+	}
+	writeTimeout := opts.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = defaultWriteTimeout
+	}
+	frameSize := opts.FrameSize
+	if frameSize <= 0 {
+		frameSize = defaultFrameSize
+	}
+
+	var closed closeReason
+	defer func() {
+		closed.set(ClosedCanceled, nil)
+	}()
+
+	// websocket -> local socket
+	go func() {
+		defer cancel()
+		buf := make([]byte, frameSize)
+		for {
+			mt, r, err := rconn.NextReader()
+			if err != nil {
+				if _, ok := err.(*websocket.CloseError); ok {
+					closed.set(ClosedByRemote, nil)
+				} else {
+					closed.set(ClosedOnError, err)
+				}
+				return
+			}
+			if mt != websocket.BinaryMessage {
+				logf("invalid binary data from websocket")
+			}
+			if _, err := io.CopyBuffer(lconn, r, buf); err != nil {
+				logf("Reading from websocket: %v", err)
+				closed.set(ClosedOnError, err)
+				return
+			}
+		}
+	}()
+
+	// Unblock the local read below when the websocket side is done.
+	go func() {
+		<-ctx.Done()
+		lconn.SetReadDeadline(time.Now())
+	}()
+
+	// local socket -> websocket
+	buf := make([]byte, frameSize)
+	for {
+		n, err := lconn.Read(buf)
+		if n > 0 {
+			if err := rconn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				logf("Writing to websocket: %v", err)
+				closed.set(ClosedOnError, err)
+				return closed.reason, closed.err
+			}
+		}
+		if ctx.Err() != nil {
+			closed.set(ClosedCanceled, nil)
+			return closed.reason, closed.err
+		}
+		if err == io.EOF {
+			closed.set(ClosedByClient, nil)
+			if err := rconn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(writeTimeout)); err != nil && err != websocket.ErrCloseSent {
+				logf("Error sending close message: %v", err)
+			}
+			// The remote side may still send data after the client half
+			// closed, deliver it until the websocket closes too.
+			<-ctx.Done()
+			return closed.reason, closed.err
+		}
+		if err != nil {
+			logf("reading from local socket: %v", err)
+			closed.set(ClosedOnError, err)
+			return closed.reason, closed.err
+		}
+	}
+}
+
+// PumpConn copies data between a local connection and a connection returned
+// by Client.Dial until either side closes or ctx is done. It returns like
+// Pump.
+func PumpConn(ctx context.Context, lconn, rconn net.Conn, opts PumpOptions) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logf := log.Printf
+	if opts.ErrorLog != nil {
+		logf = opts.ErrorLog.Printf
+	}
+	frameSize := opts.FrameSize
+	if frameSize <= 0 {
+		frameSize = defaultFrameSize
+	}
+
+	var closed closeReason
+	copyConn := func(dst, src net.Conn, name, eofReason string) {
+		_, err := io.CopyBuffer(dst, src, make([]byte, frameSize))
+		switch {
+		case err == nil:
+			closed.set(eofReason, nil)
+			// Half close the remote side if it can, and keep copying the
+			// other way until it closes too.
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && dst == rconn {
+				if err := cw.CloseWrite(); err == nil {
+					return
+				}
+			}
+		case ctx.Err() == nil:
+			logf("%s: %v", name, err)
+			closed.set(ClosedOnError, err)
+		}
+		cancel()
+	}
+	go copyConn(lconn, rconn, "Reading from remote connection", ClosedByRemote)
+	go copyConn(rconn, lconn, "reading from local socket", ClosedByClient)
+
+	<-ctx.Done()
+	lconn.Close()
+	rconn.Close()
+	closed.set(ClosedCanceled, nil)
+	return closed.reason, closed.err
+}
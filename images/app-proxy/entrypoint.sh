@@ -17,5 +17,8 @@
 # Start http server
 lighttpd -f /etc/lighttpd/lighttpd.conf
 
+# Start the HTTP long-poll transport, the fallback for blocked websockets
+/opt/selkies_connector_linux_amd64 serve-http -listen "0.0.0.0:8023" &
+
 # Start the proxy
-/opt/huproxy -listen "0.0.0.0:8022"
+/opt/selkies_connector_linux_amd64 serve-http -listen "0.0.0.0:8022"
@@ -17,13 +17,17 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	"github.com/danisla/uinput-device-plugin/pkg/uinput"
 	"github.com/golang/glog"
 )
 
 var (
-	socketPath = flag.String("server", "/tmp/.uinput/uinputctl", "The unix socket to connect to")
+	socketPath     = flag.String("server", "/tmp/.uinput/uinputctl", "The unix socket to connect to")
+	podNamespace   = flag.String("pod-namespace", os.Getenv("POD_NAMESPACE"), "Namespace of the pod, checked by the host against the pod of the container. Defaults to $POD_NAMESPACE.")
+	podUID         = flag.String("pod-uid", os.Getenv("POD_UID"), "UID of the pod, checked by the host against the pod of the container. Defaults to $POD_UID.")
+	containerNames = flag.String("containers", os.Getenv("UINPUT_CONTAINERS"), "Comma separated names of the containers of the pod given the devices in pod mode, all containers when empty. Defaults to $UINPUT_CONTAINERS.")
 )
 
 func main() {
@@ -34,7 +38,18 @@ func main() {
 		glog.Fatalf("failed to get hostname: %v", err)
 	}
 
-	if err := uinput.StartUdevDeviceWatch(*socketPath, hostname); err != nil {
+	pod := uinput.HelperPod{
+		Name:      hostname,
+		Namespace: *podNamespace,
+		UID:       *podUID,
+	}
+	for _, name := range strings.Split(*containerNames, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			pod.ContainerNames = append(pod.ContainerNames, name)
+		}
+	}
+
+	if err := uinput.StartUdevDeviceWatch(*socketPath, pod); err != nil {
 		glog.Errorf("%v", err)
 	}
 }
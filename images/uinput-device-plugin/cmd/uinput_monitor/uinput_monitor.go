@@ -8,16 +8,21 @@ import (
 	"strconv"
 
 	"github.com/danisla/uinput-device-plugin/pkg/uinput"
-	docker "github.com/docker/docker/client"
 	"github.com/golang/glog"
 )
 
 var (
-	socketDirectory = flag.String("socket-dir", "/tmp/.uinput", "Directory to create control sockets in")
-	numSockets      = flag.Int("num-sockets", 16, "The number of control sockets to create")
-	readyFile       = flag.String("ready-file", "/tmp/.uinput/ctl_devices_ready", "File to create once all sockets have been created.")
-	sysFSPrefix     = flag.String("sys-prefix", "/hostfs", "prefix where /sys/fs is mounted to")
-	deviceFileMode  = flag.String("device-file-mode", "0666", "default mode for device files created in containers.")
+	socketDirectory  = flag.String("socket-dir", "/tmp/.uinput", "Directory to create control sockets in")
+	numSockets       = flag.Int("num-sockets", 16, "The number of control sockets to create")
+	readyFile        = flag.String("ready-file", "/tmp/.uinput/ctl_devices_ready", "File to create once all sockets have been created.")
+	sysFSPrefix      = flag.String("sys-prefix", "/hostfs", "prefix where /sys/fs is mounted to")
+	deviceFileMode   = flag.String("device-file-mode", "0666", "default mode for device files created in containers.")
+	deviceUID        = flag.Int("device-uid", 0, "owner of the device files created in containers.")
+	deviceGID        = flag.Int("device-gid", 0, "group of the device files created in containers.")
+	procDir          = flag.String("proc-dir", "/proc", "procfs of the host pid namespace, used to create device files from the mount namespace of containers.")
+	containerRuntime = flag.String("container-runtime", "auto", "Container runtime to find containers with, one of: auto, cri, docker. auto uses the CRI endpoint when it responds, docker otherwise.")
+	criEndpoint      = flag.String("cri-endpoint", "unix:///run/containerd/containerd.sock", "Endpoint of the CRI runtime service.")
+	stateFile        = flag.String("state-file", "", "File to persist device grants to across restarts, defaults to monitor_state.json in the socket directory.")
 )
 
 func main() {
@@ -32,8 +37,8 @@ func main() {
 	// Channel for events
 	eventChan := make(chan uinput.MonitorEvent)
 
-	// Connect to docker
-	cli, err := docker.NewEnvClient()
+	// Connect to the container runtime
+	rt, err := newContainerRuntime()
 	if err != nil {
 		glog.Fatalf("%v", err)
 	}
@@ -44,14 +49,17 @@ func main() {
 	for i := 0; i < *numSockets; i++ {
 		socketName := fmt.Sprintf("uinputctl%d", i)
 		socketPath := path.Join(*socketDirectory, socketName)
-		go uinput.StartHostServer(cli, socketPath, eventChan)
+		go uinput.StartHostServer(rt, socketPath, eventChan)
 	}
 
 	// Start the udev monitor
-	if err := uinput.StartUdevMon(eventChan); err != nil {
+	if err := uinput.StartUdevMon(eventChan, *sysFSPrefix); err != nil {
 		glog.Fatalf("failed to start udev montor: %v", err)
 	}
 
+	// Watch for containers exiting to revoke their devices
+	uinput.StartContainerWatch(rt, eventChan)
+
 	// Create static files used to indicate to the receiving containers
 	// what mode the plugin is being used as, container or whole pod.
 	for _, fname := range []string{"uinput_type_container", "uinput_type_pod"} {
@@ -73,5 +81,32 @@ func main() {
 	glog.Infoln("initialized uinput device monitor, waiting for events from uinput-helper")
 
 	// Process all received events
-	uinput.HandleMonitorEvents(cli, eventChan, *sysFSPrefix, os.FileMode(devMode))
+	statePath := *stateFile
+	if statePath == "" {
+		statePath = path.Join(*socketDirectory, "monitor_state.json")
+	}
+	nodeOpts := uinput.DeviceNodeOptions{
+		Mode:    os.FileMode(devMode),
+		UID:     *deviceUID,
+		GID:     *deviceGID,
+		ProcDir: *procDir,
+	}
+	uinput.HandleMonitorEvents(rt, eventChan, *sysFSPrefix, nodeOpts, statePath)
+}
+
+func newContainerRuntime() (uinput.ContainerRuntime, error) {
+	switch *containerRuntime {
+	case "cri":
+		return uinput.NewCRIRuntime(*criEndpoint)
+	case "docker":
+		return uinput.NewDockerRuntime()
+	case "auto":
+		rt, err := uinput.NewCRIRuntime(*criEndpoint)
+		if err == nil {
+			return rt, nil
+		}
+		glog.Infof("using docker, CRI runtime is not available: %v", err)
+		return uinput.NewDockerRuntime()
+	}
+	return nil, fmt.Errorf("unsupported container runtime: %s", *containerRuntime)
 }
@@ -75,8 +75,13 @@ type UinputTriggerMessage struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	PodName    string                          `protobuf:"bytes,1,opt,name=podName,proto3" json:"podName,omitempty"`
-	PluginMode UinputTriggerMessage_PluginMode `protobuf:"varint,2,opt,name=pluginMode,proto3,enum=uinput.UinputTriggerMessage_PluginMode" json:"pluginMode,omitempty"`
+	PodName      string                          `protobuf:"bytes,1,opt,name=podName,proto3" json:"podName,omitempty"`
+	PluginMode   UinputTriggerMessage_PluginMode `protobuf:"varint,2,opt,name=pluginMode,proto3,enum=uinput.UinputTriggerMessage_PluginMode" json:"pluginMode,omitempty"`
+	PodNamespace string                          `protobuf:"bytes,4,opt,name=podNamespace,proto3" json:"podNamespace,omitempty"`
+	PodUID       string                          `protobuf:"bytes,5,opt,name=podUID,proto3" json:"podUID,omitempty"`
+	// Names of the containers of the pod given the devices in POD mode, all
+	// containers when empty.
+	ContainerNames []string `protobuf:"bytes,6,rep,name=containerNames,proto3" json:"containerNames,omitempty"`
 }
 
 func (x *UinputTriggerMessage) Reset() {
@@ -125,6 +130,27 @@ func (x *UinputTriggerMessage) GetPluginMode() UinputTriggerMessage_PluginMode {
 	return UinputTriggerMessage_POD
 }
 
+func (x *UinputTriggerMessage) GetPodNamespace() string {
+	if x != nil {
+		return x.PodNamespace
+	}
+	return ""
+}
+
+func (x *UinputTriggerMessage) GetPodUID() string {
+	if x != nil {
+		return x.PodUID
+	}
+	return ""
+}
+
+func (x *UinputTriggerMessage) GetContainerNames() []string {
+	if x != nil {
+		return x.ContainerNames
+	}
+	return nil
+}
+
 type UinputTriggerResponse struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -163,35 +189,368 @@ func (*UinputTriggerResponse) Descriptor() ([]byte, []int) {
 	return file_api_proto_rawDescGZIP(), []int{1}
 }
 
+type UinputDeviceNode struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Device name relative to /dev, ex: input/event5.
+	DevName string `protobuf:"bytes,1,opt,name=devName,proto3" json:"devName,omitempty"`
+	Major   uint32 `protobuf:"varint,2,opt,name=major,proto3" json:"major,omitempty"`
+	Minor   uint32 `protobuf:"varint,3,opt,name=minor,proto3" json:"minor,omitempty"`
+}
+
+func (x *UinputDeviceNode) Reset() {
+	*x = UinputDeviceNode{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UinputDeviceNode) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UinputDeviceNode) ProtoMessage() {}
+
+func (x *UinputDeviceNode) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UinputDeviceNode.ProtoReflect.Descriptor instead.
+func (*UinputDeviceNode) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *UinputDeviceNode) GetDevName() string {
+	if x != nil {
+		return x.DevName
+	}
+	return ""
+}
+
+func (x *UinputDeviceNode) GetMajor() uint32 {
+	if x != nil {
+		return x.Major
+	}
+	return 0
+}
+
+func (x *UinputDeviceNode) GetMinor() uint32 {
+	if x != nil {
+		return x.Minor
+	}
+	return 0
+}
+
+type UinputDevice struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// sysfs path, ex: /sys/devices/virtual/input/input12.
+	SysPath string `protobuf:"bytes,1,opt,name=sysPath,proto3" json:"sysPath,omitempty"`
+	// sysfs name, ex: input12.
+	Sysname string              `protobuf:"bytes,2,opt,name=sysname,proto3" json:"sysname,omitempty"`
+	Name    string              `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	Vendor  uint32              `protobuf:"varint,4,opt,name=vendor,proto3" json:"vendor,omitempty"`
+	Product uint32              `protobuf:"varint,5,opt,name=product,proto3" json:"product,omitempty"`
+	Nodes   []*UinputDeviceNode `protobuf:"bytes,6,rep,name=nodes,proto3" json:"nodes,omitempty"`
+}
+
+func (x *UinputDevice) Reset() {
+	*x = UinputDevice{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UinputDevice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UinputDevice) ProtoMessage() {}
+
+func (x *UinputDevice) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UinputDevice.ProtoReflect.Descriptor instead.
+func (*UinputDevice) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *UinputDevice) GetSysPath() string {
+	if x != nil {
+		return x.SysPath
+	}
+	return ""
+}
+
+func (x *UinputDevice) GetSysname() string {
+	if x != nil {
+		return x.Sysname
+	}
+	return ""
+}
+
+func (x *UinputDevice) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *UinputDevice) GetVendor() uint32 {
+	if x != nil {
+		return x.Vendor
+	}
+	return 0
+}
+
+func (x *UinputDevice) GetProduct() uint32 {
+	if x != nil {
+		return x.Product
+	}
+	return 0
+}
+
+func (x *UinputDevice) GetNodes() []*UinputDeviceNode {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+type UinputDeviceMessage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	PodName      string                          `protobuf:"bytes,1,opt,name=podName,proto3" json:"podName,omitempty"`
+	PluginMode   UinputTriggerMessage_PluginMode `protobuf:"varint,2,opt,name=pluginMode,proto3,enum=uinput.UinputTriggerMessage_PluginMode" json:"pluginMode,omitempty"`
+	Device       *UinputDevice                   `protobuf:"bytes,3,opt,name=device,proto3" json:"device,omitempty"`
+	PodNamespace string                          `protobuf:"bytes,4,opt,name=podNamespace,proto3" json:"podNamespace,omitempty"`
+	PodUID       string                          `protobuf:"bytes,5,opt,name=podUID,proto3" json:"podUID,omitempty"`
+	// Names of the containers of the pod given the device in POD mode, all
+	// containers when empty.
+	ContainerNames []string `protobuf:"bytes,6,rep,name=containerNames,proto3" json:"containerNames,omitempty"`
+}
+
+func (x *UinputDeviceMessage) Reset() {
+	*x = UinputDeviceMessage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UinputDeviceMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UinputDeviceMessage) ProtoMessage() {}
+
+func (x *UinputDeviceMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UinputDeviceMessage.ProtoReflect.Descriptor instead.
+func (*UinputDeviceMessage) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *UinputDeviceMessage) GetPodName() string {
+	if x != nil {
+		return x.PodName
+	}
+	return ""
+}
+
+func (x *UinputDeviceMessage) GetPluginMode() UinputTriggerMessage_PluginMode {
+	if x != nil {
+		return x.PluginMode
+	}
+	return UinputTriggerMessage_POD
+}
+
+func (x *UinputDeviceMessage) GetDevice() *UinputDevice {
+	if x != nil {
+		return x.Device
+	}
+	return nil
+}
+
+func (x *UinputDeviceMessage) GetPodNamespace() string {
+	if x != nil {
+		return x.PodNamespace
+	}
+	return ""
+}
+
+func (x *UinputDeviceMessage) GetPodUID() string {
+	if x != nil {
+		return x.PodUID
+	}
+	return ""
+}
+
+func (x *UinputDeviceMessage) GetContainerNames() []string {
+	if x != nil {
+		return x.ContainerNames
+	}
+	return nil
+}
+
+type UinputDeviceResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *UinputDeviceResponse) Reset() {
+	*x = UinputDeviceResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_api_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UinputDeviceResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UinputDeviceResponse) ProtoMessage() {}
+
+func (x *UinputDeviceResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UinputDeviceResponse.ProtoReflect.Descriptor instead.
+func (*UinputDeviceResponse) Descriptor() ([]byte, []int) {
+	return file_api_proto_rawDescGZIP(), []int{5}
+}
+
 var File_api_proto protoreflect.FileDescriptor
 
 var file_api_proto_rawDesc = []byte{
 	0x0a, 0x09, 0x61, 0x70, 0x69, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06, 0x75, 0x69, 0x6e,
-	0x70, 0x75, 0x74, 0x22, 0x9f, 0x01, 0x0a, 0x14, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72,
+	0x70, 0x75, 0x74, 0x22, 0x93, 0x02, 0x0a, 0x14, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72,
 	0x69, 0x67, 0x67, 0x65, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x18, 0x0a, 0x07,
 	0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x70,
 	0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x47, 0x0a, 0x0a, 0x70, 0x6c, 0x75, 0x67, 0x69, 0x6e,
 	0x4d, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x27, 0x2e, 0x75, 0x69, 0x6e,
 	0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65,
 	0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d,
-	0x6f, 0x64, 0x65, 0x52, 0x0a, 0x70, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x22,
-	0x24, 0x0a, 0x0a, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x12, 0x07, 0x0a,
-	0x03, 0x50, 0x4f, 0x44, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x43, 0x4f, 0x4e, 0x54, 0x41, 0x49,
-	0x4e, 0x45, 0x52, 0x10, 0x01, 0x22, 0x17, 0x0a, 0x15, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54,
-	0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x32, 0xb2,
-	0x01, 0x0a, 0x0b, 0x48, 0x6f, 0x73, 0x74, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x50,
-	0x0a, 0x11, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x4f,
-	0x70, 0x65, 0x6e, 0x12, 0x1c, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e,
-	0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67,
-	0x65, 0x1a, 0x1d, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75,
-	0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
-	0x12, 0x51, 0x0a, 0x12, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65,
-	0x72, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x12, 0x1c, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e,
-	0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x4d, 0x65, 0x73,
-	0x73, 0x61, 0x67, 0x65, 0x1a, 0x1d, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69,
-	0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f,
-	0x6e, 0x73, 0x65, 0x42, 0x0c, 0x5a, 0x0a, 0x70, 0x6b, 0x67, 0x2f, 0x75, 0x69, 0x6e, 0x70, 0x75,
-	0x74, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6f, 0x64, 0x65, 0x52, 0x0a, 0x70, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x12,
+	0x22, 0x0a, 0x0c, 0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x70,
+	0x61, 0x63, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x6f, 0x64, 0x55, 0x49, 0x44, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x6f, 0x64, 0x55, 0x49, 0x44, 0x12, 0x26, 0x0a, 0x0e, 0x63,
+	0x6f, 0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x06, 0x20,
+	0x03, 0x28, 0x09, 0x52, 0x0e, 0x63, 0x6f, 0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x4e, 0x61,
+	0x6d, 0x65, 0x73, 0x22, 0x24, 0x0a, 0x0a, 0x50, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x6f, 0x64,
+	0x65, 0x12, 0x07, 0x0a, 0x03, 0x50, 0x4f, 0x44, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x43, 0x4f,
+	0x4e, 0x54, 0x41, 0x49, 0x4e, 0x45, 0x52, 0x10, 0x01, 0x4a, 0x04, 0x08, 0x03, 0x10, 0x04, 0x52,
+	0x08, 0x73, 0x79, 0x73, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x22, 0x17, 0x0a, 0x15, 0x55, 0x69, 0x6e,
+	0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
+	0x73, 0x65, 0x22, 0x58, 0x0a, 0x10, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69,
+	0x63, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x64, 0x65, 0x76, 0x4e, 0x61, 0x6d,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x64, 0x65, 0x76, 0x4e, 0x61, 0x6d, 0x65,
+	0x12, 0x14, 0x0a, 0x05, 0x6d, 0x61, 0x6a, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x05, 0x6d, 0x61, 0x6a, 0x6f, 0x72, 0x12, 0x14, 0x0a, 0x05, 0x6d, 0x69, 0x6e, 0x6f, 0x72, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x6d, 0x69, 0x6e, 0x6f, 0x72, 0x22, 0xb8, 0x01, 0x0a,
+	0x0c, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x12, 0x18, 0x0a,
+	0x07, 0x73, 0x79, 0x73, 0x50, 0x61, 0x74, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
+	0x73, 0x79, 0x73, 0x50, 0x61, 0x74, 0x68, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x79, 0x73, 0x6e, 0x61,
+	0x6d, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x79, 0x73, 0x6e, 0x61, 0x6d,
+	0x65, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x76, 0x65, 0x6e, 0x64, 0x6f, 0x72, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x06, 0x76, 0x65, 0x6e, 0x64, 0x6f, 0x72, 0x12, 0x18, 0x0a,
+	0x07, 0x70, 0x72, 0x6f, 0x64, 0x75, 0x63, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07,
+	0x70, 0x72, 0x6f, 0x64, 0x75, 0x63, 0x74, 0x12, 0x2e, 0x0a, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73,
+	0x18, 0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x18, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e,
+	0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x4e, 0x6f, 0x64, 0x65,
+	0x52, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73, 0x22, 0x8a, 0x02, 0x0a, 0x13, 0x55, 0x69, 0x6e, 0x70,
+	0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12,
+	0x18, 0x0a, 0x07, 0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x47, 0x0a, 0x0a, 0x70, 0x6c, 0x75,
+	0x67, 0x69, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x27, 0x2e,
+	0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69,
+	0x67, 0x67, 0x65, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x50, 0x6c, 0x75, 0x67,
+	0x69, 0x6e, 0x4d, 0x6f, 0x64, 0x65, 0x52, 0x0a, 0x70, 0x6c, 0x75, 0x67, 0x69, 0x6e, 0x4d, 0x6f,
+	0x64, 0x65, 0x12, 0x2c, 0x0a, 0x06, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x14, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70,
+	0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x52, 0x06, 0x64, 0x65, 0x76, 0x69, 0x63, 0x65,
+	0x12, 0x22, 0x0a, 0x0c, 0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x70, 0x61, 0x63, 0x65,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x70, 0x6f, 0x64, 0x4e, 0x61, 0x6d, 0x65, 0x73,
+	0x70, 0x61, 0x63, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x6f, 0x64, 0x55, 0x49, 0x44, 0x18, 0x05,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x70, 0x6f, 0x64, 0x55, 0x49, 0x44, 0x12, 0x26, 0x0a, 0x0e,
+	0x63, 0x6f, 0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x4e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x06,
+	0x20, 0x03, 0x28, 0x09, 0x52, 0x0e, 0x63, 0x6f, 0x6e, 0x74, 0x61, 0x69, 0x6e, 0x65, 0x72, 0x4e,
+	0x61, 0x6d, 0x65, 0x73, 0x22, 0x16, 0x0a, 0x14, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65,
+	0x76, 0x69, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x32, 0xd8, 0x02, 0x0a,
+	0x0b, 0x48, 0x6f, 0x73, 0x74, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x50, 0x0a, 0x11,
+	0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x4f, 0x70, 0x65,
+	0x6e, 0x12, 0x1c, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75,
+	0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x1a,
+	0x1d, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54,
+	0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x51,
+	0x0a, 0x12, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x43,
+	0x6c, 0x6f, 0x73, 0x65, 0x12, 0x1c, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69,
+	0x6e, 0x70, 0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x4d, 0x65, 0x73, 0x73, 0x61,
+	0x67, 0x65, 0x1a, 0x1d, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70,
+	0x75, 0x74, 0x54, 0x72, 0x69, 0x67, 0x67, 0x65, 0x72, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x50, 0x0a, 0x13, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63,
+	0x65, 0x43, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x12, 0x1b, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75,
+	0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x4d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x1a, 0x1c, 0x2e, 0x75, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55,
+	0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x52, 0x0a, 0x15, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76,
+	0x69, 0x63, 0x65, 0x44, 0x65, 0x73, 0x74, 0x72, 0x6f, 0x79, 0x65, 0x64, 0x12, 0x1b, 0x2e, 0x75,
+	0x69, 0x6e, 0x70, 0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69,
+	0x63, 0x65, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x1a, 0x1c, 0x2e, 0x75, 0x69, 0x6e, 0x70,
+	0x75, 0x74, 0x2e, 0x55, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x44, 0x65, 0x76, 0x69, 0x63, 0x65, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x0c, 0x5a, 0x0a, 0x70, 0x6b, 0x67, 0x2f, 0x75,
+	0x69, 0x6e, 0x70, 0x75, 0x74, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -207,23 +566,34 @@ func file_api_proto_rawDescGZIP() []byte {
 }
 
 var file_api_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_api_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_api_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
 var file_api_proto_goTypes = []interface{}{
 	(UinputTriggerMessage_PluginMode)(0), // 0: uinput.UinputTriggerMessage.PluginMode
 	(*UinputTriggerMessage)(nil),         // 1: uinput.UinputTriggerMessage
 	(*UinputTriggerResponse)(nil),        // 2: uinput.UinputTriggerResponse
+	(*UinputDeviceNode)(nil),             // 3: uinput.UinputDeviceNode
+	(*UinputDevice)(nil),                 // 4: uinput.UinputDevice
+	(*UinputDeviceMessage)(nil),          // 5: uinput.UinputDeviceMessage
+	(*UinputDeviceResponse)(nil),         // 6: uinput.UinputDeviceResponse
 }
 var file_api_proto_depIdxs = []int32{
 	0, // 0: uinput.UinputTriggerMessage.pluginMode:type_name -> uinput.UinputTriggerMessage.PluginMode
-	1, // 1: uinput.HostService.UinputTriggerOpen:input_type -> uinput.UinputTriggerMessage
-	1, // 2: uinput.HostService.UinputTriggerClose:input_type -> uinput.UinputTriggerMessage
-	2, // 3: uinput.HostService.UinputTriggerOpen:output_type -> uinput.UinputTriggerResponse
-	2, // 4: uinput.HostService.UinputTriggerClose:output_type -> uinput.UinputTriggerResponse
-	3, // [3:5] is the sub-list for method output_type
-	1, // [1:3] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	3, // 1: uinput.UinputDevice.nodes:type_name -> uinput.UinputDeviceNode
+	0, // 2: uinput.UinputDeviceMessage.pluginMode:type_name -> uinput.UinputTriggerMessage.PluginMode
+	4, // 3: uinput.UinputDeviceMessage.device:type_name -> uinput.UinputDevice
+	1, // 4: uinput.HostService.UinputTriggerOpen:input_type -> uinput.UinputTriggerMessage
+	1, // 5: uinput.HostService.UinputTriggerClose:input_type -> uinput.UinputTriggerMessage
+	5, // 6: uinput.HostService.UinputDeviceCreated:input_type -> uinput.UinputDeviceMessage
+	5, // 7: uinput.HostService.UinputDeviceDestroyed:input_type -> uinput.UinputDeviceMessage
+	2, // 8: uinput.HostService.UinputTriggerOpen:output_type -> uinput.UinputTriggerResponse
+	2, // 9: uinput.HostService.UinputTriggerClose:output_type -> uinput.UinputTriggerResponse
+	6, // 10: uinput.HostService.UinputDeviceCreated:output_type -> uinput.UinputDeviceResponse
+	6, // 11: uinput.HostService.UinputDeviceDestroyed:output_type -> uinput.UinputDeviceResponse
+	8, // [8:12] is the sub-list for method output_type
+	4, // [4:8] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_api_proto_init() }
@@ -256,6 +626,54 @@ func file_api_proto_init() {
 				return nil
 			}
 		}
+		file_api_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UinputDeviceNode); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UinputDevice); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UinputDeviceMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_api_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UinputDeviceResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -263,7 +681,7 @@ func file_api_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_api_proto_rawDesc,
 			NumEnums:      1,
-			NumMessages:   2,
+			NumMessages:   6,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -292,6 +710,8 @@ const _ = grpc.SupportPackageIsVersion6
 type HostServiceClient interface {
 	UinputTriggerOpen(ctx context.Context, in *UinputTriggerMessage, opts ...grpc.CallOption) (*UinputTriggerResponse, error)
 	UinputTriggerClose(ctx context.Context, in *UinputTriggerMessage, opts ...grpc.CallOption) (*UinputTriggerResponse, error)
+	UinputDeviceCreated(ctx context.Context, in *UinputDeviceMessage, opts ...grpc.CallOption) (*UinputDeviceResponse, error)
+	UinputDeviceDestroyed(ctx context.Context, in *UinputDeviceMessage, opts ...grpc.CallOption) (*UinputDeviceResponse, error)
 }
 
 type hostServiceClient struct {
@@ -320,10 +740,30 @@ func (c *hostServiceClient) UinputTriggerClose(ctx context.Context, in *UinputTr
 	return out, nil
 }
 
+func (c *hostServiceClient) UinputDeviceCreated(ctx context.Context, in *UinputDeviceMessage, opts ...grpc.CallOption) (*UinputDeviceResponse, error) {
+	out := new(UinputDeviceResponse)
+	err := c.cc.Invoke(ctx, "/uinput.HostService/UinputDeviceCreated", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *hostServiceClient) UinputDeviceDestroyed(ctx context.Context, in *UinputDeviceMessage, opts ...grpc.CallOption) (*UinputDeviceResponse, error) {
+	out := new(UinputDeviceResponse)
+	err := c.cc.Invoke(ctx, "/uinput.HostService/UinputDeviceDestroyed", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // HostServiceServer is the server API for HostService service.
 type HostServiceServer interface {
 	UinputTriggerOpen(context.Context, *UinputTriggerMessage) (*UinputTriggerResponse, error)
 	UinputTriggerClose(context.Context, *UinputTriggerMessage) (*UinputTriggerResponse, error)
+	UinputDeviceCreated(context.Context, *UinputDeviceMessage) (*UinputDeviceResponse, error)
+	UinputDeviceDestroyed(context.Context, *UinputDeviceMessage) (*UinputDeviceResponse, error)
 }
 
 // UnimplementedHostServiceServer can be embedded to have forward compatible implementations.
@@ -336,6 +776,12 @@ func (*UnimplementedHostServiceServer) UinputTriggerOpen(context.Context, *Uinpu
 func (*UnimplementedHostServiceServer) UinputTriggerClose(context.Context, *UinputTriggerMessage) (*UinputTriggerResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UinputTriggerClose not implemented")
 }
+func (*UnimplementedHostServiceServer) UinputDeviceCreated(context.Context, *UinputDeviceMessage) (*UinputDeviceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UinputDeviceCreated not implemented")
+}
+func (*UnimplementedHostServiceServer) UinputDeviceDestroyed(context.Context, *UinputDeviceMessage) (*UinputDeviceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UinputDeviceDestroyed not implemented")
+}
 
 func RegisterHostServiceServer(s *grpc.Server, srv HostServiceServer) {
 	s.RegisterService(&_HostService_serviceDesc, srv)
@@ -377,6 +823,42 @@ func _HostService_UinputTriggerClose_Handler(srv interface{}, ctx context.Contex
 	return interceptor(ctx, in, info, handler)
 }
 
+func _HostService_UinputDeviceCreated_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UinputDeviceMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HostServiceServer).UinputDeviceCreated(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/uinput.HostService/UinputDeviceCreated",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HostServiceServer).UinputDeviceCreated(ctx, req.(*UinputDeviceMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HostService_UinputDeviceDestroyed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UinputDeviceMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HostServiceServer).UinputDeviceDestroyed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/uinput.HostService/UinputDeviceDestroyed",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HostServiceServer).UinputDeviceDestroyed(ctx, req.(*UinputDeviceMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _HostService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "uinput.HostService",
 	HandlerType: (*HostServiceServer)(nil),
@@ -389,6 +871,14 @@ var _HostService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "UinputTriggerClose",
 			Handler:    _HostService_UinputTriggerClose_Handler,
 		},
+		{
+			MethodName: "UinputDeviceCreated",
+			Handler:    _HostService_UinputDeviceCreated_Handler,
+		},
+		{
+			MethodName: "UinputDeviceDestroyed",
+			Handler:    _HostService_UinputDeviceDestroyed_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "api.proto",
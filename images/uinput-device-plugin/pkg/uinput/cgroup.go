@@ -0,0 +1,55 @@
+package uinput
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// deviceCgroup controls the access of the containers to device nodes through
+// their device cgroup.
+type deviceCgroup interface {
+	Allow(containerID string, devMajor, devMinor int) error
+	Deny(containerID string, devMajor, devMinor int) error
+}
+
+// newDeviceCgroup returns the device cgroup backend of the cgroup version of
+// the node.
+func newDeviceCgroup(paths *cgroupResolver) deviceCgroup {
+	if paths.v2 {
+		glog.Infof("using cgroup v2 device programs")
+		return newCgroupV2Devices(paths)
+	}
+	glog.Infof("using cgroup v1 devices controller")
+	return &cgroupV1Devices{paths: paths}
+}
+
+// cgroupV1Devices writes the device rules to the devices.allow and
+// devices.deny files of the cgroup v1 devices controller.
+type cgroupV1Devices struct {
+	paths *cgroupResolver
+}
+
+func (cg *cgroupV1Devices) Allow(containerID string, devMajor, devMinor int) error {
+	return cg.write(containerID, "devices.allow", devMajor, devMinor)
+}
+
+func (cg *cgroupV1Devices) Deny(containerID string, devMajor, devMinor int) error {
+	return cg.write(containerID, "devices.deny", devMajor, devMinor)
+}
+
+func (cg *cgroupV1Devices) write(containerID, name string, devMajor, devMinor int) error {
+	dir, err := cg.paths.containerDir(containerID)
+	if err != nil {
+		return err
+	}
+	// Write the device node to the cgroup sys file.
+	cgroupFile := filepath.Join(dir, name)
+	cgroupPerms := fmt.Sprintf("c %d:%d rwm", devMajor, devMinor)
+	if err := ioutil.WriteFile(cgroupFile, []byte(cgroupPerms), 0644); err != nil {
+		return fmt.Errorf("failed to write cgroup permissions to %s: %v", cgroupFile, err)
+	}
+	return nil
+}
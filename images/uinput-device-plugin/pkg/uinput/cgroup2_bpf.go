@@ -0,0 +1,300 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package uinput
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// BPF_F_ALLOW_MULTI, the attach flag used by runc and crun.
+	bpfFAllowMulti = 2
+
+	// BPF_F_REPLACE, replaces the program of replace_bpf_fd in a
+	// BPF_F_ALLOW_MULTI cgroup, since Linux 5.6.
+	bpfFReplace = 4
+
+	// Most programs queried on a cgroup.
+	bpfQueryMaxProgs = 64
+)
+
+// cgroupV2Devices allows devices by replacing the BPF_CGROUP_DEVICE
+// programs attached to the cgroup of the container, usually the one of the
+// OCI runtime, with a copy that first allows the devices. Denying a device
+// removes its rule from the copy. Needs CAP_SYS_ADMIN to read the programs.
+// The pointers in the bpf attributes are unsafe.Pointer fields to keep the
+// buffers alive and in place, which matches the u64 fields on 64-bit only.
+type cgroupV2Devices struct {
+	paths *cgroupResolver
+
+	// mu serializes the updates of the programs.
+	mu sync.Mutex
+}
+
+func newCgroupV2Devices(paths *cgroupResolver) deviceCgroup {
+	return &cgroupV2Devices{paths: paths}
+}
+
+func (cg *cgroupV2Devices) Allow(containerID string, devMajor, devMinor int) error {
+	rule := deviceRule{Major: uint32(devMajor), Minor: uint32(devMinor)}
+	return cg.update(containerID, func(rules []deviceRule) ([]deviceRule, bool) {
+		return addDeviceRule(rules, rule)
+	})
+}
+
+func (cg *cgroupV2Devices) Deny(containerID string, devMajor, devMinor int) error {
+	rule := deviceRule{Major: uint32(devMajor), Minor: uint32(devMinor)}
+	return cg.update(containerID, func(rules []deviceRule) ([]deviceRule, bool) {
+		return removeDeviceRule(rules, rule)
+	})
+}
+
+// update changes the rules of each device program attached to the cgroup of
+// a container. All attached programs must allow a device, so each one is
+// replaced. The programs are swapped atomically, so the access is always that
+// of the old or of the new program.
+func (cg *cgroupV2Devices) update(containerID string, change func([]deviceRule) ([]deviceRule, bool)) error {
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+
+	dir, err := cg.paths.containerDir(containerID)
+	if err != nil {
+		return err
+	}
+	cgroupFd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup %s: %v", dir, err)
+	}
+	defer unix.Close(cgroupFd)
+
+	progIDs, attachFlags, err := bpfProgQuery(cgroupFd)
+	if err != nil {
+		return fmt.Errorf("failed to query device programs of cgroup %s: %v", dir, err)
+	}
+	// Without a program of its own, the container is limited by the
+	// programs of the parent cgroups only.
+	for _, progID := range progIDs {
+		if err := cg.replace(cgroupFd, attachFlags, progID, change); err != nil {
+			return fmt.Errorf("failed to update device program %d of cgroup %s: %v", progID, dir, err)
+		}
+	}
+	return nil
+}
+
+// replace swaps a program for a copy with the changed rules, attached with
+// the flags of the cgroup. Without BPF_F_ALLOW_MULTI the cgroup has a single
+// program, which attaching replaces. Otherwise the program to replace is
+// passed with BPF_F_REPLACE.
+func (cg *cgroupV2Devices) replace(cgroupFd int, attachFlags, progID uint32, change func([]deviceRule) ([]deviceRule, bool)) error {
+	oldFd, err := bpfProgGetFdByID(progID)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(oldFd)
+
+	insns, err := bpfProgInsns(oldFd)
+	if err != nil {
+		return err
+	}
+	rules, base, err := parseDeviceProgram(insns)
+	if err != nil {
+		return err
+	}
+	rules, changed := change(rules)
+	if !changed {
+		return nil
+	}
+
+	newFd, err := bpfProgLoadDevice(buildDeviceProgram(rules, base))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newFd)
+
+	if attachFlags&bpfFAllowMulti == 0 {
+		if err := bpfProgAttachCgroup(cgroupFd, newFd, attachFlags, -1); err != nil {
+			return fmt.Errorf("failed to attach program: %v", err)
+		}
+		return nil
+	}
+	err = bpfProgAttachCgroup(cgroupFd, newFd, attachFlags|bpfFReplace, oldFd)
+	if errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("failed to replace program, the kernel may not support BPF_F_REPLACE, added in Linux 5.6: %v", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replace program: %v", err)
+	}
+	return nil
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// bpfProgQuery returns the ids of the device programs attached to a cgroup,
+// and the flags they were attached with.
+func bpfProgQuery(cgroupFd int) ([]uint32, uint32, error) {
+	ids := make([]uint32, bpfQueryMaxProgs)
+	attr := struct {
+		TargetFd    uint32
+		AttachType  uint32
+		QueryFlags  uint32
+		AttachFlags uint32
+		ProgIDs     unsafe.Pointer
+		ProgCnt     uint32
+		_           uint32
+	}{
+		TargetFd:   uint32(cgroupFd),
+		AttachType: unix.BPF_CGROUP_DEVICE,
+		ProgIDs:    unsafe.Pointer(&ids[0]),
+		ProgCnt:    uint32(len(ids)),
+	}
+	if _, err := bpf(unix.BPF_PROG_QUERY, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return nil, 0, err
+	}
+	return ids[:attr.ProgCnt], attr.AttachFlags, nil
+}
+
+func bpfProgGetFdByID(id uint32) (int, error) {
+	attr := struct {
+		ProgID    uint32
+		NextID    uint32
+		OpenFlags uint32
+	}{
+		ProgID: id,
+	}
+	fd, err := bpf(unix.BPF_PROG_GET_FD_BY_ID, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to get program %d: %v", id, err)
+	}
+	return int(fd), nil
+}
+
+// bpfProgInsns returns the translated instructions of a program.
+func bpfProgInsns(progFd int) ([]bpfInsn, error) {
+	// Leading fields of struct bpf_prog_info.
+	type progInfo struct {
+		Type            uint32
+		ID              uint32
+		Tag             [8]byte
+		JitedProgLen    uint32
+		XlatedProgLen   uint32
+		JitedProgInsns  uint64
+		XlatedProgInsns unsafe.Pointer
+	}
+	type infoAttr struct {
+		BpfFd   uint32
+		InfoLen uint32
+		Info    unsafe.Pointer
+	}
+
+	var info progInfo
+	attr := infoAttr{
+		BpfFd:   uint32(progFd),
+		InfoLen: uint32(unsafe.Sizeof(info)),
+		Info:    unsafe.Pointer(&info),
+	}
+	if _, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return nil, fmt.Errorf("failed to get program info: %v", err)
+	}
+	if info.XlatedProgLen == 0 {
+		return nil, fmt.Errorf("program instructions are not readable")
+	}
+
+	dat := make([]byte, info.XlatedProgLen)
+	info = progInfo{
+		XlatedProgLen:   uint32(len(dat)),
+		XlatedProgInsns: unsafe.Pointer(&dat[0]),
+	}
+	attr = infoAttr{
+		BpfFd:   uint32(progFd),
+		InfoLen: uint32(unsafe.Sizeof(info)),
+		Info:    unsafe.Pointer(&info),
+	}
+	if _, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return nil, fmt.Errorf("failed to get program instructions: %v", err)
+	}
+	return unmarshalBPFInsns(dat)
+}
+
+// bpfProgLoadDevice loads a BPF_PROG_TYPE_CGROUP_DEVICE program. The
+// verifier log is only requested to report a failure, as the log of a large
+// program can overflow the buffer and fail the load with ENOSPC.
+func bpfProgLoadDevice(insns []bpfInsn) (int, error) {
+	fd, err := bpfProgLoad(unix.BPF_PROG_TYPE_CGROUP_DEVICE, insns, nil)
+	if err == nil {
+		return fd, nil
+	}
+	logBuf := make([]byte, 64*1024)
+	if fd, logErr := bpfProgLoad(unix.BPF_PROG_TYPE_CGROUP_DEVICE, insns, logBuf); logErr == nil {
+		// The first load failed transiently, ex: on a memory allocation.
+		return fd, nil
+	}
+	return -1, fmt.Errorf("failed to load device program: %v: %s", err, unix.ByteSliceToString(logBuf))
+}
+
+// bpfProgLoad loads a program, with the verifier log written to logBuf if not
+// nil.
+func bpfProgLoad(progType uint32, insns []bpfInsn, logBuf []byte) (int, error) {
+	code := marshalBPFInsns(insns)
+	license := []byte("Apache\x00")
+	attr := struct {
+		ProgType    uint32
+		InsnCnt     uint32
+		Insns       unsafe.Pointer
+		License     unsafe.Pointer
+		LogLevel    uint32
+		LogSize     uint32
+		LogBuf      unsafe.Pointer
+		KernVersion uint32
+		ProgFlags   uint32
+	}{
+		ProgType: progType,
+		InsnCnt:  uint32(len(insns)),
+		Insns:    unsafe.Pointer(&code[0]),
+		License:  unsafe.Pointer(&license[0]),
+	}
+	if len(logBuf) > 0 {
+		attr.LogLevel = 1
+		attr.LogSize = uint32(len(logBuf))
+		attr.LogBuf = unsafe.Pointer(&logBuf[0])
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// bpfProgAttachCgroup attaches a device program to a cgroup, replacing the
+// program of replaceFd if not -1.
+func bpfProgAttachCgroup(cgroupFd, progFd int, flags uint32, replaceFd int) error {
+	attr := struct {
+		TargetFd     uint32
+		AttachBpfFd  uint32
+		AttachType   uint32
+		AttachFlags  uint32
+		ReplaceBpfFd uint32
+	}{
+		TargetFd:    uint32(cgroupFd),
+		AttachBpfFd: uint32(progFd),
+		AttachType:  unix.BPF_CGROUP_DEVICE,
+		AttachFlags: flags,
+	}
+	if replaceFd >= 0 {
+		attr.ReplaceBpfFd = uint32(replaceFd)
+	}
+	_, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
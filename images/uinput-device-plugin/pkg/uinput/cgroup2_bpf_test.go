@@ -0,0 +1,151 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package uinput
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testCgroup2 creates a cgroup in the cgroup2 hierarchy, and skips the test
+// without one or without the privileges to attach device programs.
+func testCgroup2(t *testing.T) int {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		t.Skipf("failed to read mounts: %v", err)
+	}
+	defer f.Close()
+	mountPoint := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The filesystem type follows the separator of the optional fields.
+		fields := strings.Split(scanner.Text(), " - ")
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "cgroup2 ") {
+			mountPoint = strings.Fields(fields[0])[4]
+			break
+		}
+	}
+	if len(mountPoint) == 0 {
+		t.Skip("no cgroup2 hierarchy")
+	}
+
+	dir, err := os.MkdirTemp(mountPoint, "uinput-test-")
+	if err != nil {
+		t.Skipf("failed to create cgroup: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(dir) })
+	cgroupFd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(cgroupFd) })
+	return cgroupFd
+}
+
+func loadTestDeviceProgram(t *testing.T, insns []bpfInsn) int {
+	fd, err := bpfProgLoadDevice(insns)
+	if errors.Is(err, unix.EPERM) || (err != nil && strings.Contains(err.Error(), unix.EPERM.Error())) {
+		t.Skipf("no privileges to load programs: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("bpfProgLoadDevice() failed: %v", err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	return fd
+}
+
+func TestBPFProgLoadDevice(t *testing.T) {
+	loadTestDeviceProgram(t, runcDeviceProgram)
+	loadTestDeviceProgram(t, buildDeviceProgram([]deviceRule{{13, 85}, {13, 0}}, runcDeviceProgram))
+
+	// The verifier log is returned on failure, r0 is not set.
+	_, err := bpfProgLoadDevice([]bpfInsn{{Code: bpfExit}})
+	if err == nil || !strings.Contains(err.Error(), "R0") {
+		t.Errorf("bpfProgLoadDevice() of an invalid program returned %v, want the verifier log", err)
+	}
+}
+
+func TestCgroupV2DevicesReplace(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		attachFlags uint32
+	}{
+		{"allow multi", bpfFAllowMulti},
+		{"single", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cgroupFd := testCgroup2(t)
+			progFd := loadTestDeviceProgram(t, runcDeviceProgram)
+			if err := bpfProgAttachCgroup(cgroupFd, progFd, tc.attachFlags, -1); err != nil {
+				t.Fatalf("failed to attach program: %v", err)
+			}
+
+			cg := &cgroupV2Devices{}
+			event21 := deviceRule{13, 85}
+			js0 := deviceRule{13, 0}
+			for _, step := range []struct {
+				add   bool
+				rule  deviceRule
+				rules []deviceRule
+			}{
+				{true, event21, []deviceRule{event21}},
+				{true, js0, []deviceRule{event21, js0}},
+				{true, js0, []deviceRule{event21, js0}},
+				{false, event21, []deviceRule{js0}},
+				{false, js0, nil},
+			} {
+				progIDs, attachFlags, err := bpfProgQuery(cgroupFd)
+				if err != nil {
+					t.Fatalf("bpfProgQuery() failed: %v", err)
+				}
+				if len(progIDs) != 1 || attachFlags != tc.attachFlags {
+					t.Fatalf("bpfProgQuery() = %v, %d, want 1 program attached with %d", progIDs, attachFlags, tc.attachFlags)
+				}
+				err = cg.replace(cgroupFd, attachFlags, progIDs[0], func(rules []deviceRule) ([]deviceRule, bool) {
+					if step.add {
+						return addDeviceRule(rules, step.rule)
+					}
+					return removeDeviceRule(rules, step.rule)
+				})
+				if err != nil {
+					t.Fatalf("replace() failed: %v", err)
+				}
+
+				progIDs, _, err = bpfProgQuery(cgroupFd)
+				if err != nil {
+					t.Fatalf("bpfProgQuery() failed: %v", err)
+				}
+				if len(progIDs) != 1 {
+					t.Fatalf("%d programs attached after replace(), want 1", len(progIDs))
+				}
+				fd, err := bpfProgGetFdByID(progIDs[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				insns, err := bpfProgInsns(fd)
+				unix.Close(fd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rules, base, err := parseDeviceProgram(insns)
+				if err != nil {
+					t.Fatalf("parseDeviceProgram() of the attached program failed: %v", err)
+				}
+				if !reflect.DeepEqual(rules, step.rules) && (len(rules) > 0 || len(step.rules) > 0) {
+					t.Errorf("attached program has rules %v, want %v", rules, step.rules)
+				}
+				if len(base) != len(runcDeviceProgram) {
+					t.Errorf("attached program has a base of %d instructions, want %d", len(base), len(runcDeviceProgram))
+				}
+			}
+		})
+	}
+}
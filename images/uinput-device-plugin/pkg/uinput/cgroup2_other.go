@@ -0,0 +1,21 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package uinput
+
+import "fmt"
+
+// cgroupV2Devices is only supported on 64-bit Linux.
+type cgroupV2Devices struct{}
+
+func newCgroupV2Devices(paths *cgroupResolver) deviceCgroup {
+	return &cgroupV2Devices{}
+}
+
+func (cg *cgroupV2Devices) Allow(containerID string, devMajor, devMinor int) error {
+	return fmt.Errorf("cgroup v2 device programs are only supported on 64-bit linux")
+}
+
+func (cg *cgroupV2Devices) Deny(containerID string, devMajor, devMinor int) error {
+	return fmt.Errorf("cgroup v2 device programs are only supported on 64-bit linux")
+}
@@ -0,0 +1,195 @@
+package uinput
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// containerCgroupPatterns are the known layouts of the container cgroups,
+// relative to the root of a hierarchy, with %s the container ID. The kubelet
+// puts Guaranteed pods directly under kubepods and the Burstable and
+// BestEffort pods under a cgroup of their QoS class. The systemd cgroup
+// driver names the container scope after the runtime, ex: docker-<id>.scope,
+// cri-containerd-<id>.scope or crio-<id>.scope.
+var containerCgroupPatterns = []string{
+	// cgroupfs driver.
+	"kubepods/pod*/%s",
+	"kubepods/*/pod*/%s",
+	// systemd driver.
+	"kubepods.slice/kubepods-pod*.slice/*-%s.scope",
+	"kubepods.slice/kubepods-*.slice/kubepods-*-pod*.slice/*-%s.scope",
+	// Plain docker containers.
+	"docker/%s",
+	"system.slice/docker-%s.scope",
+}
+
+var containerIDPattern = regexp.MustCompile(`^[0-9A-Za-z_.-]+$`)
+
+// cgroupResolver finds the device cgroup of the containers.
+type cgroupResolver struct {
+	// root is the cgroup mount point, ex: /sys/fs/cgroup.
+	root string
+	// v2 is set for the unified hierarchy, the devices controller of cgroup
+	// v1 is used otherwise.
+	v2      bool
+	procDir string
+	rt      ContainerRuntime
+}
+
+// newCgroupResolver detects the cgroup version of the node: the devices
+// controller of cgroup v1 when it is mounted, the unified hierarchy of cgroup
+// v2 otherwise.
+func newCgroupResolver(sysFSPrefix, procDir string, rt ContainerRuntime) *cgroupResolver {
+	r := &cgroupResolver{
+		root:    fmt.Sprintf("%s/sys/fs/cgroup", sysFSPrefix),
+		procDir: procDir,
+		rt:      rt,
+	}
+	if _, err := os.Stat(filepath.Join(r.root, "devices")); err == nil {
+		return r
+	}
+	if _, err := os.Stat(filepath.Join(r.root, "cgroup.controllers")); err == nil {
+		r.v2 = true
+		return r
+	}
+	glog.Warningf("found no devices cgroup at %s, assuming cgroup v1", r.root)
+	return r
+}
+
+// hierarchy returns the root of the hierarchy holding the device cgroups.
+func (r *cgroupResolver) hierarchy() string {
+	if r.v2 {
+		return r.root
+	}
+	return filepath.Join(r.root, "devices")
+}
+
+// containerDir returns the device cgroup directory of a container, from the
+// cgroup of its init process when the runtime knows it, from the known
+// layouts otherwise.
+func (r *cgroupResolver) containerDir(containerID string) (string, error) {
+	if !containerIDPattern.MatchString(containerID) {
+		return "", fmt.Errorf("invalid container ID '%s'", containerID)
+	}
+	if r.rt != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		pid, err := r.rt.ContainerPid(ctx, containerID)
+		if err == nil {
+			dir, err := r.procCgroupDir(pid)
+			if err == nil {
+				return dir, nil
+			}
+			glog.V(1).Infof("falling back to the known cgroup layouts for container %s: %v", containerID, err)
+		}
+	}
+	return r.findContainerDir(containerID)
+}
+
+// containerPids returns the pids of the processes of a container, from the
+// cgroup.procs file of its device cgroup. The pids are in the pid namespace
+// of the reader, the host pid namespace for the monitor.
+func (r *cgroupResolver) containerPids(containerID string) ([]int, error) {
+	dir, err := r.containerDir(containerID)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, "cgroup.procs")
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	var pids []int
+	for _, field := range strings.Fields(string(dat)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", name, err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// procCgroupDir returns the device cgroup directory of a process from
+// /proc/<pid>/cgroup.
+func (r *cgroupResolver) procCgroupDir(pid int) (string, error) {
+	name := filepath.Join(r.procDir, fmt.Sprint(pid), "cgroup")
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	defer f.Close()
+	cgroupPath, err := parseProcCgroup(f, r.v2)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	// The path is relative to the cgroup namespace of the reader, a path
+	// outside of it cannot be found in the mounted hierarchy.
+	if strings.Contains(cgroupPath, "..") {
+		return "", fmt.Errorf("cgroup %s is outside of the cgroup namespace", cgroupPath)
+	}
+	dir := filepath.Join(r.hierarchy(), cgroupPath)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("failed to find cgroup of process %d: %v", pid, err)
+	}
+	return dir, nil
+}
+
+// parseProcCgroup returns the path of the device cgroup in the content of
+// /proc/<pid>/cgroup, lines of hierarchy-ID:controllers:path.
+func parseProcCgroup(r io.Reader, v2 bool) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if v2 {
+			if parts[0] == "0" && parts[1] == "" {
+				return parts[2], nil
+			}
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "devices" {
+				return parts[2], nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if v2 {
+		return "", fmt.Errorf("no cgroup v2 entry")
+	}
+	return "", fmt.Errorf("no devices cgroup entry")
+}
+
+// findContainerDir returns the device cgroup directory of a container from
+// the known layouts.
+func (r *cgroupResolver) findContainerDir(containerID string) (string, error) {
+	var dirs []string
+	for _, pattern := range containerCgroupPatterns {
+		cgroupPathPattern := filepath.Join(r.hierarchy(), fmt.Sprintf(pattern, containerID))
+		matches, err := filepath.Glob(cgroupPathPattern)
+		if err != nil {
+			return "", fmt.Errorf("failed to glob path to find cgroup path in pattern '%s': %v", cgroupPathPattern, err)
+		}
+		dirs = append(dirs, matches...)
+	}
+	if len(dirs) != 1 {
+		return "", fmt.Errorf("failed to find single cgroup of container %s in %s, expected 1, found %d", containerID, r.hierarchy(), len(dirs))
+	}
+	return dirs[0], nil
+}
@@ -0,0 +1,256 @@
+package uinput
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testContainerID = "3f4e1b6c2a9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f"
+	testPodUID      = "2b1c8a6e-6f3b-4bd0-9a0c-2f4a9c6a1e11"
+	testPodSlice    = "2b1c8a6e_6f3b_4bd0_9a0c_2f4a9c6a1e11"
+	testPid         = 4242
+)
+
+// pidRuntime is a ContainerRuntime that only knows the pid of the test
+// container.
+type pidRuntime struct {
+	ContainerRuntime
+	pid int
+}
+
+func (rt *pidRuntime) ContainerPid(ctx context.Context, containerID string) (int, error) {
+	if containerID != testContainerID || rt.pid == 0 {
+		return 0, fmt.Errorf("container %s not found", containerID)
+	}
+	return rt.pid, nil
+}
+
+// newTestCgroupTree creates the cgroup hierarchy of a node under a temporary
+// sysfs prefix, with the cgroups at the paths given relative to the
+// hierarchy, and the /proc/<pid>/cgroup file of the container if not empty.
+func newTestCgroupTree(t *testing.T, v2 bool, cgroupPaths []string, procCgroup string) (string, string) {
+	sysFSPrefix := t.TempDir()
+	procDir := t.TempDir()
+	root := filepath.Join(sysFSPrefix, "sys/fs/cgroup")
+	hierarchy := filepath.Join(root, "devices")
+	if v2 {
+		hierarchy = root
+	}
+	if err := os.MkdirAll(hierarchy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if v2 {
+		if err := ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cgroupPath := range cgroupPaths {
+		if err := os.MkdirAll(filepath.Join(hierarchy, cgroupPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(procCgroup) > 0 {
+		dir := filepath.Join(procDir, fmt.Sprint(testPid))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cgroup"), []byte(procCgroup), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sysFSPrefix, procDir
+}
+
+// procCgroupContent returns a /proc/<pid>/cgroup of a process in the cgroup
+// path, with the other controllers of a cgroup v1 node in the same cgroup.
+func procCgroupContent(v2 bool, cgroupPath string) string {
+	if v2 {
+		return "0::" + cgroupPath + "\n"
+	}
+	return strings.Join([]string{
+		"12:pids:" + cgroupPath,
+		"11:cpu,cpuacct:" + cgroupPath,
+		"10:devices:" + cgroupPath,
+		"9:memory:" + cgroupPath,
+		"1:name=systemd:" + cgroupPath,
+		"0::/",
+	}, "\n") + "\n"
+}
+
+func TestCgroupResolverLayouts(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cgroupPath string
+	}{
+		{"cgroupfs guaranteed", "kubepods/pod" + testPodUID + "/" + testContainerID},
+		{"cgroupfs burstable", "kubepods/burstable/pod" + testPodUID + "/" + testContainerID},
+		{"cgroupfs besteffort", "kubepods/besteffort/pod" + testPodUID + "/" + testContainerID},
+		{"systemd guaranteed", "kubepods.slice/kubepods-pod" + testPodSlice + ".slice/cri-containerd-" + testContainerID + ".scope"},
+		{"systemd burstable", "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + testPodSlice + ".slice/docker-" + testContainerID + ".scope"},
+		{"systemd besteffort", "kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod" + testPodSlice + ".slice/crio-" + testContainerID + ".scope"},
+		{"docker cgroupfs", "docker/" + testContainerID},
+		{"docker systemd", "system.slice/docker-" + testContainerID + ".scope"},
+	} {
+		for _, v2 := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s v2 %v", tc.name, v2), func(t *testing.T) {
+				// Other pods and containers of the same pod are not matched.
+				other := strings.Replace(tc.cgroupPath, testContainerID, "0a1b2c3d4e5f", 1)
+				sysFSPrefix, procDir := newTestCgroupTree(t, v2, []string{tc.cgroupPath, other}, procCgroupContent(v2, "/"+tc.cgroupPath))
+				want := filepath.Join(sysFSPrefix, "sys/fs/cgroup", tc.cgroupPath)
+				if !v2 {
+					want = filepath.Join(sysFSPrefix, "sys/fs/cgroup/devices", tc.cgroupPath)
+				}
+
+				// From the known layouts without a runtime, and from the
+				// cgroup of the container process with one.
+				for _, rt := range []ContainerRuntime{nil, &pidRuntime{pid: testPid}} {
+					r := newCgroupResolver(sysFSPrefix, procDir, rt)
+					if r.v2 != v2 {
+						t.Fatalf("newCgroupResolver() detected v2 %v, want %v", r.v2, v2)
+					}
+					dir, err := r.containerDir(testContainerID)
+					if err != nil {
+						t.Fatalf("containerDir() with runtime %v failed: %v", rt != nil, err)
+					}
+					if dir != want {
+						t.Errorf("containerDir() with runtime %v = %s, want %s", rt != nil, dir, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCgroupResolverProcFallback(t *testing.T) {
+	layoutPath := "kubepods/burstable/pod" + testPodUID + "/" + testContainerID
+	for _, tc := range []struct {
+		name       string
+		v2         bool
+		procCgroup string
+		// procDir is the cgroup found from the process, relative to the
+		// hierarchy, or empty if the known layouts are used.
+		procDir string
+	}{
+		{
+			name:       "custom layout",
+			v2:         true,
+			procCgroup: "0::/custom.slice/app-" + testContainerID + ".scope\n",
+			procDir:    "custom.slice/app-" + testContainerID + ".scope",
+		},
+		{
+			name:       "outside of the cgroup namespace v2",
+			v2:         true,
+			procCgroup: "0::/../../" + layoutPath + "\n",
+		},
+		{
+			name:       "outside of the cgroup namespace v1",
+			procCgroup: "10:devices:/../" + layoutPath + "\n",
+		},
+		{
+			name:       "missing cgroup",
+			v2:         true,
+			procCgroup: "0::/kubepods/burstable/pod" + testPodUID + "/other\n",
+		},
+		{
+			name:       "no v2 entry",
+			v2:         true,
+			procCgroup: "10:devices:/" + layoutPath + "\n",
+		},
+		{
+			name:       "no devices entry",
+			procCgroup: "11:cpu,cpuacct:/" + layoutPath + "\n0::/" + layoutPath + "\n",
+		},
+		{
+			name: "no process",
+			v2:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cgroupPaths := []string{layoutPath}
+			if len(tc.procDir) > 0 {
+				cgroupPaths = append(cgroupPaths, tc.procDir)
+			}
+			sysFSPrefix, procDir := newTestCgroupTree(t, tc.v2, cgroupPaths, tc.procCgroup)
+			r := newCgroupResolver(sysFSPrefix, procDir, &pidRuntime{pid: testPid})
+
+			_, procErr := r.procCgroupDir(testPid)
+			if (procErr == nil) != (len(tc.procDir) > 0) {
+				t.Errorf("procCgroupDir() returned error %v, want error %v", procErr, len(tc.procDir) == 0)
+			}
+
+			want := filepath.Join(r.hierarchy(), layoutPath)
+			if len(tc.procDir) > 0 {
+				want = filepath.Join(r.hierarchy(), tc.procDir)
+			}
+			dir, err := r.containerDir(testContainerID)
+			if err != nil {
+				t.Fatalf("containerDir() failed: %v", err)
+			}
+			if dir != want {
+				t.Errorf("containerDir() = %s, want %s", dir, want)
+			}
+		})
+	}
+}
+
+func TestCgroupResolverErrors(t *testing.T) {
+	sysFSPrefix, procDir := newTestCgroupTree(t, true, []string{
+		"kubepods/pod" + testPodUID + "/" + testContainerID,
+		"kubepods.slice/kubepods-pod" + testPodSlice + ".slice/cri-containerd-" + testContainerID + ".scope",
+	}, "")
+	r := newCgroupResolver(sysFSPrefix, procDir, nil)
+
+	for _, containerID := range []string{"", "../" + testContainerID, "*", testContainerID, "0a1b2c3d4e5f"} {
+		if dir, err := r.containerDir(containerID); err == nil {
+			t.Errorf("containerDir(%q) = %s, want error", containerID, dir)
+		}
+	}
+
+	// Without a devices hierarchy nor cgroup.controllers, cgroup v1 is
+	// assumed.
+	if r := newCgroupResolver(t.TempDir(), procDir, nil); r.v2 {
+		t.Errorf("newCgroupResolver() of an empty sysfs detected cgroup v2")
+	}
+}
+
+func TestCgroupResolverContainerPids(t *testing.T) {
+	cgroupPath := "kubepods/pod" + testPodUID + "/" + testContainerID
+	for _, tc := range []struct {
+		name  string
+		procs string
+		want  []int
+		err   bool
+	}{
+		{name: "processes", procs: "4242\n4250\n4251\n", want: []int{4242, 4250, 4251}},
+		{name: "no processes", procs: ""},
+		{name: "invalid pid", procs: "4242\nabc\n", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sysFSPrefix, procDir := newTestCgroupTree(t, true, []string{cgroupPath}, "")
+			name := filepath.Join(sysFSPrefix, "sys/fs/cgroup", cgroupPath, "cgroup.procs")
+			if err := ioutil.WriteFile(name, []byte(tc.procs), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r := newCgroupResolver(sysFSPrefix, procDir, nil)
+			pids, err := r.containerPids(testContainerID)
+			if (err != nil) != tc.err {
+				t.Fatalf("containerPids() returned error %v, want error %v", err, tc.err)
+			}
+			if !tc.err && fmt.Sprint(pids) != fmt.Sprint(tc.want) {
+				t.Errorf("containerPids() = %v, want %v", pids, tc.want)
+			}
+		})
+	}
+
+	// The processes of a container without a cgroup are unknown.
+	sysFSPrefix, procDir := newTestCgroupTree(t, true, nil, "")
+	if pids, err := newCgroupResolver(sysFSPrefix, procDir, nil).containerPids(testContainerID); err == nil {
+		t.Errorf("containerPids() of a missing cgroup = %v, want error", pids)
+	}
+}
@@ -0,0 +1,144 @@
+package uinput
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// DeviceNodeOptions are the options of the device nodes created in
+// containers.
+type DeviceNodeOptions struct {
+	// Mode is the permissions of the nodes.
+	Mode os.FileMode
+	// UID and GID own the nodes.
+	UID int
+	GID int
+	// ProcDir is the procfs of the host pid namespace, used to enter the
+	// mount namespace of the containers.
+	ProcDir string
+}
+
+// containerQueue runs the changes to the devices of each container in order,
+// one at a time, apart from the caller. A worker goroutine is started for a
+// container with pending changes and exits once they are done, so that a
+// node removed right after it was added is not created again.
+type containerQueue struct {
+	mu      sync.Mutex
+	pending map[string][]func()
+	// idle is signaled when the workers of all the containers are done.
+	idle *sync.Cond
+}
+
+func newContainerQueue() *containerQueue {
+	q := &containerQueue{pending: make(map[string][]func())}
+	q.idle = sync.NewCond(&q.mu)
+	return q
+}
+
+// run queues f after the pending changes of a container.
+func (q *containerQueue) run(containerID string, f func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, busy := q.pending[containerID]
+	q.pending[containerID] = append(pending, f)
+	if !busy {
+		go q.work(containerID)
+	}
+}
+
+func (q *containerQueue) work(containerID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending[containerID]) > 0 {
+		f := q.pending[containerID][0]
+		q.pending[containerID] = q.pending[containerID][1:]
+		q.mu.Unlock()
+		f()
+		q.mu.Lock()
+	}
+	delete(q.pending, containerID)
+	if len(q.pending) == 0 {
+		q.idle.Broadcast()
+	}
+}
+
+// wait waits for the pending changes of all the containers to be done.
+func (q *containerQueue) wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 {
+		q.idle.Wait()
+	}
+}
+
+func addDeviceToContainer(rt ContainerRuntime, cgroups deviceCgroup, containerID, devicePath string, devMajor, devMinor int, nodeOpts DeviceNodeOptions) {
+	// Add device to cgroup
+	if err := cgroups.Allow(containerID, devMajor, devMinor); err != nil {
+		glog.Errorf("%v", err)
+	}
+
+	// Create the device node from the mount namespace of the container.
+	ctx := context.Background()
+	pid, err := rt.ContainerPid(ctx, containerID)
+	if err == nil {
+		err = mknodInContainer(nodeOpts.ProcDir, pid, devicePath, devMajor, devMinor, nodeOpts)
+	}
+	if err == nil {
+		return
+	}
+	glog.Warningf("failed to create %s in mount namespace of container %s, falling back to exec: %v", devicePath, containerID, err)
+
+	// Add device to container using exec.
+	cmd := []string{
+		"/bin/sh",
+		"-c",
+		fmt.Sprintf(
+			"mkdir -p %s; mknod -m %s %s c %d %d; chown %d:%d %s",
+			path.Dir(devicePath),
+			strconv.FormatUint(uint64(nodeOpts.Mode), 8),
+			devicePath,
+			devMajor,
+			devMinor,
+			nodeOpts.UID,
+			nodeOpts.GID,
+			devicePath,
+		),
+	}
+	if err := rt.Exec(ctx, containerID, cmd); err != nil {
+		glog.Errorf("%v", err)
+	}
+}
+
+func removeDeviceFromContainer(rt ContainerRuntime, cgroups deviceCgroup, containerID, devicePath string, devMajor, devMinor int, nodeOpts DeviceNodeOptions) {
+	// Remove device from cgroup
+	if err := cgroups.Deny(containerID, devMajor, devMinor); err != nil {
+		glog.Errorf("%v", err)
+	}
+
+	// Remove the device node from the mount namespace of the container.
+	ctx := context.Background()
+	pid, err := rt.ContainerPid(ctx, containerID)
+	if err == nil {
+		err = unlinkInContainer(nodeOpts.ProcDir, pid, devicePath)
+	}
+	if err == nil {
+		return
+	}
+	glog.Warningf("failed to remove %s in mount namespace of container %s, falling back to exec: %v", devicePath, containerID, err)
+
+	// Remove device from container using exec.
+	cmd := []string{
+		"/bin/rm",
+		"-f",
+		devicePath,
+	}
+	if err := rt.Exec(ctx, containerID, cmd); err != nil {
+		glog.Errorf("%v", err)
+	}
+}
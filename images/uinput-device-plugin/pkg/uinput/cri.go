@@ -0,0 +1,206 @@
+package uinput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/danisla/uinput-device-plugin/pkg/cri"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Timeout of the commands run in containers.
+	criExecTimeout = 30 * time.Second
+
+	// Timeout of the version request when connecting to the runtime.
+	criConnectTimeout = 10 * time.Second
+)
+
+// criRuntime is a ContainerRuntime over the CRI runtime service, served by
+// containerd and CRI-O. Commands run through ExecSync as the user of the
+// container, not as root like with docker.
+type criRuntime struct {
+	client cri.RuntimeServiceClient
+}
+
+// NewCRIRuntime connects to the CRI runtime service at endpoint, ex:
+// unix:///run/containerd/containerd.sock.
+func NewCRIRuntime(endpoint string) (ContainerRuntime, error) {
+	socketPath := strings.TrimPrefix(endpoint, "unix://")
+	conn, err := grpc.Dial(
+		socketPath,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", socketPath, timeout)
+		}))
+	if err != nil {
+		return nil, err
+	}
+
+	rt := &criRuntime{client: cri.NewRuntimeServiceClient(conn)}
+	ctx, cancel := context.WithTimeout(context.Background(), criConnectTimeout)
+	defer cancel()
+	version, err := rt.client.Version(ctx, &cri.VersionRequest{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get version of CRI runtime at %s: %v", endpoint, err)
+	}
+	glog.Infof("connected to container runtime %s %s, CRI %s", version.RuntimeName, version.RuntimeVersion, version.RuntimeApiVersion)
+	return rt, nil
+}
+
+func (rt *criRuntime) ListContainers(ctx context.Context) ([]string, error) {
+	resp, err := rt.client.ListContainers(ctx, &cri.ListContainersRequest{
+		Filter: &cri.ContainerFilter{
+			State: &cri.ContainerStateValue{State: cri.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var containerIDs []string
+	for _, container := range resp.Containers {
+		containerIDs = append(containerIDs, container.Id)
+	}
+	return containerIDs, nil
+}
+
+func (rt *criRuntime) FindContainerWithMount(ctx context.Context, hostPath string) (string, error) {
+	containerIDs, err := rt.ListContainers(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, containerID := range containerIDs {
+		resp, err := rt.client.ContainerStatus(ctx, &cri.ContainerStatusRequest{ContainerId: containerID})
+		if err != nil {
+			// The container was removed meanwhile.
+			continue
+		}
+		for _, mount := range resp.GetStatus().GetMounts() {
+			if mount.HostPath == hostPath {
+				return containerID, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// PodContainers returns the running containers of the pod sandbox of a
+// container, the sandbox itself is not a container in CRI. The pod is
+// identified by the metadata of the sandbox.
+func (rt *criRuntime) PodContainers(ctx context.Context, containerID string) ([]PodContainer, error) {
+	resp, err := rt.client.ListContainers(ctx, &cri.ListContainersRequest{
+		Filter: &cri.ContainerFilter{Id: containerID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Containers) != 1 {
+		return nil, fmt.Errorf("failed to find container %s, expected 1, found %d", containerID, len(resp.Containers))
+	}
+	sandboxID := resp.Containers[0].PodSandboxId
+	sandbox, err := rt.client.PodSandboxStatus(ctx, &cri.PodSandboxStatusRequest{PodSandboxId: sandboxID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status of pod sandbox %s: %v", sandboxID, err)
+	}
+	metadata := sandbox.GetStatus().GetMetadata()
+	if metadata == nil {
+		return nil, fmt.Errorf("pod sandbox %s has no metadata", sandboxID)
+	}
+
+	resp, err = rt.client.ListContainers(ctx, &cri.ListContainersRequest{
+		Filter: &cri.ContainerFilter{
+			PodSandboxId: sandboxID,
+			State:        &cri.ContainerStateValue{State: cri.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var containers []PodContainer
+	for _, container := range resp.Containers {
+		containers = append(containers, PodContainer{
+			ID:           container.Id,
+			Name:         container.GetMetadata().GetName(),
+			PodName:      metadata.Name,
+			PodNamespace: metadata.Namespace,
+			PodUID:       metadata.Uid,
+		})
+	}
+	return containers, nil
+}
+
+// ContainerPid returns the pid from the verbose info of the container
+// status, as served by containerd and CRI-O.
+func (rt *criRuntime) ContainerPid(ctx context.Context, containerID string) (int, error) {
+	resp, err := rt.client.ContainerStatus(ctx, &cri.ContainerStatusRequest{
+		ContainerId: containerID,
+		Verbose:     true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var info struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.Unmarshal([]byte(resp.Info["info"]), &info); err != nil {
+		return 0, fmt.Errorf("failed to parse info of container %s: %v", containerID, err)
+	}
+	if info.Pid == 0 {
+		return 0, fmt.Errorf("container %s has no pid", containerID)
+	}
+	return info.Pid, nil
+}
+
+func (rt *criRuntime) Exec(ctx context.Context, containerID string, cmd []string) error {
+	resp, err := rt.client.ExecSync(ctx, &cri.ExecSyncRequest{
+		ContainerId: containerID,
+		Cmd:         cmd,
+		Timeout:     int64(criExecTimeout / time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to exec %s in container %s: %v", cmd[0], containerID, err)
+	}
+	if resp.ExitCode != 0 {
+		return fmt.Errorf("exec %s in container %s exited with %d: %s", cmd[0], containerID, resp.ExitCode, strings.TrimSpace(string(resp.Stderr)))
+	}
+	return nil
+}
+
+// WatchExits sends the containers that stop or are deleted, from the CRI
+// container events stream. The stream is only served by recent runtimes, ex:
+// containerd 1.7.
+func (rt *criRuntime) WatchExits(ctx context.Context, exits chan<- string) error {
+	stream, err := rt.client.GetContainerEvents(ctx, &cri.GetEventsRequest{})
+	if err != nil {
+		return criWatchError(err)
+	}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("container events stream closed")
+		}
+		if err != nil {
+			return criWatchError(err)
+		}
+		switch event.ContainerEventType {
+		case cri.ContainerEventType_CONTAINER_STOPPED_EVENT, cri.ContainerEventType_CONTAINER_DELETED_EVENT:
+			exits <- event.ContainerId
+		}
+	}
+}
+
+func criWatchError(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return errWatchUnsupported
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+package uinput
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danisla/uinput-device-plugin/pkg/cri"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeRuntimeService serves a fixed set of containers, ContainerEvents is not
+// implemented like in runtimes older than containerd 1.7.
+type fakeRuntimeService struct {
+	cri.UnimplementedRuntimeServiceServer
+
+	containers []*cri.Container
+	statuses   map[string]*cri.ContainerStatusResponse
+	sandboxes  map[string]*cri.PodSandboxStatusResponse
+	execs      map[string]*cri.ExecSyncResponse
+}
+
+func (s *fakeRuntimeService) Version(ctx context.Context, req *cri.VersionRequest) (*cri.VersionResponse, error) {
+	return &cri.VersionResponse{RuntimeName: "fake", RuntimeVersion: "1.0", RuntimeApiVersion: "v1"}, nil
+}
+
+func (s *fakeRuntimeService) ListContainers(ctx context.Context, req *cri.ListContainersRequest) (*cri.ListContainersResponse, error) {
+	filter := req.GetFilter()
+	resp := &cri.ListContainersResponse{}
+	for _, container := range s.containers {
+		if len(filter.GetId()) > 0 && container.Id != filter.GetId() {
+			continue
+		}
+		if len(filter.GetPodSandboxId()) > 0 && container.PodSandboxId != filter.GetPodSandboxId() {
+			continue
+		}
+		if filter.GetState() != nil && container.State != filter.GetState().State {
+			continue
+		}
+		resp.Containers = append(resp.Containers, container)
+	}
+	return resp, nil
+}
+
+func (s *fakeRuntimeService) ContainerStatus(ctx context.Context, req *cri.ContainerStatusRequest) (*cri.ContainerStatusResponse, error) {
+	resp, ok := s.statuses[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %s not found", req.ContainerId)
+	}
+	if !req.Verbose {
+		return &cri.ContainerStatusResponse{Status: resp.Status}, nil
+	}
+	return resp, nil
+}
+
+func (s *fakeRuntimeService) PodSandboxStatus(ctx context.Context, req *cri.PodSandboxStatusRequest) (*cri.PodSandboxStatusResponse, error) {
+	resp, ok := s.sandboxes[req.PodSandboxId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "pod sandbox %s not found", req.PodSandboxId)
+	}
+	return resp, nil
+}
+
+func (s *fakeRuntimeService) ExecSync(ctx context.Context, req *cri.ExecSyncRequest) (*cri.ExecSyncResponse, error) {
+	resp, ok := s.execs[req.ContainerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %s not found", req.ContainerId)
+	}
+	return resp, nil
+}
+
+// newFakeCRIRuntime serves the fake runtime service on a Unix socket and
+// connects to it.
+func newFakeCRIRuntime(t *testing.T) ContainerRuntime {
+	running := &cri.ContainerStateValue{State: cri.ContainerState_CONTAINER_RUNNING}
+	service := &fakeRuntimeService{
+		containers: []*cri.Container{
+			{Id: "app", PodSandboxId: "sandbox", Metadata: &cri.ContainerMetadata{Name: "desktop"}, State: running.State},
+			{Id: "sidecar", PodSandboxId: "sandbox", Metadata: &cri.ContainerMetadata{Name: "sidecar"}, State: running.State},
+			{Id: "exited", PodSandboxId: "sandbox", Metadata: &cri.ContainerMetadata{Name: "init"}, State: cri.ContainerState_CONTAINER_EXITED},
+			{Id: "removed", PodSandboxId: "sandbox", Metadata: &cri.ContainerMetadata{Name: "removed"}, State: running.State},
+			{Id: "orphan", PodSandboxId: "gone", Metadata: &cri.ContainerMetadata{Name: "orphan"}, State: running.State},
+		},
+		statuses: map[string]*cri.ContainerStatusResponse{
+			"app": {
+				Status: &cri.ContainerStatus{Id: "app", Mounts: []*cri.Mount{
+					{ContainerPath: "/tmp/.X11-unix", HostPath: "/tmp/.X11-unix"},
+					{ContainerPath: "/var/run/uinput", HostPath: "/tmp/.uinput/uinput-3"},
+				}},
+				Info: map[string]string{"info": `{"sandboxID":"sandbox","pid":4242,"runtimeSpec":{}}`},
+			},
+			"sidecar": {
+				Status: &cri.ContainerStatus{Id: "sidecar"},
+				Info:   map[string]string{"info": `{"sandboxID":"sandbox"}`},
+			},
+			"orphan": {
+				Status: &cri.ContainerStatus{Id: "orphan"},
+				Info:   map[string]string{"info": "not json"},
+			},
+		},
+		sandboxes: map[string]*cri.PodSandboxStatusResponse{
+			"sandbox": {Status: &cri.PodSandboxStatus{Id: "sandbox", Metadata: &cri.PodSandboxMetadata{Name: "desktop-0", Namespace: "user-1", Uid: "2b1c8a6e-6f3b-4bd0-9a0c-2f4a9c6a1e11"}}},
+		},
+		execs: map[string]*cri.ExecSyncResponse{
+			"app":     {ExitCode: 0},
+			"sidecar": {ExitCode: 1, Stderr: []byte("mknod: /dev/input/event21: Permission denied\n")},
+		},
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "cri.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	cri.RegisterRuntimeServiceServer(server, service)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	rt, err := NewCRIRuntime("unix://" + socketPath)
+	if err != nil {
+		t.Fatalf("NewCRIRuntime() failed: %v", err)
+	}
+	return rt
+}
+
+func TestCRIRuntimeContainers(t *testing.T) {
+	rt := newFakeCRIRuntime(t)
+	ctx := context.Background()
+
+	containerIDs, err := rt.ListContainers(ctx)
+	if err != nil {
+		t.Fatalf("ListContainers() failed: %v", err)
+	}
+	if got := strings.Join(containerIDs, ","); got != "app,sidecar,removed,orphan" {
+		t.Errorf("ListContainers() = %s, want the running containers", got)
+	}
+
+	for _, tc := range []struct {
+		hostPath    string
+		containerID string
+	}{
+		{"/tmp/.uinput/uinput-3", "app"},
+		{"/tmp/.uinput/uinput-4", ""},
+	} {
+		containerID, err := rt.FindContainerWithMount(ctx, tc.hostPath)
+		if err != nil {
+			t.Errorf("FindContainerWithMount(%s) failed: %v", tc.hostPath, err)
+		} else if containerID != tc.containerID {
+			t.Errorf("FindContainerWithMount(%s) = %q, want %q", tc.hostPath, containerID, tc.containerID)
+		}
+	}
+
+	containers, err := rt.PodContainers(ctx, "app")
+	if err != nil {
+		t.Fatalf("PodContainers() failed: %v", err)
+	}
+	var names []string
+	for _, container := range containers {
+		if container.PodName != "desktop-0" || container.PodNamespace != "user-1" || len(container.PodUID) == 0 {
+			t.Errorf("PodContainers() returned %+v, want the pod of the sandbox", container)
+		}
+		names = append(names, container.Name)
+	}
+	if got := strings.Join(names, ","); got != "desktop,sidecar,removed" {
+		t.Errorf("PodContainers() returned containers %s, want the running containers of the sandbox", got)
+	}
+	for _, containerID := range []string{"orphan", "unknown"} {
+		if _, err := rt.PodContainers(ctx, containerID); err == nil {
+			t.Errorf("PodContainers(%s) succeeded", containerID)
+		}
+	}
+}
+
+func TestCRIRuntimeContainerPid(t *testing.T) {
+	rt := newFakeCRIRuntime(t)
+	for _, tc := range []struct {
+		containerID string
+		pid         int
+		err         string
+	}{
+		{containerID: "app", pid: 4242},
+		{containerID: "sidecar", err: "has no pid"},
+		{containerID: "orphan", err: "failed to parse info"},
+		{containerID: "removed", err: "not found"},
+	} {
+		pid, err := rt.ContainerPid(context.Background(), tc.containerID)
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("ContainerPid(%s) returned %d, %v, want error containing %q", tc.containerID, pid, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || pid != tc.pid {
+			t.Errorf("ContainerPid(%s) = %d, %v, want %d", tc.containerID, pid, err, tc.pid)
+		}
+	}
+}
+
+func TestCRIRuntimeExec(t *testing.T) {
+	rt := newFakeCRIRuntime(t)
+	cmd := []string{"mknod", "/dev/input/event21", "c", "13", "85"}
+	for _, tc := range []struct {
+		containerID string
+		err         string
+	}{
+		{containerID: "app"},
+		{containerID: "sidecar", err: "exec mknod in container sidecar exited with 1: mknod: /dev/input/event21: Permission denied"},
+		{containerID: "removed", err: "failed to exec mknod in container removed"},
+	} {
+		err := rt.Exec(context.Background(), tc.containerID, cmd)
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("Exec(%s) returned %v, want error containing %q", tc.containerID, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Exec(%s) failed: %v", tc.containerID, err)
+		}
+	}
+}
+
+func TestCRIRuntimeWatchUnsupported(t *testing.T) {
+	rt := newFakeCRIRuntime(t)
+	if err := rt.WatchExits(context.Background(), make(chan string)); err != errWatchUnsupported {
+		t.Errorf("WatchExits() returned %v, want %v", err, errWatchUnsupported)
+	}
+}
+
+func TestCRIRuntimeUnavailable(t *testing.T) {
+	if _, err := NewCRIRuntime("unix://" + filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Errorf("NewCRIRuntime() of a missing socket succeeded")
+	}
+}
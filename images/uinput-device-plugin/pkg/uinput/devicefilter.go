@@ -0,0 +1,143 @@
+package uinput
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// eBPF instruction encodings used by the device programs.
+const (
+	bpfMov64Imm = 0x07 | 0xb0 // BPF_ALU64 | BPF_MOV | BPF_K
+	bpfAnd64Imm = 0x07 | 0x50 // BPF_ALU64 | BPF_AND | BPF_K
+	bpfLdxW     = 0x01 | 0x60 // BPF_LDX | BPF_MEM | BPF_W
+	bpfJneImm   = 0x05 | 0x50 // BPF_JMP | BPF_JNE | BPF_K
+	bpfExit     = 0x05 | 0x90 // BPF_JMP | BPF_EXIT
+
+	// BPF_DEVCG_DEV_CHAR, the device type in the low 16 bits of the access
+	// type of struct bpf_cgroup_dev_ctx.
+	bpfDevcgDevChar = 2
+
+	// deviceProgramMagic marks the start of the rules prepended to a device
+	// program, "uinp".
+	deviceProgramMagic = 0x75696e70
+
+	// Length of the header and of each rule of the prepended rules.
+	deviceProgramHeaderLen = 6
+	deviceProgramRuleLen   = 5
+)
+
+// bpfInsn is an eBPF instruction, struct bpf_insn.
+type bpfInsn struct {
+	Code uint8
+	// Regs holds the destination register in the low nibble and the source
+	// register in the high nibble.
+	Regs uint8
+	Off  int16
+	Imm  int32
+}
+
+func bpfInsnRegs(dst, src uint8) uint8 {
+	return src<<4 | dst
+}
+
+// deviceRule allows all access to a character device.
+type deviceRule struct {
+	Major uint32
+	Minor uint32
+}
+
+// buildDeviceProgram prepends rules allowing the devices to a
+// BPF_PROG_TYPE_CGROUP_DEVICE program, the base program decides for the
+// other devices. The rules are prefixed by a header holding their count, so
+// parseDeviceProgram can split them from the base program again.
+func buildDeviceProgram(rules []deviceRule, base []bpfInsn) []bpfInsn {
+	if len(rules) == 0 {
+		return base
+	}
+	insns := []bpfInsn{
+		{Code: bpfMov64Imm, Regs: bpfInsnRegs(0, 0), Imm: deviceProgramMagic},
+		{Code: bpfMov64Imm, Regs: bpfInsnRegs(0, 0), Imm: int32(len(rules))},
+		// r2 = ctx->access_type & 0xffff, the device type.
+		{Code: bpfLdxW, Regs: bpfInsnRegs(2, 1), Off: 0},
+		{Code: bpfAnd64Imm, Regs: bpfInsnRegs(2, 0), Imm: 0xffff},
+		// r3 = ctx->major, r4 = ctx->minor.
+		{Code: bpfLdxW, Regs: bpfInsnRegs(3, 1), Off: 4},
+		{Code: bpfLdxW, Regs: bpfInsnRegs(4, 1), Off: 8},
+	}
+	for _, rule := range rules {
+		insns = append(insns,
+			// Jump to the next rule unless the device matches.
+			bpfInsn{Code: bpfJneImm, Regs: bpfInsnRegs(2, 0), Off: 4, Imm: bpfDevcgDevChar},
+			bpfInsn{Code: bpfJneImm, Regs: bpfInsnRegs(3, 0), Off: 3, Imm: int32(rule.Major)},
+			bpfInsn{Code: bpfJneImm, Regs: bpfInsnRegs(4, 0), Off: 2, Imm: int32(rule.Minor)},
+			bpfInsn{Code: bpfMov64Imm, Regs: bpfInsnRegs(0, 0), Imm: 1},
+			bpfInsn{Code: bpfExit},
+		)
+	}
+	// The base program reads the context from r1, which is left untouched.
+	return append(insns, base...)
+}
+
+// parseDeviceProgram splits a program built by buildDeviceProgram into its
+// rules and base program. A program without rules is returned as the base.
+func parseDeviceProgram(insns []bpfInsn) ([]deviceRule, []bpfInsn, error) {
+	if len(insns) < 2 || insns[0].Code != bpfMov64Imm || insns[0].Imm != deviceProgramMagic {
+		return nil, insns, nil
+	}
+	n := int(insns[1].Imm)
+	end := deviceProgramHeaderLen + n*deviceProgramRuleLen
+	if insns[1].Code != bpfMov64Imm || n < 0 || end > len(insns) {
+		return nil, nil, fmt.Errorf("invalid device program header")
+	}
+	var rules []deviceRule
+	for i := 0; i < n; i++ {
+		rule := insns[deviceProgramHeaderLen+i*deviceProgramRuleLen:]
+		if rule[1].Code != bpfJneImm || rule[2].Code != bpfJneImm || rule[4].Code != bpfExit {
+			return nil, nil, fmt.Errorf("invalid device program rule %d", i)
+		}
+		rules = append(rules, deviceRule{
+			Major: uint32(rule[1].Imm),
+			Minor: uint32(rule[2].Imm),
+		})
+	}
+	return rules, insns[end:], nil
+}
+
+// addDeviceRule returns the rules with rule added, and whether it was added.
+func addDeviceRule(rules []deviceRule, rule deviceRule) ([]deviceRule, bool) {
+	for _, r := range rules {
+		if r == rule {
+			return rules, false
+		}
+	}
+	return append(rules, rule), true
+}
+
+// removeDeviceRule returns the rules without rule, and whether it was
+// removed.
+func removeDeviceRule(rules []deviceRule, rule deviceRule) ([]deviceRule, bool) {
+	for i, r := range rules {
+		if r == rule {
+			return append(rules[:i:i], rules[i+1:]...), true
+		}
+	}
+	return rules, false
+}
+
+func marshalBPFInsns(insns []bpfInsn) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, insns)
+	return buf.Bytes()
+}
+
+func unmarshalBPFInsns(dat []byte) ([]bpfInsn, error) {
+	if len(dat)%8 != 0 {
+		return nil, fmt.Errorf("invalid program length %d", len(dat))
+	}
+	insns := make([]bpfInsn, len(dat)/8)
+	if err := binary.Read(bytes.NewReader(dat), binary.LittleEndian, insns); err != nil {
+		return nil, err
+	}
+	return insns, nil
+}
@@ -0,0 +1,168 @@
+package uinput
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Other eBPF instruction encodings of the programs generated by runc.
+const (
+	bpfMov32Imm = 0x04 | 0xb0 // BPF_ALU | BPF_MOV | BPF_K
+	bpfMov32Reg = 0x04 | 0xb8 // BPF_ALU | BPF_MOV | BPF_X
+	bpfAnd32Imm = 0x04 | 0x50 // BPF_ALU | BPF_AND | BPF_K
+	bpfRsh32Imm = 0x04 | 0x70 // BPF_ALU | BPF_RSH | BPF_K
+	bpfJneReg   = 0x05 | 0x58 // BPF_JMP | BPF_JNE | BPF_X
+)
+
+// runcDeviceProgram is the program generated by runc for a container
+// allowed "c 1:3 rwm" and "c 10:200 rw", denying other devices.
+var runcDeviceProgram = []bpfInsn{
+	// r2 = type, r3 = access, r4 = major, r5 = minor.
+	{Code: bpfLdxW, Regs: bpfInsnRegs(2, 1), Off: 0},
+	{Code: bpfAnd32Imm, Regs: bpfInsnRegs(2, 0), Imm: 0xffff},
+	{Code: bpfLdxW, Regs: bpfInsnRegs(3, 1), Off: 0},
+	{Code: bpfRsh32Imm, Regs: bpfInsnRegs(3, 0), Imm: 16},
+	{Code: bpfLdxW, Regs: bpfInsnRegs(4, 1), Off: 4},
+	{Code: bpfLdxW, Regs: bpfInsnRegs(5, 1), Off: 8},
+	// c 1:3 rwm
+	{Code: bpfJneImm, Regs: bpfInsnRegs(2, 0), Off: 4, Imm: bpfDevcgDevChar},
+	{Code: bpfJneImm, Regs: bpfInsnRegs(4, 0), Off: 3, Imm: 1},
+	{Code: bpfJneImm, Regs: bpfInsnRegs(5, 0), Off: 2, Imm: 3},
+	{Code: bpfMov32Imm, Regs: bpfInsnRegs(0, 0), Imm: 1},
+	{Code: bpfExit},
+	// c 10:200 rw
+	{Code: bpfJneImm, Regs: bpfInsnRegs(2, 0), Off: 7, Imm: bpfDevcgDevChar},
+	{Code: bpfMov32Reg, Regs: bpfInsnRegs(1, 3)},
+	{Code: bpfAnd32Imm, Regs: bpfInsnRegs(1, 0), Imm: 6},
+	{Code: bpfJneReg, Regs: bpfInsnRegs(1, 3), Off: 4},
+	{Code: bpfJneImm, Regs: bpfInsnRegs(4, 0), Off: 3, Imm: 10},
+	{Code: bpfJneImm, Regs: bpfInsnRegs(5, 0), Off: 2, Imm: 200},
+	{Code: bpfMov32Imm, Regs: bpfInsnRegs(0, 0), Imm: 1},
+	{Code: bpfExit},
+	// Deny.
+	{Code: bpfMov32Imm, Regs: bpfInsnRegs(0, 0), Imm: 0},
+	{Code: bpfExit},
+}
+
+func TestDeviceProgramRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rules []deviceRule
+		base  []bpfInsn
+	}{
+		{"runc without rules", nil, runcDeviceProgram},
+		{"runc", []deviceRule{{13, 85}}, runcDeviceProgram},
+		{"runc with rules", []deviceRule{{13, 85}, {13, 0}, {13, 63}}, runcDeviceProgram},
+		{"large numbers", []deviceRule{{4095, 1048575}}, runcDeviceProgram},
+		{"empty base", []deviceRule{{13, 85}}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			insns := buildDeviceProgram(tc.rules, tc.base)
+			if want := len(tc.base); len(tc.rules) > 0 {
+				want += deviceProgramHeaderLen + len(tc.rules)*deviceProgramRuleLen
+				if len(insns) != want {
+					t.Fatalf("buildDeviceProgram() returned %d instructions, want %d", len(insns), want)
+				}
+			}
+
+			// The program goes through the kernel as bytes.
+			insns, err := unmarshalBPFInsns(marshalBPFInsns(insns))
+			if err != nil {
+				t.Fatalf("unmarshalBPFInsns() failed: %v", err)
+			}
+
+			rules, base, err := parseDeviceProgram(insns)
+			if err != nil {
+				t.Fatalf("parseDeviceProgram() failed: %v", err)
+			}
+			if !reflect.DeepEqual(rules, tc.rules) {
+				t.Errorf("parseDeviceProgram() returned rules %v, want %v", rules, tc.rules)
+			}
+			if len(base) != len(tc.base) || (len(base) > 0 && !reflect.DeepEqual(base, tc.base)) {
+				t.Errorf("parseDeviceProgram() returned base %v, want %v", base, tc.base)
+			}
+		})
+	}
+}
+
+func TestParseDeviceProgramInvalid(t *testing.T) {
+	valid := buildDeviceProgram([]deviceRule{{13, 85}, {13, 0}}, runcDeviceProgram)
+	corrupt := func(f func(insns []bpfInsn) []bpfInsn) []bpfInsn {
+		insns := append([]bpfInsn(nil), valid...)
+		return f(insns)
+	}
+	for _, tc := range []struct {
+		name  string
+		insns []bpfInsn
+	}{
+		{"truncated rules", valid[:deviceProgramHeaderLen+deviceProgramRuleLen+2]},
+		{"negative count", corrupt(func(insns []bpfInsn) []bpfInsn {
+			insns[1].Imm = -1
+			return insns
+		})},
+		{"count too large", corrupt(func(insns []bpfInsn) []bpfInsn {
+			insns[1].Imm = 100
+			return insns
+		})},
+		{"count not a mov", corrupt(func(insns []bpfInsn) []bpfInsn {
+			insns[1].Code = bpfLdxW
+			return insns
+		})},
+		{"rule without exit", corrupt(func(insns []bpfInsn) []bpfInsn {
+			insns[deviceProgramHeaderLen+deviceProgramRuleLen+4].Code = bpfMov64Imm
+			return insns
+		})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if rules, _, err := parseDeviceProgram(tc.insns); err == nil {
+				t.Errorf("parseDeviceProgram() returned rules %v, want error", rules)
+			}
+		})
+	}
+
+	if _, err := unmarshalBPFInsns(make([]byte, 12)); err == nil {
+		t.Errorf("unmarshalBPFInsns() of 12 bytes succeeded")
+	}
+}
+
+func TestDeviceRules(t *testing.T) {
+	js0 := deviceRule{13, 0}
+	event21 := deviceRule{13, 85}
+	for _, tc := range []struct {
+		name    string
+		rules   []deviceRule
+		add     bool
+		rule    deviceRule
+		want    []deviceRule
+		changed bool
+	}{
+		{"add to empty", nil, true, js0, []deviceRule{js0}, true},
+		{"add new", []deviceRule{js0}, true, event21, []deviceRule{js0, event21}, true},
+		{"add existing", []deviceRule{js0, event21}, true, event21, []deviceRule{js0, event21}, false},
+		{"remove existing", []deviceRule{js0, event21}, false, js0, []deviceRule{event21}, true},
+		{"remove last", []deviceRule{js0}, false, js0, []deviceRule{}, true},
+		{"remove missing", []deviceRule{event21}, false, js0, []deviceRule{event21}, false},
+		{"remove from empty", nil, false, js0, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := append([]deviceRule(nil), tc.rules...)
+			change := removeDeviceRule
+			if tc.add {
+				change = addDeviceRule
+			}
+			got, changed := change(rules, tc.rule)
+			if changed != tc.changed || len(got) != len(tc.want) || (len(got) > 0 && !reflect.DeepEqual(got, tc.want)) {
+				t.Errorf("got %v, %v, want %v, %v", got, changed, tc.want, tc.changed)
+			}
+			// Adding or removing again changes nothing.
+			again, changed := change(got, tc.rule)
+			if changed || !reflect.DeepEqual(again, got) {
+				t.Errorf("second change returned %v, %v, want %v, false", again, changed, got)
+			}
+			// The rules given are left untouched.
+			if len(tc.rules) > 0 && !reflect.DeepEqual(rules, tc.rules) {
+				t.Errorf("rules changed to %v", rules)
+			}
+		})
+	}
+}
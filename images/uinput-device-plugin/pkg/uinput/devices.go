@@ -0,0 +1,593 @@
+package uinput
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// sysfs directory of the devices created with uinput.
+	virtualInputDevPath = "/devices/virtual/input"
+
+	// Interval at which the grants of containers that are gone are dropped.
+	grantGCInterval = time.Minute
+
+	// Timeout of the runtime requests finding the containers of a pod.
+	podContainersTimeout = 10 * time.Second
+)
+
+// deviceOwner is the container that created a device, and the containers the
+// device nodes are added to.
+type deviceOwner struct {
+	container  string
+	mode       string
+	containers []string
+}
+
+type deviceNode struct {
+	major int
+	minor int
+}
+
+// inputDevice is a uinput device, ex: input12, and its nodes, ex:
+// /dev/input/event5.
+type inputDevice struct {
+	sysname string
+	owner   *deviceOwner
+	nodes   map[string]deviceNode
+}
+
+// deviceCorrelator matches the device nodes to the containers that created
+// them. The devices created by a container are found on the uinput file
+// descriptors of its processes after each trigger of its helper, the nodes
+// seen in udev events are added once the device is claimed, in any order.
+type deviceCorrelator struct {
+	rt          ContainerRuntime
+	paths       *cgroupResolver
+	cgroups     deviceCgroup
+	sysFSPrefix string
+	nodeOpts    DeviceNodeOptions
+	statePath   string
+	// queue applies the grants to the containers, in order for each
+	// container.
+	queue *containerQueue
+	// resolves finds the devices created and destroyed after the triggers,
+	// in order for each container, and sends them to resolved.
+	resolves *containerQueue
+	resolved chan MonitorEvent
+	trackers map[string]*uinputTracker
+
+	devices map[string]*inputDevice
+	// dirty is set when the grants changed since the state was saved.
+	dirty bool
+}
+
+func newDeviceCorrelator(rt ContainerRuntime, sysFSPrefix string, nodeOpts DeviceNodeOptions, statePath string) *deviceCorrelator {
+	paths := newCgroupResolver(sysFSPrefix, nodeOpts.ProcDir, rt)
+	return &deviceCorrelator{
+		rt:          rt,
+		paths:       paths,
+		cgroups:     newDeviceCgroup(paths),
+		sysFSPrefix: sysFSPrefix,
+		nodeOpts:    nodeOpts,
+		statePath:   statePath,
+		queue:       newContainerQueue(),
+		resolves:    newContainerQueue(),
+		resolved:    make(chan MonitorEvent),
+		trackers:    make(map[string]*uinputTracker),
+		devices:     make(map[string]*inputDevice),
+	}
+}
+
+func (c *deviceCorrelator) handle(event MonitorEvent) {
+	switch event.Type {
+	case EventTypeUdevDeviceOpened:
+		c.resolveCreated(event.Data)
+
+	case EventTypeUdevDeviceClosed:
+		c.resolveDestroyed(event.Data)
+
+	case EventTypeUinputDeviceCreated:
+		device := event.Device
+		dev := c.device(device.Sysname)
+		c.claim(dev, eventOwner(event.Data))
+		for _, n := range device.Nodes {
+			c.addDeviceNode(dev, path.Join("/dev", n.DevName), deviceNode{major: int(n.Major), minor: int(n.Minor)})
+		}
+
+	case EventTypeUinputDeviceDestroyed:
+		dev, ok := c.devices[event.Device.Sysname]
+		if !ok {
+			return
+		}
+		if dev.owner != nil && dev.owner.container != event.Data["container"] {
+			glog.Errorf("device %s is destroyed by container %s, owned by container %s", dev.sysname, event.Data["container"], dev.owner.container)
+			return
+		}
+		for devicePath := range dev.nodes {
+			c.removeDeviceNode(dev, devicePath)
+		}
+		delete(c.devices, dev.sysname)
+
+	case EventTypeContainerExited:
+		c.containerExited(event.Data["container"])
+
+	case EventTypeUdevDeviceAdded:
+		sysname, devicePath, node, ok := parseNodeEvent(event.Data)
+		if !ok {
+			return
+		}
+		c.addDeviceNode(c.device(sysname), devicePath, node)
+
+	case EventTypeUdevDeviceRemoved:
+		sysname, devicePath, _, ok := parseNodeEvent(event.Data)
+		if !ok {
+			return
+		}
+		if dev, ok := c.devices[sysname]; ok {
+			c.removeDeviceNode(dev, devicePath)
+		}
+	}
+}
+
+// resolveCreated finds the owner and the devices created by the container of
+// an open trigger and sends them to the event loop. The devices are created
+// some time after the open and the owner is found with runtime requests, so
+// they are waited for apart from the event loop. Only the devices on the
+// uinput file descriptors of the processes of the container are found,
+// whatever its helper reports.
+func (c *deviceCorrelator) resolveCreated(trigger map[string]string) {
+	containerID := trigger["container"]
+	tracker := c.tracker(containerID)
+	c.resolves.run(containerID, func() {
+		owner := c.newOwner(trigger)
+		data := make(map[string]string)
+		for k, v := range trigger {
+			data[k] = v
+		}
+		data["containers"] = strings.Join(owner.containers, ",")
+
+		devices, err := tracker.created(uinputCreateTimeout)
+		if err != nil {
+			glog.Errorf("failed to find devices created by container %s: %v", containerID, err)
+		}
+		for _, device := range devices {
+			c.resolved <- MonitorEvent{
+				Timestamp: time.Now(),
+				Type:      EventTypeUinputDeviceCreated,
+				Data:      data,
+				Device:    device,
+			}
+		}
+	})
+}
+
+// resolveDestroyed finds the devices destroyed by the container of a close
+// trigger and sends them to the event loop.
+func (c *deviceCorrelator) resolveDestroyed(data map[string]string) {
+	containerID := data["container"]
+	tracker := c.tracker(containerID)
+	c.resolves.run(containerID, func() {
+		devices, err := tracker.destroyed(uinputDestroyTimeout)
+		if err != nil {
+			glog.Errorf("failed to find devices destroyed by container %s: %v", containerID, err)
+		}
+		for _, device := range devices {
+			c.resolved <- MonitorEvent{
+				Timestamp: time.Now(),
+				Type:      EventTypeUinputDeviceDestroyed,
+				Data:      data,
+				Device:    device,
+			}
+		}
+	})
+}
+
+// tracker returns the tracker of the uinput file descriptors of the
+// processes of a container, the processes of its cgroup in the host pid
+// namespace.
+func (c *deviceCorrelator) tracker(containerID string) *uinputTracker {
+	tracker, ok := c.trackers[containerID]
+	if !ok {
+		tracker = newUinputTracker(c.nodeOpts.ProcDir, path.Join(c.sysFSPrefix, "sys"), func() ([]int, error) {
+			return c.paths.containerPids(containerID)
+		})
+		c.trackers[containerID] = tracker
+	}
+	return tracker
+}
+
+// addDeviceNode adds a node to a device, and to the containers of its owner.
+// A node is reported by both the helper and udev, it is only added once.
+func (c *deviceCorrelator) addDeviceNode(dev *inputDevice, devicePath string, node deviceNode) {
+	if _, ok := dev.nodes[devicePath]; ok {
+		return
+	}
+	dev.nodes[devicePath] = node
+	if dev.owner != nil {
+		c.addNode(dev.owner, devicePath, node)
+		c.dirty = true
+	}
+}
+
+// removeDeviceNode removes a node from a device and from the containers of
+// its owner, the device is forgotten with its last node.
+func (c *deviceCorrelator) removeDeviceNode(dev *inputDevice, devicePath string) {
+	node, ok := dev.nodes[devicePath]
+	if !ok {
+		return
+	}
+	delete(dev.nodes, devicePath)
+	if dev.owner != nil {
+		for _, containerID := range dev.owner.containers {
+			c.removeFromContainer(containerID, devicePath, node)
+		}
+		glog.Infof("removed device %s from %d containers", devicePath, len(dev.owner.containers))
+		c.dirty = true
+	}
+	if len(dev.nodes) == 0 {
+		delete(c.devices, dev.sysname)
+	}
+}
+
+// newOwner returns the owner of the devices created by the container of a
+// trigger. When the plugin mode is 'pod', the devices are added to the app
+// containers of the pod, or those named by the helper, otherwise just the
+// creating container.
+func (c *deviceCorrelator) newOwner(data map[string]string) *deviceOwner {
+	containerID := data["container"]
+	owner := &deviceOwner{
+		container:  containerID,
+		mode:       data["mode"],
+		containers: []string{containerID},
+	}
+	if owner.mode == UinputTriggerMessage_PluginMode_name[int32(UinputTriggerMessage_POD)] {
+		ctx, cancel := context.WithTimeout(context.Background(), podContainersTimeout)
+		defer cancel()
+		podContainers, err := c.rt.PodContainers(ctx, containerID)
+		if err != nil {
+			glog.Errorf("failed to find pod of container %s, adding devices to it only: %v", containerID, err)
+			return owner
+		}
+		containers, err := selectPodContainers(containerID, podContainers, eventPod(data))
+		if err != nil {
+			glog.Errorf("%v, adding devices to container %s only", err, containerID)
+			return owner
+		}
+		owner.containers = containers
+	}
+	return owner
+}
+
+// eventOwner returns the owner found for a uinput device created event.
+func eventOwner(data map[string]string) *deviceOwner {
+	owner := &deviceOwner{
+		container:  data["container"],
+		mode:       data["mode"],
+		containers: strings.Split(data["containers"], ","),
+	}
+	if data["containers"] == "" {
+		owner.containers = []string{owner.container}
+	}
+	return owner
+}
+
+// eventPod returns the pod sent by the helper of a trigger.
+func eventPod(data map[string]string) HelperPod {
+	pod := HelperPod{
+		Name:      data["pod_name"],
+		Namespace: data["pod_namespace"],
+		UID:       data["pod_uid"],
+	}
+	if names := data["container_names"]; names != "" {
+		pod.ContainerNames = strings.Split(names, ",")
+	}
+	return pod
+}
+
+// selectPodContainers returns the IDs of the containers of the pod of a
+// container that get the devices it creates. The pod sent by the helper must
+// match the pod of the container, except for the name which is the hostname
+// of the helper and differs with a custom hostname or the host network. The
+// creating container is always included.
+func selectPodContainers(containerID string, podContainers []PodContainer, pod HelperPod) ([]string, error) {
+	var self *PodContainer
+	for i := range podContainers {
+		if podContainers[i].ID == containerID {
+			self = &podContainers[i]
+			break
+		}
+	}
+	if self == nil {
+		return nil, fmt.Errorf("container %s is not in its pod", containerID)
+	}
+	if len(pod.UID) > 0 && pod.UID != self.PodUID {
+		return nil, fmt.Errorf("container %s is in pod %s, helper reported pod %s", containerID, self.PodUID, pod.UID)
+	}
+	if len(pod.Namespace) > 0 && pod.Namespace != self.PodNamespace {
+		return nil, fmt.Errorf("container %s is in namespace %s, helper reported namespace %s", containerID, self.PodNamespace, pod.Namespace)
+	}
+	if len(pod.Name) > 0 && pod.Name != self.PodName {
+		glog.V(1).Infof("container %s is in pod %s/%s, helper reported name %s", containerID, self.PodNamespace, self.PodName, pod.Name)
+	}
+
+	containerIDs := []string{}
+	for _, container := range podContainers {
+		if container.ID == containerID || len(pod.ContainerNames) == 0 || containsString(pod.ContainerNames, container.Name) {
+			containerIDs = append(containerIDs, container.ID)
+		}
+	}
+	return containerIDs, nil
+}
+
+func (c *deviceCorrelator) device(sysname string) *inputDevice {
+	dev, ok := c.devices[sysname]
+	if !ok {
+		dev = &inputDevice{
+			sysname: sysname,
+			nodes:   make(map[string]deviceNode),
+		}
+		c.devices[sysname] = dev
+	}
+	return dev
+}
+
+// claim gives a device to its owner and adds the nodes seen so far.
+func (c *deviceCorrelator) claim(dev *inputDevice, owner *deviceOwner) {
+	if dev.owner != nil {
+		if dev.owner.container != owner.container {
+			glog.Errorf("device %s is claimed by container %s, already owned by container %s", dev.sysname, owner.container, dev.owner.container)
+		}
+		return
+	}
+	dev.owner = owner
+	c.dirty = true
+	for devicePath, node := range dev.nodes {
+		c.addNode(owner, devicePath, node)
+	}
+}
+
+func (c *deviceCorrelator) addNode(owner *deviceOwner, devicePath string, node deviceNode) {
+	for _, containerID := range owner.containers {
+		c.addToContainer(containerID, devicePath, node)
+	}
+	glog.Infof("added device %s to %d containers", devicePath, len(owner.containers))
+}
+
+// addToContainer queues the grant of a node to a container.
+func (c *deviceCorrelator) addToContainer(containerID, devicePath string, node deviceNode) {
+	c.queue.run(containerID, func() {
+		addDeviceToContainer(c.rt, c.cgroups, containerID, devicePath, node.major, node.minor, c.nodeOpts)
+	})
+}
+
+// removeFromContainer queues the revocation of a node from a container.
+func (c *deviceCorrelator) removeFromContainer(containerID, devicePath string, node deviceNode) {
+	c.queue.run(containerID, func() {
+		removeDeviceFromContainer(c.rt, c.cgroups, containerID, devicePath, node.major, node.minor, c.nodeOpts)
+	})
+}
+
+// containerExited revokes the grants tied to a container that exited. The
+// devices created by the container are revoked from the other containers of
+// its pod, the grants of the exited container itself are dropped since its
+// cgroup and /dev are gone with it.
+func (c *deviceCorrelator) containerExited(containerID string) {
+	delete(c.trackers, containerID)
+
+	for _, dev := range c.devices {
+		if dev.owner == nil {
+			continue
+		}
+		if dev.owner.container == containerID {
+			for _, otherID := range dev.owner.containers {
+				if otherID == containerID {
+					continue
+				}
+				for devicePath, node := range dev.nodes {
+					c.removeFromContainer(otherID, devicePath, node)
+				}
+			}
+			glog.Infof("revoked device %s of exited container %s from %d containers", dev.sysname, containerID, len(dev.owner.containers)-1)
+			dev.owner = nil
+			c.dirty = true
+			continue
+		}
+		for i, otherID := range dev.owner.containers {
+			if otherID == containerID {
+				dev.owner.containers = append(dev.owner.containers[:i], dev.owner.containers[i+1:]...)
+				glog.Infof("dropped grant of device %s to exited container %s", dev.sysname, containerID)
+				c.dirty = true
+				break
+			}
+		}
+	}
+
+	for sysname, dev := range c.devices {
+		if dev.owner == nil && len(dev.nodes) == 0 {
+			delete(c.devices, sysname)
+		}
+	}
+}
+
+// collectGarbage drops the grants of the containers that are not running,
+// for the exits missed by the events.
+func (c *deviceCorrelator) collectGarbage() {
+	running, err := listRunningContainerIDs(c.rt)
+	if err != nil {
+		glog.Errorf("failed to collect grants of stopped containers: %v", err)
+		return
+	}
+	exited := make(map[string]bool)
+	for _, dev := range c.devices {
+		if dev.owner == nil {
+			continue
+		}
+		for _, containerID := range append([]string{dev.owner.container}, dev.owner.containers...) {
+			if !running[containerID] {
+				exited[containerID] = true
+			}
+		}
+	}
+	for containerID := range exited {
+		glog.Infof("collecting grants of container %s, it is not running", containerID)
+		c.containerExited(containerID)
+	}
+}
+
+// restore loads the grants of the state file and reconciles them with the
+// running containers and the devices in sysfs.
+func (c *deviceCorrelator) restore() {
+	if c.statePath == "" {
+		return
+	}
+	state, err := loadMonitorState(c.statePath)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return
+	}
+	running, err := listRunningContainerIDs(c.rt)
+	if err != nil {
+		glog.Warningf("not revoking grants of stopped containers: %v", err)
+	}
+	c.reconcile(state, running)
+	c.saveState()
+}
+
+// reconcile restores the grants of a saved state. Grants of containers that
+// are gone are dropped, grants of devices that are gone or changed are
+// revoked, and the others are applied again in case they were lost. When
+// running is nil, the containers are assumed to be running.
+func (c *deviceCorrelator) reconcile(state *monitorState, running map[string]bool) {
+	sysDir := path.Join(c.sysFSPrefix, "sys")
+	devices := make(map[string]*UinputDevice)
+	var valid []deviceGrant
+	for _, grant := range state.Grants {
+		if running != nil && !running[grant.Container] {
+			glog.Infof("dropping grant of device %s to container %s, the container is gone", grant.DevicePath, grant.Container)
+			c.dirty = true
+			continue
+		}
+		device, ok := devices[grant.Sysname]
+		if !ok {
+			device, _ = readUinputDevice(sysDir, grant.Sysname)
+			devices[grant.Sysname] = device
+		}
+		if !hasDeviceNode(device, grant) {
+			// Revoke before applying the valid grants, the device numbers
+			// may have been reused by another device since. The changes of
+			// a container are applied in order.
+			glog.Infof("revoking device %s %d:%d from container %s, the device is gone", grant.DevicePath, grant.Major, grant.Minor, grant.Container)
+			c.removeFromContainer(grant.Container, grant.DevicePath, deviceNode{major: grant.Major, minor: grant.Minor})
+			c.dirty = true
+			continue
+		}
+		valid = append(valid, grant)
+	}
+
+	for _, grant := range valid {
+		dev := c.device(grant.Sysname)
+		if dev.owner == nil {
+			dev.owner = &deviceOwner{
+				container: grant.Owner,
+				mode:      grant.Mode,
+			}
+		}
+		if !containsString(dev.owner.containers, grant.Container) {
+			dev.owner.containers = append(dev.owner.containers, grant.Container)
+		}
+		node := deviceNode{major: grant.Major, minor: grant.Minor}
+		dev.nodes[grant.DevicePath] = node
+		c.addToContainer(grant.Container, grant.DevicePath, node)
+	}
+	glog.Infof("restored %d of %d device grants from %s", len(valid), len(state.Grants), c.statePath)
+}
+
+// state returns the grants of the owned devices.
+func (c *deviceCorrelator) state() *monitorState {
+	state := &monitorState{Grants: []deviceGrant{}}
+	for _, dev := range c.devices {
+		if dev.owner == nil {
+			continue
+		}
+		for devicePath, node := range dev.nodes {
+			for _, containerID := range dev.owner.containers {
+				state.Grants = append(state.Grants, deviceGrant{
+					Container:  containerID,
+					Owner:      dev.owner.container,
+					Mode:       dev.owner.mode,
+					Sysname:    dev.sysname,
+					DevicePath: devicePath,
+					Major:      node.major,
+					Minor:      node.minor,
+				})
+			}
+		}
+	}
+	sort.Slice(state.Grants, func(i, j int) bool {
+		a, b := state.Grants[i], state.Grants[j]
+		if a.DevicePath != b.DevicePath {
+			return a.DevicePath < b.DevicePath
+		}
+		return a.Container < b.Container
+	})
+	return state
+}
+
+// saveState writes the state file when the grants changed.
+func (c *deviceCorrelator) saveState() {
+	if !c.dirty || c.statePath == "" {
+		return
+	}
+	if err := c.state().save(c.statePath); err != nil {
+		glog.Errorf("%v", err)
+		return
+	}
+	c.dirty = false
+}
+
+func hasDeviceNode(device *UinputDevice, grant deviceGrant) bool {
+	if device == nil {
+		return false
+	}
+	for _, node := range device.Nodes {
+		if path.Join("/dev", node.DevName) == grant.DevicePath && int(node.Major) == grant.Major && int(node.Minor) == grant.Minor {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNodeEvent returns the device and node of a udev event of a uinput
+// device node.
+func parseNodeEvent(data map[string]string) (string, string, deviceNode, bool) {
+	devPath := data["path"]
+	if path.Dir(path.Dir(devPath)) != virtualInputDevPath || data["devname"] == "" {
+		return "", "", deviceNode{}, false
+	}
+	major, err := strconv.Atoi(data["major"])
+	if err != nil {
+		return "", "", deviceNode{}, false
+	}
+	minor, err := strconv.Atoi(data["minor"])
+	if err != nil {
+		return "", "", deviceNode{}, false
+	}
+	return path.Base(path.Dir(devPath)), path.Join("/dev", data["devname"]), deviceNode{major: major, minor: minor}, true
+}
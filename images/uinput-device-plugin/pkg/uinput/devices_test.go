@@ -0,0 +1,855 @@
+package uinput
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeRuntime is a ContainerRuntime with a fixed set of running containers.
+// The device nodes are created through Exec since the containers have no
+// pid.
+type fakeRuntime struct {
+	ContainerRuntime
+	containers []PodContainer
+	// podContainers holds the requests for the containers of a pod until it
+	// is closed, when not nil.
+	podContainers chan struct{}
+}
+
+func (rt *fakeRuntime) ListContainers(ctx context.Context) ([]string, error) {
+	var containerIDs []string
+	for _, container := range rt.containers {
+		containerIDs = append(containerIDs, container.ID)
+	}
+	return containerIDs, nil
+}
+
+func (rt *fakeRuntime) PodContainers(ctx context.Context, containerID string) ([]PodContainer, error) {
+	if rt.podContainers != nil {
+		<-rt.podContainers
+	}
+	for _, self := range rt.containers {
+		if self.ID != containerID {
+			continue
+		}
+		var containers []PodContainer
+		for _, container := range rt.containers {
+			if container.PodUID == self.PodUID {
+				containers = append(containers, container)
+			}
+		}
+		return containers, nil
+	}
+	return nil, fmt.Errorf("container %s not found", containerID)
+}
+
+func (rt *fakeRuntime) ContainerPid(ctx context.Context, containerID string) (int, error) {
+	return 0, fmt.Errorf("container %s has no pid", containerID)
+}
+
+func (rt *fakeRuntime) Exec(ctx context.Context, containerID string, cmd []string) error {
+	return nil
+}
+
+// fakeCgroup records the device rules written for each container.
+type fakeCgroup struct {
+	mu    sync.Mutex
+	rules map[string][]string
+}
+
+func (cg *fakeCgroup) Allow(containerID string, devMajor, devMinor int) error {
+	cg.write(containerID, fmt.Sprintf("allow %d:%d", devMajor, devMinor))
+	return nil
+}
+
+func (cg *fakeCgroup) Deny(containerID string, devMajor, devMinor int) error {
+	cg.write(containerID, fmt.Sprintf("deny %d:%d", devMajor, devMinor))
+	return nil
+}
+
+func (cg *fakeCgroup) write(containerID, rule string) {
+	cg.mu.Lock()
+	defer cg.mu.Unlock()
+	cg.rules[containerID] = append(cg.rules[containerID], rule)
+}
+
+// fakeUinputFds are the uinput file descriptors of the processes of the
+// containers, with the sysfs names of the devices created on them.
+type fakeUinputFds struct {
+	mu  sync.Mutex
+	fds map[string]map[uinputFd]string
+}
+
+func (f *fakeUinputFds) set(containerID string, ufd uinputFd, sysname string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fds[containerID] == nil {
+		f.fds[containerID] = make(map[uinputFd]string)
+	}
+	if sysname == "" {
+		delete(f.fds[containerID], ufd)
+		return
+	}
+	f.fds[containerID][ufd] = sysname
+}
+
+// tracker returns a tracker of the descriptors of a container.
+func (f *fakeUinputFds) tracker(sysDir, containerID string) *uinputTracker {
+	return &uinputTracker{
+		sysDir: sysDir,
+		fds: func() (map[uinputFd]bool, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			fds := make(map[uinputFd]bool)
+			for ufd := range f.fds[containerID] {
+				fds[ufd] = true
+			}
+			return fds, nil
+		},
+		sysname: func(ufd uinputFd) (string, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			sysname, ok := f.fds[containerID][ufd]
+			if !ok {
+				return "", syscall.EBADF
+			}
+			return sysname, nil
+		},
+		devices: make(map[uinputFd]*UinputDevice),
+	}
+}
+
+func newTestCorrelator(rt *fakeRuntime, sysFSPrefix string, fds *fakeUinputFds) (*deviceCorrelator, *fakeCgroup) {
+	cgroups := &fakeCgroup{rules: make(map[string][]string)}
+	c := &deviceCorrelator{
+		rt:          rt,
+		cgroups:     cgroups,
+		sysFSPrefix: sysFSPrefix,
+		queue:       newContainerQueue(),
+		resolves:    newContainerQueue(),
+		resolved:    make(chan MonitorEvent),
+		trackers:    make(map[string]*uinputTracker),
+		devices:     make(map[string]*inputDevice),
+	}
+	for _, container := range rt.containers {
+		c.trackers[container.ID] = fds.tracker(filepath.Join(sysFSPrefix, "sys"), container.ID)
+	}
+	return c, cgroups
+}
+
+// handleEvents handles the events in order, with the devices found after
+// each trigger as the event loop does, and waits for the grants to be
+// applied.
+func handleEvents(c *deviceCorrelator, events []MonitorEvent) {
+	for _, event := range events {
+		c.handle(event)
+		handleResolved(c)
+	}
+	c.queue.wait()
+}
+
+// handleResolved handles the devices found after the pending triggers.
+func handleResolved(c *deviceCorrelator) {
+	resolved := make(chan struct{})
+	go func() {
+		c.resolves.wait()
+		close(resolved)
+	}()
+	for {
+		select {
+		case event := <-c.resolved:
+			c.handle(event)
+		case <-resolved:
+			return
+		}
+	}
+}
+
+// writeTestUinputDevice creates the sysfs directory of a uinput device under
+// a sysfs prefix.
+func writeTestUinputDevice(t *testing.T, sysFSPrefix string, device *UinputDevice) {
+	dir := filepath.Join(sysFSPrefix, "sys", virtualInputDevPath, device.Sysname)
+	files := map[string]string{
+		"name":       device.Name + "\n",
+		"id/vendor":  fmt.Sprintf("%04x\n", device.Vendor),
+		"id/product": fmt.Sprintf("%04x\n", device.Product),
+	}
+	for _, node := range device.Nodes {
+		files[filepath.Join(filepath.Base(node.DevName), "uevent")] = fmt.Sprintf("MAJOR=%d\nMINOR=%d\nDEVNAME=%s\n", node.Major, node.Minor, node.DevName)
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testUinputDevice(sysname, devName string, major, minor uint32) *UinputDevice {
+	return &UinputDevice{
+		SysPath: filepath.Join("/sys", virtualInputDevPath, sysname),
+		Sysname: sysname,
+		Name:    "Virtual Input Mouse",
+		Vendor:  0x1234,
+		Product: 0x5678,
+		Nodes:   []*UinputDeviceNode{{DevName: devName, Major: major, Minor: minor}},
+	}
+}
+
+func triggerEvent(eventType EventType, containerID, mode string) MonitorEvent {
+	return MonitorEvent{
+		Type: eventType,
+		Data: map[string]string{
+			"container": containerID,
+			"mode":      mode,
+		},
+	}
+}
+
+func deviceEvent(eventType EventType, containerID, mode string, device *UinputDevice) MonitorEvent {
+	event := triggerEvent(eventType, containerID, mode)
+	event.Device = device
+	return event
+}
+
+func nodeEvent(eventType EventType, sysname, devName string, major, minor int) MonitorEvent {
+	return MonitorEvent{
+		Type: eventType,
+		Data: map[string]string{
+			"path":    filepath.Join(virtualInputDevPath, sysname, filepath.Base(devName)),
+			"devname": devName,
+			"major":   fmt.Sprint(major),
+			"minor":   fmt.Sprint(minor),
+		},
+	}
+}
+
+func TestDeviceCorrelator(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	mouse := testUinputDevice("input12", "input/event5", 13, 69)
+	writeTestUinputDevice(t, sysFSPrefix, mouse)
+	fds := &fakeUinputFds{fds: make(map[string]map[uinputFd]string)}
+	fds.set("app", uinputFd{Pid: 100, Fd: 3}, "input12")
+
+	rt := &fakeRuntime{containers: []PodContainer{
+		{ID: "app", Name: "app", PodUID: "pod-a"},
+		{ID: "desktop", Name: "desktop", PodUID: "pod-a"},
+		{ID: "other", Name: "other", PodUID: "pod-b"},
+	}}
+	const (
+		containerMode = "CONTAINER"
+		podMode       = "POD"
+	)
+	added := nodeEvent(EventTypeUdevDeviceAdded, "input12", "input/event5", 13, 69)
+	removed := nodeEvent(EventTypeUdevDeviceRemoved, "input12", "input/event5", 13, 69)
+
+	tests := []struct {
+		name   string
+		events []MonitorEvent
+		// want are the rules written for each container.
+		want map[string][]string
+		// owner is the container owning input12 after the events.
+		owner string
+	}{
+		{
+			name: "helper before udev",
+			events: []MonitorEvent{
+				triggerEvent(EventTypeUdevDeviceOpened, "app", containerMode),
+				added,
+			},
+			want:  map[string][]string{"app": {"allow 13:69"}},
+			owner: "app",
+		},
+		{
+			name: "udev before helper",
+			events: []MonitorEvent{
+				added,
+				triggerEvent(EventTypeUdevDeviceOpened, "app", containerMode),
+			},
+			want:  map[string][]string{"app": {"allow 13:69"}},
+			owner: "app",
+		},
+		{
+			name: "trigger of another container",
+			events: []MonitorEvent{
+				added,
+				// The helper of the other container reports the device,
+				// its processes have no descriptor of it.
+				triggerEvent(EventTypeUdevDeviceOpened, "other", containerMode),
+			},
+			want: map[string][]string{},
+		},
+		{
+			name: "device of another container",
+			events: []MonitorEvent{
+				triggerEvent(EventTypeUdevDeviceOpened, "app", containerMode),
+				added,
+				deviceEvent(EventTypeUinputDeviceCreated, "other", containerMode, mouse),
+			},
+			want:  map[string][]string{"app": {"allow 13:69"}},
+			owner: "app",
+		},
+		{
+			name: "pod mode",
+			events: []MonitorEvent{
+				triggerEvent(EventTypeUdevDeviceOpened, "app", podMode),
+				added,
+			},
+			want: map[string][]string{
+				"app":     {"allow 13:69"},
+				"desktop": {"allow 13:69"},
+			},
+			owner: "app",
+		},
+		{
+			name: "removed",
+			events: []MonitorEvent{
+				triggerEvent(EventTypeUdevDeviceOpened, "app", containerMode),
+				added,
+				removed,
+				added,
+			},
+			// The device is forgotten with its last node, the same node
+			// seen again is not given to the former owner.
+			want: map[string][]string{"app": {"allow 13:69", "deny 13:69"}},
+		},
+		{
+			name: "destroyed",
+			events: []MonitorEvent{
+				triggerEvent(EventTypeUdevDeviceOpened, "app", podMode),
+				deviceEvent(EventTypeUinputDeviceDestroyed, "other", podMode, mouse),
+				deviceEvent(EventTypeUinputDeviceDestroyed, "app", podMode, mouse),
+			},
+			want: map[string][]string{
+				"app":     {"allow 13:69", "deny 13:69"},
+				"desktop": {"allow 13:69", "deny 13:69"},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cgroups := newTestCorrelator(rt, sysFSPrefix, fds)
+			handleEvents(c, tc.events)
+			if !reflect.DeepEqual(cgroups.rules, tc.want) {
+				t.Errorf("rules = %v, want %v", cgroups.rules, tc.want)
+			}
+			owner := ""
+			if dev, ok := c.devices["input12"]; ok && dev.owner != nil {
+				owner = dev.owner.container
+			}
+			if owner != tc.owner {
+				t.Errorf("owner of input12 = '%s', want '%s'", owner, tc.owner)
+			}
+		})
+	}
+}
+
+func TestDeviceCorrelatorClose(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input12", "input/event5", 13, 69))
+	fds := &fakeUinputFds{fds: make(map[string]map[uinputFd]string)}
+	ufd := uinputFd{Pid: 100, Fd: 3}
+	fds.set("app", ufd, "input12")
+	rt := &fakeRuntime{containers: []PodContainer{{ID: "app", Name: "app", PodUID: "pod-a"}}}
+	c, cgroups := newTestCorrelator(rt, sysFSPrefix, fds)
+
+	handleEvents(c, []MonitorEvent{triggerEvent(EventTypeUdevDeviceOpened, "app", "CONTAINER")})
+	if rules := cgroups.rules["app"]; !reflect.DeepEqual(rules, []string{"allow 13:69"}) {
+		t.Fatalf("rules after open = %v, want allow", rules)
+	}
+
+	fds.set("app", ufd, "")
+	handleEvents(c, []MonitorEvent{triggerEvent(EventTypeUdevDeviceClosed, "app", "CONTAINER")})
+	if rules := cgroups.rules["app"]; !reflect.DeepEqual(rules, []string{"allow 13:69", "deny 13:69"}) {
+		t.Errorf("rules after close = %v, want allow and deny", rules)
+	}
+	if len(c.devices) != 0 {
+		t.Errorf("devices after close = %v, want none", c.devices)
+	}
+}
+
+func TestDeviceCorrelatorClaim(t *testing.T) {
+	c, cgroups := newTestCorrelator(&fakeRuntime{}, t.TempDir(), nil)
+	dev := c.device("input12")
+	c.addDeviceNode(dev, "/dev/input/event5", deviceNode{major: 13, minor: 69})
+	c.addDeviceNode(dev, "/dev/input/js0", deviceNode{major: 13, minor: 0})
+	if c.dirty {
+		t.Errorf("unowned nodes marked the state dirty")
+	}
+
+	owner := &deviceOwner{container: "app", containers: []string{"app", "desktop"}}
+	c.claim(dev, owner)
+	c.claim(dev, &deviceOwner{container: "other", containers: []string{"other"}})
+	c.queue.wait()
+
+	if dev.owner != owner {
+		t.Errorf("owner = %+v, want %+v", dev.owner, owner)
+	}
+	if !c.dirty {
+		t.Errorf("claim did not mark the state dirty")
+	}
+	for _, containerID := range []string{"app", "desktop"} {
+		rules := append([]string(nil), cgroups.rules[containerID]...)
+		want := []string{"allow 13:0", "allow 13:69"}
+		if len(rules) == 2 && rules[0] > rules[1] {
+			rules[0], rules[1] = rules[1], rules[0]
+		}
+		if !reflect.DeepEqual(rules, want) {
+			t.Errorf("rules of %s = %v, want %v", containerID, rules, want)
+		}
+	}
+	if rules := cgroups.rules["other"]; len(rules) > 0 {
+		t.Errorf("rules of other = %v, want none", rules)
+	}
+}
+
+func TestDeviceCorrelatorReconcile(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input12", "input/event5", 13, 69))
+	// The numbers of the node of input14 changed since the state was saved.
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input14", "input/event7", 13, 72))
+	grant := func(containerID, sysname, devicePath string, minor int) deviceGrant {
+		return deviceGrant{
+			Container:  containerID,
+			Owner:      "app",
+			Mode:       "POD",
+			Sysname:    sysname,
+			DevicePath: devicePath,
+			Major:      13,
+			Minor:      minor,
+		}
+	}
+	state := &monitorState{Grants: []deviceGrant{
+		grant("app", "input12", "/dev/input/event5", 69),
+		grant("desktop", "input12", "/dev/input/event5", 69),
+		grant("exited", "input12", "/dev/input/event5", 69),
+		// input13 is gone.
+		grant("app", "input13", "/dev/input/event6", 70),
+		grant("app", "input14", "/dev/input/event7", 71),
+	}}
+	rt := &fakeRuntime{containers: []PodContainer{
+		{ID: "app", Name: "app", PodUID: "pod-a"},
+		{ID: "desktop", Name: "desktop", PodUID: "pod-a"},
+	}}
+
+	for _, tc := range []struct {
+		name    string
+		running map[string]bool
+		// want are the rules written for each container.
+		want map[string][]string
+		// grants are the grants after the reconciliation.
+		grants []deviceGrant
+	}{
+		{
+			name:    "running containers",
+			running: map[string]bool{"app": true, "desktop": true},
+			want: map[string][]string{
+				// The revocations come first, the numbers may have been
+				// reused by the valid grants.
+				"app":     {"deny 13:70", "deny 13:71", "allow 13:69"},
+				"desktop": {"allow 13:69"},
+			},
+			grants: []deviceGrant{state.Grants[0], state.Grants[1]},
+		},
+		{
+			name: "unknown containers",
+			want: map[string][]string{
+				"app":     {"deny 13:70", "deny 13:71", "allow 13:69"},
+				"desktop": {"allow 13:69"},
+				"exited":  {"allow 13:69"},
+			},
+			grants: []deviceGrant{state.Grants[0], state.Grants[1], state.Grants[2]},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cgroups := newTestCorrelator(rt, sysFSPrefix, nil)
+			c.reconcile(state, tc.running)
+			c.queue.wait()
+			if !reflect.DeepEqual(cgroups.rules, tc.want) {
+				t.Errorf("rules = %v, want %v", cgroups.rules, tc.want)
+			}
+			if got := c.state().Grants; !reflect.DeepEqual(got, tc.grants) {
+				t.Errorf("grants = %+v, want %+v", got, tc.grants)
+			}
+			if !c.dirty {
+				t.Errorf("reconcile() did not mark the state dirty")
+			}
+		})
+	}
+}
+
+func TestDeviceCorrelatorRestore(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input12", "input/event5", 13, 69))
+	valid := deviceGrant{
+		Container:  "app",
+		Owner:      "app",
+		Mode:       "CONTAINER",
+		Sysname:    "input12",
+		DevicePath: "/dev/input/event5",
+		Major:      13,
+		Minor:      69,
+	}
+	stale := valid
+	stale.Container = "exited"
+	stale.Owner = "exited"
+	rt := &fakeRuntime{containers: []PodContainer{{ID: "app", Name: "app", PodUID: "pod-a"}}}
+
+	statePath := filepath.Join(t.TempDir(), "monitor_state.json")
+	if err := (&monitorState{Grants: []deviceGrant{stale, valid}}).save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	c, cgroups := newTestCorrelator(rt, sysFSPrefix, nil)
+	c.statePath = statePath
+	c.restore()
+	c.queue.wait()
+
+	if want := map[string][]string{"app": {"allow 13:69"}}; !reflect.DeepEqual(cgroups.rules, want) {
+		t.Errorf("rules = %v, want %v", cgroups.rules, want)
+	}
+	// The grants of the containers that are gone are dropped from the
+	// state file.
+	state, err := loadMonitorState(statePath)
+	if err != nil {
+		t.Fatalf("loadMonitorState() failed: %v", err)
+	}
+	if want := []deviceGrant{valid}; !reflect.DeepEqual(state.Grants, want) {
+		t.Errorf("saved grants = %+v, want %+v", state.Grants, want)
+	}
+	if c.dirty {
+		t.Errorf("state is dirty after it was saved")
+	}
+
+	// Without a state file, nothing is restored nor saved.
+	statePath = filepath.Join(t.TempDir(), "monitor_state.json")
+	c, cgroups = newTestCorrelator(rt, sysFSPrefix, nil)
+	c.statePath = statePath
+	c.restore()
+	c.queue.wait()
+	if len(cgroups.rules) != 0 || len(c.devices) != 0 {
+		t.Errorf("restored rules %v and devices %v without a state file", cgroups.rules, c.devices)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("state file saved without grants: %v", err)
+	}
+}
+
+func TestDeviceCorrelatorState(t *testing.T) {
+	c, _ := newTestCorrelator(&fakeRuntime{}, t.TempDir(), nil)
+	owner := &deviceOwner{container: "app", mode: "POD", containers: []string{"desktop", "app"}}
+	for _, node := range []struct {
+		sysname    string
+		devicePath string
+		minor      int
+	}{
+		{"input13", "/dev/input/event6", 70},
+		{"input12", "/dev/input/event5", 69},
+	} {
+		dev := c.device(node.sysname)
+		dev.owner = owner
+		dev.nodes[node.devicePath] = deviceNode{major: 13, minor: node.minor}
+	}
+	// Unowned devices have no grants.
+	c.device("input14").nodes["/dev/input/event7"] = deviceNode{major: 13, minor: 71}
+
+	var got []string
+	for _, grant := range c.state().Grants {
+		got = append(got, fmt.Sprintf("%s %s %s %s", grant.DevicePath, grant.Container, grant.Owner, grant.Sysname))
+	}
+	want := []string{
+		"/dev/input/event5 app app input12",
+		"/dev/input/event5 desktop app input12",
+		"/dev/input/event6 app app input13",
+		"/dev/input/event6 desktop app input13",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("grants = %v, want %v", got, want)
+	}
+	if grants := (&deviceCorrelator{devices: map[string]*inputDevice{}}).state().Grants; grants == nil {
+		t.Errorf("grants of an empty state are nil, want an empty list")
+	}
+}
+
+func TestDeviceCorrelatorSlowRuntime(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input12", "input/event5", 13, 69))
+	fds := &fakeUinputFds{fds: make(map[string]map[uinputFd]string)}
+	fds.set("app", uinputFd{Pid: 100, Fd: 3}, "input12")
+	rt := &fakeRuntime{
+		containers: []PodContainer{
+			{ID: "app", Name: "app", PodUID: "pod-a"},
+			{ID: "desktop", Name: "desktop", PodUID: "pod-a"},
+		},
+		podContainers: make(chan struct{}),
+	}
+	c, cgroups := newTestCorrelator(rt, sysFSPrefix, fds)
+
+	// The pod of the container is found apart from the event loop, which
+	// keeps handling the udev events meanwhile.
+	handled := make(chan struct{})
+	go func() {
+		c.handle(triggerEvent(EventTypeUdevDeviceOpened, "app", "POD"))
+		c.handle(nodeEvent(EventTypeUdevDeviceAdded, "input12", "input/event5", 13, 69))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event loop blocked by the runtime requests")
+	}
+	close(rt.podContainers)
+	handleResolved(c)
+	c.queue.wait()
+
+	want := map[string][]string{
+		"app":     {"allow 13:69"},
+		"desktop": {"allow 13:69"},
+	}
+	if !reflect.DeepEqual(cgroups.rules, want) {
+		t.Errorf("rules = %v, want %v", cgroups.rules, want)
+	}
+}
+
+// newExitTestCorrelator returns a correlator with input12 created by app and
+// given to its pod, and input13 created by other.
+func newExitTestCorrelator(rt *fakeRuntime) (*deviceCorrelator, *fakeCgroup) {
+	c, cgroups := newTestCorrelator(rt, "", &fakeUinputFds{})
+	app := c.device("input12")
+	app.owner = &deviceOwner{container: "app", mode: "POD", containers: []string{"app", "desktop"}}
+	app.nodes["/dev/input/event5"] = deviceNode{major: 13, minor: 69}
+	other := c.device("input13")
+	other.owner = &deviceOwner{container: "other", mode: "CONTAINER", containers: []string{"other"}}
+	other.nodes["/dev/input/event6"] = deviceNode{major: 13, minor: 70}
+	c.trackers["app"] = &uinputTracker{}
+	return c, cgroups
+}
+
+// grantedContainers returns the containers given each owned device.
+func grantedContainers(c *deviceCorrelator) map[string][]string {
+	granted := make(map[string][]string)
+	for _, grant := range c.state().Grants {
+		granted[grant.Sysname] = append(granted[grant.Sysname], grant.Container)
+	}
+	return granted
+}
+
+func TestDeviceCorrelatorContainerExited(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		container string
+		// want are the rules written for each container.
+		want map[string][]string
+		// granted are the containers given each device after the exit.
+		granted map[string][]string
+	}{
+		{
+			name:      "owner",
+			container: "app",
+			// The exited container is gone with its cgroup and /dev.
+			want:    map[string][]string{"desktop": {"deny 13:69"}},
+			granted: map[string][]string{"input13": {"other"}},
+		},
+		{
+			name:      "pod container",
+			container: "desktop",
+			want:      map[string][]string{},
+			granted:   map[string][]string{"input12": {"app"}, "input13": {"other"}},
+		},
+		{
+			name:      "unknown container",
+			container: "unknown",
+			want:      map[string][]string{},
+			granted:   map[string][]string{"input12": {"app", "desktop"}, "input13": {"other"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cgroups := newExitTestCorrelator(&fakeRuntime{})
+			c.handle(MonitorEvent{
+				Type: EventTypeContainerExited,
+				Data: map[string]string{"container": tc.container},
+			})
+			c.queue.wait()
+			if !reflect.DeepEqual(cgroups.rules, tc.want) {
+				t.Errorf("rules = %v, want %v", cgroups.rules, tc.want)
+			}
+			if granted := grantedContainers(c); !reflect.DeepEqual(granted, tc.granted) {
+				t.Errorf("granted = %v, want %v", granted, tc.granted)
+			}
+			if _, ok := c.trackers[tc.container]; ok {
+				t.Errorf("tracker of exited container %s is kept", tc.container)
+			}
+			// The device of an exited owner is kept until it is removed,
+			// without an owner.
+			if dev, ok := c.devices["input12"]; !ok || len(dev.nodes) != 1 {
+				t.Errorf("device input12 = %+v, want its node kept", dev)
+			}
+		})
+	}
+}
+
+func TestDeviceCorrelatorCollectGarbage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		running []string
+		want    map[string][]string
+		granted map[string][]string
+	}{
+		{
+			name:    "all running",
+			running: []string{"app", "desktop", "other"},
+			want:    map[string][]string{},
+			granted: map[string][]string{"input12": {"app", "desktop"}, "input13": {"other"}},
+		},
+		{
+			name:    "pod container stopped",
+			running: []string{"app", "other"},
+			want:    map[string][]string{},
+			granted: map[string][]string{"input12": {"app"}, "input13": {"other"}},
+		},
+		{
+			name:    "owners stopped",
+			running: []string{"desktop"},
+			want:    map[string][]string{"desktop": {"deny 13:69"}},
+			granted: map[string][]string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := &fakeRuntime{}
+			for _, containerID := range tc.running {
+				rt.containers = append(rt.containers, PodContainer{ID: containerID})
+			}
+			c, cgroups := newExitTestCorrelator(rt)
+			c.dirty = false
+			c.collectGarbage()
+			c.queue.wait()
+			if !reflect.DeepEqual(cgroups.rules, tc.want) {
+				t.Errorf("rules = %v, want %v", cgroups.rules, tc.want)
+			}
+			if granted := grantedContainers(c); !reflect.DeepEqual(granted, tc.granted) {
+				t.Errorf("granted = %v, want %v", granted, tc.granted)
+			}
+			if c.dirty != (len(tc.running) < 3) {
+				t.Errorf("dirty = %v after collecting %v", c.dirty, tc.running)
+			}
+		})
+	}
+}
+
+func TestSelectPodContainers(t *testing.T) {
+	podContainers := []PodContainer{
+		{ID: "app", Name: "app", PodName: "vdi-0", PodNamespace: "user-1", PodUID: testPodUID},
+		{ID: "desktop", Name: "desktop", PodName: "vdi-0", PodNamespace: "user-1", PodUID: testPodUID},
+		{ID: "webrtc", Name: "webrtc", PodName: "vdi-0", PodNamespace: "user-1", PodUID: testPodUID},
+	}
+	for _, tc := range []struct {
+		name      string
+		container string
+		pod       HelperPod
+		want      []string
+		err       bool
+	}{
+		{
+			name:      "all containers",
+			container: "app",
+			pod:       HelperPod{Name: "vdi-0", Namespace: "user-1", UID: testPodUID},
+			want:      []string{"app", "desktop", "webrtc"},
+		},
+		{
+			name:      "unset pod",
+			container: "app",
+			want:      []string{"app", "desktop", "webrtc"},
+		},
+		{
+			// The name is the hostname of the helper.
+			name:      "custom hostname",
+			container: "app",
+			pod:       HelperPod{Name: "desktop-host", Namespace: "user-1", UID: testPodUID},
+			want:      []string{"app", "desktop", "webrtc"},
+		},
+		{
+			name:      "name filter",
+			container: "app",
+			pod:       HelperPod{UID: testPodUID, ContainerNames: []string{"webrtc", "missing"}},
+			want:      []string{"app", "webrtc"},
+		},
+		{
+			name:      "creator always included",
+			container: "desktop",
+			pod:       HelperPod{ContainerNames: []string{"webrtc"}},
+			want:      []string{"desktop", "webrtc"},
+		},
+		{
+			name:      "uid mismatch",
+			container: "app",
+			pod:       HelperPod{Namespace: "user-1", UID: "7c9d0e4f-1a2b-4c3d-8e9f-0a1b2c3d4e5f"},
+			err:       true,
+		},
+		{
+			name:      "namespace mismatch",
+			container: "app",
+			pod:       HelperPod{Namespace: "user-2", UID: testPodUID},
+			err:       true,
+		},
+		{
+			name:      "container not in pod",
+			container: "other",
+			err:       true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := selectPodContainers(tc.container, podContainers, tc.pod)
+			if (err != nil) != tc.err {
+				t.Fatalf("selectPodContainers() returned error %v, want error %v", err, tc.err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("selectPodContainers() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContainerQueue(t *testing.T) {
+	q := newContainerQueue()
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	release := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		i := i
+		containerID := fmt.Sprint("container", i%3)
+		q.run(containerID, func() {
+			if i == 0 {
+				// The changes of the other containers are not held up.
+				<-release
+			}
+			mu.Lock()
+			got[containerID] = append(got[containerID], i)
+			mu.Unlock()
+		})
+	}
+	q.run("container1", func() {
+		close(release)
+	})
+	q.wait()
+
+	for containerID, order := range got {
+		for j := 1; j < len(order); j++ {
+			if order[j] < order[j-1] {
+				t.Errorf("changes of %s ran out of order: %v", containerID, order)
+				break
+			}
+		}
+	}
+	if len(got["container0"]) != 34 || len(got["container1"]) != 33 || len(got["container2"]) != 33 {
+		t.Errorf("ran %d, %d and %d changes, want 34, 33 and 33", len(got["container0"]), len(got["container1"]), len(got["container2"]))
+	}
+}
@@ -3,127 +3,141 @@ package uinput
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
-	"path/filepath"
-	"strconv"
 
 	types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	docker "github.com/docker/docker/client"
-	"github.com/golang/glog"
 )
 
-func findContainerWithMount(cli *docker.Client, sourcePath string) (*types.Container, error) {
-	ctx := context.Background()
-	list, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+// Label set by dockershim on the pause container of the pod sandboxes.
+const (
+	dockershimContainerTypeLabel = "io.kubernetes.docker.type"
+	dockershimSandboxType        = "podsandbox"
+)
+
+// dockerRuntime is a ContainerRuntime over the docker socket.
+type dockerRuntime struct {
+	cli *docker.Client
+}
+
+// NewDockerRuntime connects to docker with the settings of the environment.
+func NewDockerRuntime() (ContainerRuntime, error) {
+	cli, err := docker.NewEnvClient()
 	if err != nil {
 		return nil, err
 	}
-
-	for _, container := range list {
-		for _, mount := range container.Mounts {
-			if mount.Source == sourcePath {
-				return &container, nil
-			}
-		}
-	}
-	return nil, nil
+	return &dockerRuntime{cli: cli}, nil
 }
 
-func getPodContainerIDs(sysFSPrefix, testContainerID string) ([]string, error) {
-	containerIDs := []string{}
-	containerPathPattern := fmt.Sprintf("%s/sys/fs/cgroup/devices/kubepods/burstable/*/%s", sysFSPrefix, testContainerID)
-	files, err := filepath.Glob(containerPathPattern)
-	if err != nil || len(files) != 1 {
-		return containerIDs, fmt.Errorf("failed to glob path to find containers in pattern '%s': %v", containerPathPattern, err)
-	}
-	podPath := path.Dir(files[0])
-	podContainerPathPattern := path.Join(podPath, "*", "devices.allow")
-	files, err = filepath.Glob(podContainerPathPattern)
+func (rt *dockerRuntime) ListContainers(ctx context.Context) ([]string, error) {
+	list, err := rt.cli.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
-		return containerIDs, fmt.Errorf("failed to glob path to find pod containers in pattern '%s': %v", podContainerPathPattern, err)
+		return nil, err
 	}
-
-	for _, f := range files {
-		containerIDs = append(containerIDs, path.Base(path.Dir(f)))
+	var containerIDs []string
+	for _, container := range list {
+		containerIDs = append(containerIDs, container.ID)
 	}
 	return containerIDs, nil
 }
 
-func addDeviceToContainer(cli *docker.Client, containerID, devicePath, sysFSPrefix string, devMajor, devMinor int, deviceFileMode os.FileMode) {
-	// Add device to cgroup
-	cgroupPathPattern := fmt.Sprintf("%s/sys/fs/cgroup/devices/kubepods/burstable/*/%s/devices.allow", sysFSPrefix, containerID)
-	files, err := filepath.Glob(cgroupPathPattern)
+func (rt *dockerRuntime) FindContainerWithMount(ctx context.Context, hostPath string) (string, error) {
+	list, err := rt.cli.ContainerList(ctx, types.ContainerListOptions{})
 	if err != nil {
-		glog.Errorf("failed to glob path to find cgroup path in pattern '%s': %v", cgroupPathPattern, err)
+		return "", err
 	}
-	if len(files) == 1 {
-		// Write the device node to the devices.allow cgroup sys file.
-		cgroupPerms := fmt.Sprintf("c %d:%d rwm", devMajor, devMinor)
-		if err := ioutil.WriteFile(files[0], []byte(cgroupPerms), deviceFileMode); err != nil {
-			glog.Errorf("failed to write cgroup permissions to %s", cgroupPathPattern)
+
+	for _, container := range list {
+		for _, mount := range container.Mounts {
+			if mount.Source == hostPath {
+				return container.ID, nil
+			}
 		}
-	} else {
-		glog.Errorf("failed to find single cgroup devices.allow at: %s, expected 1, found %d", cgroupPathPattern, len(files))
 	}
+	return "", nil
+}
 
-	// Add device to container using docker exec.
-	cmd := []string{
-		"/bin/sh",
-		"-c",
-		fmt.Sprintf(
-			"mkdir -p /dev/input; mknod -m %s %s c %d %d",
-			strconv.FormatUint(uint64(deviceFileMode), 8),
-			devicePath,
-			devMajor,
-			devMinor,
-		),
+// PodContainers returns the running containers labeled with the pod UID of a
+// container, except for the pause container of the pod sandbox.
+func (rt *dockerRuntime) PodContainers(ctx context.Context, containerID string) ([]PodContainer, error) {
+	container, err := rt.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, err
 	}
-	if err := execContainer(cli, containerID, cmd); err != nil {
-		glog.Errorf("%v", err)
+	var podUID string
+	if container.Config != nil {
+		podUID = container.Config.Labels[kubernetesPodUIDLabel]
+	}
+	if len(podUID) == 0 {
+		return nil, fmt.Errorf("container %s is not in a kubernetes pod", containerID)
 	}
-}
 
-func removeDeviceFromContainer(cli *docker.Client, containerID, devicePath, sysFSPrefix string, devMajor, devMinor int, deviceFileMode os.FileMode) {
-	// Remove device from cgroup
-	cgroupPathPattern := fmt.Sprintf("%s/sys/fs/cgroup/devices/kubepods/burstable/*/%s/devices.deny", sysFSPrefix, containerID)
-	files, err := filepath.Glob(cgroupPathPattern)
+	list, err := rt.cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", kubernetesPodUIDLabel, podUID))),
+	})
 	if err != nil {
-		glog.Errorf("failed to glob path to find cgroup path in pattern '%s': %v", cgroupPathPattern, err)
+		return nil, err
 	}
-	if len(files) == 1 {
-		// Write the device node to the devices.deny cgroup sys file.
-		cgroupPerms := fmt.Sprintf("c %d:%d rwm", devMajor, devMinor)
-		if err := ioutil.WriteFile(files[0], []byte(cgroupPerms), deviceFileMode); err != nil {
-			glog.Errorf("failed to write cgroup permissions to %s", cgroupPathPattern)
+	var containers []PodContainer
+	for _, c := range list {
+		if c.Labels[dockershimContainerTypeLabel] == dockershimSandboxType {
+			continue
 		}
-	} else {
-		glog.Errorf("failed to find single cgroup devices.deny at: %s, expected 1, found %d", cgroupPathPattern, len(files))
+		containers = append(containers, PodContainer{
+			ID:           c.ID,
+			Name:         c.Labels[kubernetesContainerNameLabel],
+			PodName:      c.Labels[kubernetesPodNameLabel],
+			PodNamespace: c.Labels[kubernetesPodNamespaceLabel],
+			PodUID:       podUID,
+		})
 	}
+	return containers, nil
+}
 
-	// Remove device to container using docker exec.
-	cmd := []string{
-		"/bin/rm",
-		"-f",
-		devicePath,
+func (rt *dockerRuntime) ContainerPid(ctx context.Context, containerID string) (int, error) {
+	container, err := rt.cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return 0, err
 	}
-	if err := execContainer(cli, containerID, cmd); err != nil {
-		glog.Errorf("%v", err)
+	if container.State == nil || container.State.Pid == 0 {
+		return 0, fmt.Errorf("container %s is not running", containerID)
 	}
+	return container.State.Pid, nil
 }
 
-func execContainer(cli *docker.Client, containerID string, cmd []string) error {
-	ctx := context.Background()
-	createExecResp, err := cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+func (rt *dockerRuntime) Exec(ctx context.Context, containerID string, cmd []string) error {
+	createExecResp, err := rt.cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
 		User: "root",
 		Cmd:  cmd,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create container exec for container %s: %v", containerID, err)
 	}
-	if err := cli.ContainerExecStart(ctx, createExecResp.ID, types.ExecStartCheck{}); err != nil {
-		return fmt.Errorf("failed to exec rm in container %s: %v", containerID, err)
+	if err := rt.cli.ContainerExecStart(ctx, createExecResp.ID, types.ExecStartCheck{}); err != nil {
+		return fmt.Errorf("failed to exec %s in container %s: %v", cmd[0], containerID, err)
 	}
 	return nil
 }
+
+// WatchExits sends the containers that die or are destroyed, from the docker
+// events stream.
+func (rt *dockerRuntime) WatchExits(ctx context.Context, exits chan<- string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages, errs := rt.cli.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", events.ContainerEventType),
+			filters.Arg("event", "die"),
+			filters.Arg("event", "destroy"),
+		),
+	})
+	for {
+		select {
+		case msg := <-messages:
+			exits <- msg.Actor.ID
+		case err := <-errs:
+			return err
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/danisla/fsnotify"
@@ -12,7 +13,21 @@ import (
 	"google.golang.org/grpc"
 )
 
-func StartUdevDeviceWatch(socketPath, podName string) error {
+// HelperPod identifies the pod of a helper to the host service.
+type HelperPod struct {
+	Name      string
+	Namespace string
+	UID       string
+	// ContainerNames are the containers of the pod given the devices in pod
+	// mode, all containers when empty.
+	ContainerNames []string
+}
+
+// StartUdevDeviceWatch watches /dev/uinput and notifies the host service when
+// a process of the container opens or closes it. The host finds the devices
+// created and destroyed on the uinput file descriptors of the processes of
+// the container itself, and adds exactly those nodes to the container.
+func StartUdevDeviceWatch(socketPath string, pod HelperPod) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
@@ -39,9 +54,25 @@ func StartUdevDeviceWatch(socketPath, podName string) error {
 
 	glog.Infof("initialized uinput helper in plugin mode: %v", pluginMode)
 
-	cli := NewHostServiceClient(conn)
+	reporter := &uinputReporter{
+		cli:        NewHostServiceClient(conn),
+		pod:        pod,
+		pluginMode: pluginMode,
+	}
 
-	ctx := context.Background()
+	// Sending a trigger waits for the host, so it runs apart from the
+	// watcher, which must keep reading events to not overflow the inotify
+	// queue.
+	triggers := newUinputTriggerQueue()
+	go func() {
+		for {
+			if op := triggers.pop(); op == fsnotify.Open {
+				reporter.opened()
+			} else {
+				reporter.closed()
+			}
+		}
+	}()
 
 	done := make(chan bool)
 	go func() {
@@ -54,23 +85,9 @@ func StartUdevDeviceWatch(socketPath, podName string) error {
 				// Note requires fsnotify fork from https://github.com/nsaway/fsnotify
 				// to support device Open and CloseWrite events.
 				if event.Op&fsnotify.Open == fsnotify.Open {
-					glog.Infof("saw uinput device open, sending message to control socket")
-					_, err := cli.UinputTriggerOpen(ctx, &UinputTriggerMessage{
-						PodName:    podName,
-						PluginMode: pluginMode,
-					})
-					if err != nil {
-						glog.Errorf("failed to send message: %v", err)
-					}
+					triggers.push(fsnotify.Open)
 				} else if event.Op&fsnotify.CloseWrite == fsnotify.CloseWrite {
-					glog.Infof("saw uinput device close, sending message to control socket")
-					_, err := cli.UinputTriggerClose(ctx, &UinputTriggerMessage{
-						PodName:    podName,
-						PluginMode: pluginMode,
-					})
-					if err != nil {
-						glog.Errorf("failed to send message: %v", err)
-					}
+					triggers.push(fsnotify.CloseWrite)
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
@@ -88,3 +105,72 @@ func StartUdevDeviceWatch(socketPath, podName string) error {
 	<-done
 	return nil
 }
+
+// uinputTriggerQueue queues the opens and closes of /dev/uinput in order,
+// without bound so that pushing never blocks.
+type uinputTriggerQueue struct {
+	mu    sync.Mutex
+	ops   []fsnotify.Op
+	ready chan struct{}
+}
+
+func newUinputTriggerQueue() *uinputTriggerQueue {
+	return &uinputTriggerQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *uinputTriggerQueue) push(op fsnotify.Op) {
+	q.mu.Lock()
+	q.ops = append(q.ops, op)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for and removes the oldest trigger.
+func (q *uinputTriggerQueue) pop() fsnotify.Op {
+	for {
+		q.mu.Lock()
+		if len(q.ops) > 0 {
+			op := q.ops[0]
+			q.ops = q.ops[1:]
+			q.mu.Unlock()
+			return op
+		}
+		q.mu.Unlock()
+		<-q.ready
+	}
+}
+
+// uinputReporter sends the opens and closes of /dev/uinput to the host
+// service.
+type uinputReporter struct {
+	cli        HostServiceClient
+	pod        HelperPod
+	pluginMode UinputTriggerMessage_PluginMode
+}
+
+func (r *uinputReporter) opened() {
+	glog.Infof("saw uinput device open, sending message to control socket")
+	if _, err := r.cli.UinputTriggerOpen(context.Background(), r.triggerMessage()); err != nil {
+		glog.Errorf("failed to send message: %v", err)
+	}
+}
+
+func (r *uinputReporter) closed() {
+	glog.Infof("saw uinput device close, sending message to control socket")
+	if _, err := r.cli.UinputTriggerClose(context.Background(), r.triggerMessage()); err != nil {
+		glog.Errorf("failed to send message: %v", err)
+	}
+}
+
+func (r *uinputReporter) triggerMessage() *UinputTriggerMessage {
+	return &UinputTriggerMessage{
+		PodName:        r.pod.Name,
+		PodNamespace:   r.pod.Namespace,
+		PodUID:         r.pod.UID,
+		ContainerNames: r.pod.ContainerNames,
+		PluginMode:     r.pluginMode,
+	}
+}
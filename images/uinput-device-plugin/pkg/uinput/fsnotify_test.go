@@ -0,0 +1,45 @@
+package uinput
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danisla/fsnotify"
+)
+
+func TestUinputTriggerQueue(t *testing.T) {
+	q := newUinputTriggerQueue()
+
+	// Pushing does not wait for the triggers to be resolved.
+	var want []fsnotify.Op
+	for i := 0; i < 1000; i++ {
+		op := fsnotify.Open
+		if i%3 == 2 {
+			op = fsnotify.CloseWrite
+		}
+		q.push(op)
+		want = append(want, op)
+	}
+	for i, op := range want {
+		if got := q.pop(); got != op {
+			t.Fatalf("pop() %d = %v, want %v", i, got, op)
+		}
+	}
+
+	popped := make(chan fsnotify.Op)
+	go func() { popped <- q.pop() }()
+	select {
+	case op := <-popped:
+		t.Fatalf("pop() of an empty queue returned %v", op)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.push(fsnotify.CloseWrite)
+	select {
+	case op := <-popped:
+		if op != fsnotify.CloseWrite {
+			t.Errorf("pop() = %v, want %v", op, fsnotify.CloseWrite)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pop() did not return after a push")
+	}
+}
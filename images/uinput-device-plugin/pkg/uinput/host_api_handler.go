@@ -4,10 +4,9 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"path"
+	"strings"
 	"time"
 
-	docker "github.com/docker/docker/client"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -16,10 +15,10 @@ import (
 type HostServer struct {
 	eventChan  chan<- MonitorEvent
 	socketPath string
-	cli        *docker.Client
+	rt         ContainerRuntime
 }
 
-func StartHostServer(cli *docker.Client, socketPath string, eventChan chan<- MonitorEvent) {
+func StartHostServer(rt ContainerRuntime, socketPath string, eventChan chan<- MonitorEvent) {
 	os.Remove(socketPath)
 
 	lis, err := net.Listen("unix", socketPath)
@@ -31,7 +30,7 @@ func StartHostServer(cli *docker.Client, socketPath string, eventChan chan<- Mon
 	srv := HostServer{
 		eventChan:  eventChan,
 		socketPath: socketPath,
-		cli:        cli,
+		rt:         rt,
 	}
 	grpcServer := grpc.NewServer()
 	RegisterHostServiceServer(grpcServer, &srv)
@@ -47,7 +46,7 @@ func StartHostServer(cli *docker.Client, socketPath string, eventChan chan<- Mon
 
 func (srv *HostServer) UinputTriggerOpen(ctx context.Context, in *UinputTriggerMessage) (*UinputTriggerResponse, error) {
 	resp := &UinputTriggerResponse{}
-	if err := srv.enqueueMonitorEvent(EventTypeUdevDeviceOpened, in.PluginMode); err != nil {
+	if err := srv.enqueueMonitorEvent(EventTypeUdevDeviceOpened, in.PluginMode, triggerPod(in)); err != nil {
 		return resp, err
 	}
 	return &UinputTriggerResponse{}, nil
@@ -55,15 +54,54 @@ func (srv *HostServer) UinputTriggerOpen(ctx context.Context, in *UinputTriggerM
 
 func (srv *HostServer) UinputTriggerClose(ctx context.Context, in *UinputTriggerMessage) (*UinputTriggerResponse, error) {
 	resp := &UinputTriggerResponse{}
-	if err := srv.enqueueMonitorEvent(EventTypeUdevDeviceClosed, in.PluginMode); err != nil {
+	if err := srv.enqueueMonitorEvent(EventTypeUdevDeviceClosed, in.PluginMode, triggerPod(in)); err != nil {
 		return resp, err
 	}
 	return &UinputTriggerResponse{}, nil
 }
 
-func (srv *HostServer) enqueueMonitorEvent(eventType EventType, pluginMode UinputTriggerMessage_PluginMode) error {
-	container, err := findContainerWithMount(srv.cli, srv.socketPath)
-	if err != nil || container == nil {
+// UinputDeviceCreated is an open trigger, the reported device is not trusted.
+// The monitor finds the devices created by the processes of the container
+// itself.
+func (srv *HostServer) UinputDeviceCreated(ctx context.Context, in *UinputDeviceMessage) (*UinputDeviceResponse, error) {
+	resp := &UinputDeviceResponse{}
+	if err := srv.enqueueMonitorEvent(EventTypeUdevDeviceOpened, in.PluginMode, devicePod(in)); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// UinputDeviceDestroyed is a close trigger, the reported device is not
+// trusted.
+func (srv *HostServer) UinputDeviceDestroyed(ctx context.Context, in *UinputDeviceMessage) (*UinputDeviceResponse, error) {
+	resp := &UinputDeviceResponse{}
+	if err := srv.enqueueMonitorEvent(EventTypeUdevDeviceClosed, in.PluginMode, devicePod(in)); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+func triggerPod(in *UinputTriggerMessage) HelperPod {
+	return HelperPod{
+		Name:           in.PodName,
+		Namespace:      in.PodNamespace,
+		UID:            in.PodUID,
+		ContainerNames: in.ContainerNames,
+	}
+}
+
+func devicePod(in *UinputDeviceMessage) HelperPod {
+	return HelperPod{
+		Name:           in.PodName,
+		Namespace:      in.PodNamespace,
+		UID:            in.PodUID,
+		ContainerNames: in.ContainerNames,
+	}
+}
+
+func (srv *HostServer) enqueueMonitorEvent(eventType EventType, pluginMode UinputTriggerMessage_PluginMode, pod HelperPod) error {
+	containerID, err := srv.rt.FindContainerWithMount(context.Background(), srv.socketPath)
+	if err != nil || containerID == "" {
 		return fmt.Errorf("failed to find container with mounted socket path '%s': %v", srv.socketPath, err)
 	}
 
@@ -71,111 +109,45 @@ func (srv *HostServer) enqueueMonitorEvent(eventType EventType, pluginMode Uinpu
 		Timestamp: time.Now(),
 		Type:      eventType,
 		Data: map[string]string{
-			"container": container.ID,
+			"container": containerID,
 			"mode":      UinputTriggerMessage_PluginMode_name[int32(pluginMode)],
+			// Pod of the helper, checked against the pod of the container.
+			"pod_name":        pod.Name,
+			"pod_namespace":   pod.Namespace,
+			"pod_uid":         pod.UID,
+			"container_names": strings.Join(pod.ContainerNames, ","),
 		},
 	}
 
 	return nil
 }
 
-func HandleMonitorEvents(cli *docker.Client, events <-chan MonitorEvent, sysFSPrefix string, deviceFileMode os.FileMode) {
-
-	type groupedEventItem struct {
-		UinputEvent  MonitorEvent
-		DeviceEvents []MonitorEvent
-	}
-
-	windowLength := time.Duration(20 * time.Millisecond)
-	prevGroupTimestamp := time.Now().Add(-20 * time.Millisecond)
-	loopPeriod := time.Duration(5 * time.Millisecond)
-	var groupItem groupedEventItem
-	var event MonitorEvent
-
-	// use a map to memorize the major and minor numbers since
-	// we won't know them when removing the cgroup permission.
-	type devNumberCacheItem struct {
-		Major int
-		Minor int
-	}
-	devNumberMap := map[string]devNumberCacheItem{}
-
+// HandleMonitorEvents adds the input device nodes to the containers that
+// created the devices and removes them when the devices are destroyed. On the
+// trigger events of the helpers, the devices created by a container are found
+// through the uinput file descriptors of its processes, and matched to the
+// udev events of the nodes by their sysfs name. The grants are saved to the state file
+// and reconciled with the running containers on startup, and revoked when
+// the containers exit.
+func HandleMonitorEvents(rt ContainerRuntime, events <-chan MonitorEvent, sysFSPrefix string, nodeOpts DeviceNodeOptions, statePath string) {
+	c := newDeviceCorrelator(rt, sysFSPrefix, nodeOpts, statePath)
+	c.restore()
+	gc := time.NewTicker(grantGCInterval)
+	defer gc.Stop()
 	for {
-		// Non-blocking channel read
-		var ok, valid bool
 		select {
-		case event, valid = <-events:
-			ok = true
-		default:
-			ok = false
-		}
-
-		if ok && valid {
-			glog.Infof("[%d] Saw MonitorEvent %s: '%s'", event.Timestamp.UnixNano(), EventTypeEnum[event.Type], event.Data)
-
-			switch event.Type {
-			case EventTypeUdevDeviceOpened, EventTypeUdevDeviceClosed:
-				groupItem.UinputEvent = event
-			case EventTypeUdevDeviceAdded, EventTypeUdevDeviceRemoved:
-				groupItem.DeviceEvents = append(groupItem.DeviceEvents, event)
-			}
-		}
-
-		if time.Now().Sub(prevGroupTimestamp) > windowLength {
-			if groupItem.UinputEvent.Type != EventTypeInvalid {
-				addAction := false
-				if groupItem.UinputEvent.Type == EventTypeUdevDeviceOpened {
-					addAction = true
-				}
-
-				for _, deviceEvent := range groupItem.DeviceEvents {
-					devicePath := path.Join("/dev/input", path.Base(deviceEvent.Data["path"]))
-					containerID := groupItem.UinputEvent.Data["container"]
-					containers := []string{containerID}
-
-					// When device mode is 'pod', add device to all containers, otherwise just the creating container.
-					if groupItem.UinputEvent.Data["mode"] == UinputTriggerMessage_PluginMode_name[int32(UinputTriggerMessage_POD)] {
-						podContainers, err := getPodContainerIDs(sysFSPrefix, containerID)
-						if err != nil {
-							glog.Errorf("%v", err)
-						} else {
-							containers = podContainers
-						}
-					}
-
-					for _, containerID := range containers {
-						if addAction {
-							// Add device to container.
-							devMajor, devMinor, err := getDeviceInfo(path.Base(devicePath), sysFSPrefix)
-							if err != nil {
-								glog.Errorf("%v", err)
-								continue
-							}
-							devNumberMap[devicePath] = devNumberCacheItem{
-								Major: devMajor,
-								Minor: devMinor,
-							}
-							go addDeviceToContainer(cli, containerID, devicePath, sysFSPrefix, devMajor, devMinor, deviceFileMode)
-						} else {
-							// Remove device from container
-							devMajor := devNumberMap[devicePath].Major
-							devMinor := devNumberMap[devicePath].Minor
-							go removeDeviceFromContainer(cli, containerID, devicePath, sysFSPrefix, devMajor, devMinor, deviceFileMode)
-						}
-					}
-
-					if addAction {
-						glog.Infof("added device %s to %d containers", devicePath, len(containers))
-					} else {
-						glog.Infof("removed device %s from %d containers", devicePath, len(containers))
-					}
-				}
-
-				// new group
-				prevGroupTimestamp = groupItem.UinputEvent.Timestamp
-				groupItem = groupedEventItem{}
+		case event, ok := <-events:
+			if !ok {
+				return
 			}
+			glog.Infof("[%d] Saw MonitorEvent %s: '%s'", event.Timestamp.UnixNano(), EventTypeEnum[event.Type], event.Data)
+			c.handle(event)
+		case event := <-c.resolved:
+			glog.Infof("[%d] Resolved MonitorEvent %s: '%s' %s", event.Timestamp.UnixNano(), EventTypeEnum[event.Type], event.Data, event.Device.Sysname)
+			c.handle(event)
+		case <-gc.C:
+			c.collectGarbage()
 		}
-		time.Sleep(loopPeriod)
+		c.saveState()
 	}
 }
@@ -0,0 +1,79 @@
+package uinput
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// inMountNamespace runs fn in the mount namespace of a process, with the
+// root and working directory of the namespace. The namespace is entered on a
+// dedicated thread that is never unlocked, so the thread is destroyed with
+// the goroutine instead of going back to the scheduler.
+func inMountNamespace(procDir string, pid int, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		// setns of a mount namespace fails on threads sharing their
+		// filesystem attributes, as all threads of a go process do.
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			errc <- fmt.Errorf("failed to unshare filesystem attributes: %v", err)
+			return
+		}
+		nsPath := filepath.Join(procDir, fmt.Sprint(pid), "ns/mnt")
+		fd, err := unix.Open(nsPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			errc <- fmt.Errorf("failed to open %s: %v", nsPath, err)
+			return
+		}
+		defer unix.Close(fd)
+		if err := unix.Setns(fd, unix.CLONE_NEWNS); err != nil {
+			errc <- fmt.Errorf("failed to enter mount namespace %s: %v", nsPath, err)
+			return
+		}
+		errc <- fn()
+	}()
+	return <-errc
+}
+
+// mknodInContainer creates a character device node in the mount namespace
+// of the container with the process pid.
+func mknodInContainer(procDir string, pid int, devicePath string, devMajor, devMinor int, nodeOpts DeviceNodeOptions) error {
+	return inMountNamespace(procDir, pid, func() error {
+		if err := os.MkdirAll(path.Dir(devicePath), 0755); err != nil {
+			return err
+		}
+		// Replace a stale node left with other device numbers.
+		if err := unix.Unlink(devicePath); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("failed to remove %s: %v", devicePath, err)
+		}
+		dev := unix.Mkdev(uint32(devMajor), uint32(devMinor))
+		if err := unix.Mknod(devicePath, unix.S_IFCHR|uint32(nodeOpts.Mode.Perm()), int(dev)); err != nil {
+			return fmt.Errorf("failed to create %s: %v", devicePath, err)
+		}
+		// The mode given to mknod is masked by the umask.
+		if err := unix.Chmod(devicePath, uint32(nodeOpts.Mode.Perm())); err != nil {
+			return fmt.Errorf("failed to chmod %s: %v", devicePath, err)
+		}
+		if err := unix.Chown(devicePath, nodeOpts.UID, nodeOpts.GID); err != nil {
+			return fmt.Errorf("failed to chown %s: %v", devicePath, err)
+		}
+		return nil
+	})
+}
+
+// unlinkInContainer removes a device node in the mount namespace of the
+// container with the process pid.
+func unlinkInContainer(procDir string, pid int, devicePath string) error {
+	return inMountNamespace(procDir, pid, func() error {
+		if err := unix.Unlink(devicePath); err != nil && err != unix.ENOENT {
+			return fmt.Errorf("failed to remove %s: %v", devicePath, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package uinput
+
+import "fmt"
+
+// mknodInContainer is only supported on Linux.
+func mknodInContainer(procDir string, pid int, devicePath string, devMajor, devMinor int, nodeOpts DeviceNodeOptions) error {
+	return fmt.Errorf("entering mount namespaces is only supported on linux")
+}
+
+// unlinkInContainer is only supported on Linux.
+func unlinkInContainer(procDir string, pid int, devicePath string) error {
+	return fmt.Errorf("entering mount namespaces is only supported on linux")
+}
@@ -0,0 +1,68 @@
+package uinput
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Netlink multicast group of the kernel uevents, udevd rebroadcasts on group 2.
+const ueventKernelGroup = 1
+
+// netlinkUeventSource reads kernel uevents from a NETLINK_KOBJECT_UEVENT
+// socket.
+type netlinkUeventSource struct {
+	fd  int
+	buf []byte
+}
+
+// NewNetlinkUeventSource opens a NETLINK_KOBJECT_UEVENT socket subscribed to
+// the kernel uevents.
+func NewNetlinkUeventSource() (UeventSource, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netlink socket: %v", err)
+	}
+
+	// SO_RCVBUFFORCE ignores rmem_max but needs CAP_NET_ADMIN.
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, ueventBufferSize); err != nil {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, ueventBufferSize)
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: ueventKernelGroup,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+
+	return &netlinkUeventSource{fd: fd, buf: make([]byte, 16*1024)}, nil
+}
+
+// ReadUevent returns the next message sent by the kernel. Messages from
+// other processes are ignored.
+func (s *netlinkUeventSource) ReadUevent() ([]byte, error) {
+	for {
+		n, from, err := syscall.Recvfrom(s.fd, s.buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.ENOBUFS {
+			return nil, ErrUeventOverrun
+		}
+		if err != nil {
+			return nil, err
+		}
+		if nl, ok := from.(*syscall.SockaddrNetlink); !ok || nl.Pid != 0 {
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, s.buf[:n])
+		return msg, nil
+	}
+}
+
+func (s *netlinkUeventSource) Close() error {
+	return syscall.Close(s.fd)
+}
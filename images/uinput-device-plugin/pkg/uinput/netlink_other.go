@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package uinput
+
+import "fmt"
+
+// NewNetlinkUeventSource is only supported on Linux.
+func NewNetlinkUeventSource() (UeventSource, error) {
+	return nil, fmt.Errorf("uevent sockets are only supported on linux")
+}
@@ -0,0 +1,96 @@
+package uinput
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Delay before resubscribing to the container events after the stream
+// failed.
+const containerWatchRetryDelay = 5 * time.Second
+
+// Labels set by the kubelet on the containers of pods.
+const (
+	kubernetesPodNameLabel       = "io.kubernetes.pod.name"
+	kubernetesPodNamespaceLabel  = "io.kubernetes.pod.namespace"
+	kubernetesPodUIDLabel        = "io.kubernetes.pod.uid"
+	kubernetesContainerNameLabel = "io.kubernetes.container.name"
+)
+
+// errWatchUnsupported is returned by WatchExits when the runtime does not
+// stream container events.
+var errWatchUnsupported = errors.New("container events are not supported by the runtime")
+
+// PodContainer is an app container of a pod.
+type PodContainer struct {
+	ID           string
+	Name         string
+	PodName      string
+	PodNamespace string
+	PodUID       string
+}
+
+// ContainerRuntime is the container runtime of the node, used to find the
+// containers and to run commands in them.
+type ContainerRuntime interface {
+	// ListContainers returns the IDs of the running containers.
+	ListContainers(ctx context.Context) ([]string, error)
+	// FindContainerWithMount returns the ID of the running container with a
+	// mount of hostPath, or an empty ID if there is none.
+	FindContainerWithMount(ctx context.Context, hostPath string) (string, error)
+	// PodContainers returns the running app containers of the pod of a
+	// container, without the pod sandbox.
+	PodContainers(ctx context.Context, containerID string) ([]PodContainer, error)
+	// ContainerPid returns the host pid of the init process of a container.
+	ContainerPid(ctx context.Context, containerID string) (int, error)
+	// Exec runs a command in a container.
+	Exec(ctx context.Context, containerID string, cmd []string) error
+	// WatchExits sends the IDs of the containers that exit or are deleted,
+	// until the context is done or the events stream fails.
+	WatchExits(ctx context.Context, exits chan<- string) error
+}
+
+// StartContainerWatch sends an event for each container that exits or is
+// deleted. Events missed while resubscribing are covered by the garbage
+// collection of the grants.
+func StartContainerWatch(rt ContainerRuntime, eventChan chan<- MonitorEvent) {
+	exits := make(chan string)
+	go func() {
+		for containerID := range exits {
+			eventChan <- MonitorEvent{
+				Timestamp: time.Now(),
+				Type:      EventTypeContainerExited,
+				Data: map[string]string{
+					"container": containerID,
+				},
+			}
+		}
+	}()
+	go func() {
+		for {
+			err := rt.WatchExits(context.Background(), exits)
+			if err == errWatchUnsupported {
+				glog.Warningf("%v, grants of exited containers are collected every %v", err, grantGCInterval)
+				return
+			}
+			glog.Warningf("container events stream failed, resubscribing in %v: %v", containerWatchRetryDelay, err)
+			time.Sleep(containerWatchRetryDelay)
+		}
+	}()
+}
+
+func listRunningContainerIDs(rt ContainerRuntime) (map[string]bool, error) {
+	list, err := rt.ListContainers(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	containerIDs := make(map[string]bool)
+	for _, containerID := range list {
+		containerIDs[containerID] = true
+	}
+	return containerIDs, nil
+}
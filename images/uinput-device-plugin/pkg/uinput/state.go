@@ -0,0 +1,66 @@
+package uinput
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// deviceGrant is a device node given to a container.
+type deviceGrant struct {
+	Container  string `json:"container"`
+	Owner      string `json:"owner"`
+	Mode       string `json:"mode"`
+	Sysname    string `json:"sysname"`
+	DevicePath string `json:"device_path"`
+	Major      int    `json:"major"`
+	Minor      int    `json:"minor"`
+}
+
+// monitorState is the state of the monitor persisted across restarts.
+type monitorState struct {
+	Grants []deviceGrant `json:"grants"`
+}
+
+// loadMonitorState reads the state file, a missing file is an empty state.
+func loadMonitorState(name string) (*monitorState, error) {
+	state := &monitorState{}
+	dat, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state file %s: %v", name, err)
+	}
+	if err := json.Unmarshal(dat, state); err != nil {
+		return state, fmt.Errorf("failed to parse state file %s: %v", name, err)
+	}
+	return state, nil
+}
+
+// save writes the state file, through a temporary file so that a crash
+// never leaves a partial state.
+func (s *monitorState) save(name string) error {
+	dat, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(dat); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return fmt.Errorf("failed to replace state file %s: %v", name, err)
+	}
+	return nil
+}
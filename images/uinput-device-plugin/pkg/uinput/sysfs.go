@@ -0,0 +1,77 @@
+package uinput
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var sysnamePattern = regexp.MustCompile(`^input[0-9]+$`)
+
+// readUinputDevice reads the details and the nodes of a uinput device from
+// the sysfs mounted at sysDir.
+func readUinputDevice(sysDir, sysname string) (*UinputDevice, error) {
+	if !sysnamePattern.MatchString(sysname) {
+		return nil, fmt.Errorf("invalid input device name '%s'", sysname)
+	}
+	dir := filepath.Join(sysDir, virtualInputDevPath, sysname)
+
+	name, err := ioutil.ReadFile(filepath.Join(dir, "name"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read name of input device %s: %v", sysname, err)
+	}
+	vendor, err := readSysfsHex(filepath.Join(dir, "id/vendor"))
+	if err != nil {
+		return nil, err
+	}
+	product, err := readSysfsHex(filepath.Join(dir, "id/product"))
+	if err != nil {
+		return nil, err
+	}
+
+	device := &UinputDevice{
+		SysPath: path.Join("/sys", virtualInputDevPath, sysname),
+		Sysname: sysname,
+		Name:    strings.TrimSpace(string(name)),
+		Vendor:  vendor,
+		Product: product,
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*/uevent"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to glob uevent files of input device %s: %v", sysname, err)
+	}
+	for _, f := range files {
+		dat, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		event, err := parseUeventEnv(bytes.Split(dat, []byte("\n")))
+		if err != nil || len(event.DevName) == 0 {
+			continue
+		}
+		device.Nodes = append(device.Nodes, &UinputDeviceNode{
+			DevName: event.DevName,
+			Major:   uint32(event.Major),
+			Minor:   uint32(event.Minor),
+		})
+	}
+	return device, nil
+}
+
+func readSysfsHex(name string) (uint32, error) {
+	dat, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(dat)), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", name, err)
+	}
+	return uint32(value), nil
+}
@@ -0,0 +1,81 @@
+package uinput
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Device number of /dev/uinput, the misc major and UINPUT_MINOR.
+var uinputRdev = unix.Mkdev(10, 223)
+
+// uiGetSysname is the UI_GET_SYSNAME(len) ioctl request, encoded as
+// _IOC(_IOC_READ, 'U', 44, len).
+func uiGetSysname(size int) uintptr {
+	return uintptr(2)<<30 | uintptr(size)<<16 | 'U'<<8 | 44
+}
+
+// findUinputFds returns the file descriptors of the processes in procDir
+// that refer to /dev/uinput.
+func findUinputFds(procDir string, pids []int) map[uinputFd]bool {
+	fds := make(map[uinputFd]bool)
+	var links []string
+	for _, pid := range pids {
+		matches, _ := filepath.Glob(filepath.Join(procDir, fmt.Sprint(pid), "fd", "*"))
+		links = append(links, matches...)
+	}
+	for _, link := range links {
+		var st unix.Stat_t
+		if err := unix.Stat(link, &st); err != nil {
+			continue
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFCHR || uint64(st.Rdev) != uinputRdev {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(link))))
+		if err != nil {
+			continue
+		}
+		fd, err := strconv.Atoi(filepath.Base(link))
+		if err != nil {
+			continue
+		}
+		fds[uinputFd{Pid: pid, Fd: fd}] = true
+	}
+	return fds
+}
+
+// uinputSysname returns the sysfs name, ex: input12, of the device created
+// on a uinput file descriptor of another process. The descriptor is
+// duplicated with pidfd_getfd, which needs Linux 5.6 and ptrace access to the
+// process, given to the monitor by CAP_SYS_PTRACE. Fails with ENOENT while
+// the device is not created yet.
+func uinputSysname(ufd uinputFd) (string, error) {
+	pidfd, err := unix.PidfdOpen(ufd.Pid, 0)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(pidfd)
+
+	fd, err := unix.PidfdGetfd(pidfd, ufd.Fd, 0)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+
+	buf := make([]byte, 64)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uiGetSysname(len(buf)), uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return "", errno
+	}
+	return unix.ByteSliceToString(buf), nil
+}
+
+// isDeviceNotCreated reports whether err is returned by uinputSysname for a
+// descriptor without a created device.
+func isDeviceNotCreated(err error) bool {
+	return err == unix.ENOENT
+}
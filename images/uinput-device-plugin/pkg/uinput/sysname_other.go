@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package uinput
+
+import "fmt"
+
+// findUinputFds is only supported on Linux.
+func findUinputFds(procDir string, pids []int) map[uinputFd]bool {
+	return nil
+}
+
+// uinputSysname is only supported on Linux.
+func uinputSysname(ufd uinputFd) (string, error) {
+	return "", fmt.Errorf("uinput device names are only supported on linux")
+}
+
+func isDeviceNotCreated(err error) bool {
+	return false
+}
@@ -0,0 +1,146 @@
+package uinput
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Interval at which the uinput file descriptors are polled after an
+	// open or close of /dev/uinput.
+	uinputPollInterval = 50 * time.Millisecond
+
+	// Time to wait for a device to be created after an open, and destroyed
+	// after a close.
+	uinputCreateTimeout  = 5 * time.Second
+	uinputDestroyTimeout = time.Second
+)
+
+// uinputFd is a /dev/uinput file descriptor of a process.
+type uinputFd struct {
+	Pid int
+	Fd  int
+}
+
+// uinputTracker finds the input devices created and destroyed by the
+// processes of a container through their /dev/uinput file descriptors.
+type uinputTracker struct {
+	sysDir string
+	// fds returns the uinput file descriptors of the processes of the
+	// container.
+	fds func() (map[uinputFd]bool, error)
+	// sysname returns the sysfs name of the device created on a descriptor.
+	sysname func(ufd uinputFd) (string, error)
+
+	mu sync.Mutex
+	// devices maps each uinput file descriptor with a created device to the
+	// device.
+	devices map[uinputFd]*UinputDevice
+}
+
+// newUinputTracker returns a tracker of the uinput file descriptors of the
+// processes in procDir returned by pids.
+func newUinputTracker(procDir, sysDir string, pids func() ([]int, error)) *uinputTracker {
+	return &uinputTracker{
+		sysDir: sysDir,
+		fds: func() (map[uinputFd]bool, error) {
+			list, err := pids()
+			if err != nil {
+				return nil, err
+			}
+			return findUinputFds(procDir, list), nil
+		},
+		sysname: uinputSysname,
+		devices: make(map[uinputFd]*UinputDevice),
+	}
+}
+
+// created waits for devices to be created on the untracked uinput file
+// descriptors and returns them, read from sysfs. The device is created some
+// time after the open, so the descriptors are polled until a device shows up
+// or none of them is waiting for one.
+func (t *uinputTracker) created(timeout time.Duration) ([]*UinputDevice, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, waiting, err := t.resolve()
+		if len(devices) > 0 || !waiting || err != nil || time.Now().After(deadline) {
+			return devices, err
+		}
+		time.Sleep(uinputPollInterval)
+	}
+}
+
+// resolve returns the devices created on the untracked descriptors, and
+// whether a descriptor is still waiting for its device. A descriptor that
+// fails to resolve is skipped, it may be closed already.
+func (t *uinputTracker) resolve() ([]*UinputDevice, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fds, err := t.fds()
+	if err != nil {
+		return nil, false, err
+	}
+	var devices []*UinputDevice
+	waiting := false
+	for ufd := range fds {
+		if _, ok := t.devices[ufd]; ok {
+			continue
+		}
+		sysname, err := t.sysname(ufd)
+		if isDeviceNotCreated(err) {
+			waiting = true
+			continue
+		}
+		if err != nil {
+			glog.Warningf("failed to get device of uinput descriptor %d of process %d: %v", ufd.Fd, ufd.Pid, err)
+			continue
+		}
+		device, err := readUinputDevice(t.sysDir, sysname)
+		if err != nil {
+			glog.Warningf("failed to read device of uinput descriptor %d of process %d: %v", ufd.Fd, ufd.Pid, err)
+			continue
+		}
+		t.devices[ufd] = device
+		devices = append(devices, device)
+	}
+	return devices, waiting, nil
+}
+
+// destroyed waits for tracked devices to be destroyed and returns them. A
+// device is destroyed when its file descriptor is closed or it is gone from
+// sysfs.
+func (t *uinputTracker) destroyed(timeout time.Duration) ([]*UinputDevice, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, err := t.collect()
+		if len(devices) > 0 || err != nil || time.Now().After(deadline) {
+			return devices, err
+		}
+		time.Sleep(uinputPollInterval)
+	}
+}
+
+func (t *uinputTracker) collect() ([]*UinputDevice, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fds, err := t.fds()
+	if err != nil {
+		return nil, err
+	}
+	var devices []*UinputDevice
+	for ufd, device := range t.devices {
+		_, err := os.Stat(filepath.Join(t.sysDir, virtualInputDevPath, device.Sysname))
+		if fds[ufd] && !os.IsNotExist(err) {
+			continue
+		}
+		delete(t.devices, ufd)
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
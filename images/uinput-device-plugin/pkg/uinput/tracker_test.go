@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package uinput
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestUinputTracker(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input12", "input/event5", 13, 69))
+	writeTestUinputDevice(t, sysFSPrefix, testUinputDevice("input13", "input/event6", 13, 70))
+
+	created := uinputFd{Pid: 100, Fd: 3}
+	sysnames := map[uinputFd]string{
+		created: "input12",
+		// Closed since it was found.
+		{Pid: 100, Fd: 4}: "",
+		// Not created yet.
+		{Pid: 100, Fd: 5}: "",
+		// Gone from sysfs.
+		{Pid: 101, Fd: 3}: "input14",
+		{Pid: 101, Fd: 4}: "input13",
+	}
+	errs := map[uinputFd]error{
+		{Pid: 100, Fd: 4}: syscall.EBADF,
+		{Pid: 100, Fd: 5}: syscall.ENOENT,
+	}
+	tracker := &uinputTracker{
+		sysDir: filepath.Join(sysFSPrefix, "sys"),
+		fds: func() (map[uinputFd]bool, error) {
+			fds := make(map[uinputFd]bool)
+			for ufd := range sysnames {
+				fds[ufd] = true
+			}
+			return fds, nil
+		},
+		sysname: func(ufd uinputFd) (string, error) {
+			return sysnames[ufd], errs[ufd]
+		},
+		devices: make(map[uinputFd]*UinputDevice),
+	}
+
+	// The descriptors that fail to resolve are skipped.
+	devices, waiting, err := tracker.resolve()
+	if err != nil {
+		t.Fatalf("resolve() failed: %v", err)
+	}
+	var got []string
+	for _, device := range devices {
+		got = append(got, device.Sysname)
+	}
+	if len(got) == 2 && got[0] > got[1] {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !reflect.DeepEqual(got, []string{"input12", "input13"}) || !waiting {
+		t.Errorf("resolve() = %v, %v, want [input12 input13], true", got, waiting)
+	}
+
+	// The tracked descriptors are not resolved again.
+	devices, _, err = tracker.resolve()
+	if err != nil || len(devices) != 0 {
+		t.Errorf("resolve() again = %v, %v, want no devices", devices, err)
+	}
+
+	// A device is destroyed with its descriptor, or when it is gone from
+	// sysfs.
+	delete(sysnames, created)
+	if err := os.RemoveAll(filepath.Join(sysFSPrefix, "sys", virtualInputDevPath, "input13")); err != nil {
+		t.Fatal(err)
+	}
+	devices, err = tracker.destroyed(0)
+	if err != nil {
+		t.Fatalf("destroyed() failed: %v", err)
+	}
+	got = nil
+	for _, device := range devices {
+		got = append(got, device.Sysname)
+	}
+	if len(got) == 2 && got[0] > got[1] {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !reflect.DeepEqual(got, []string{"input12", "input13"}) {
+		t.Errorf("destroyed() = %v, want [input12 input13]", got)
+	}
+	if len(tracker.devices) != 0 {
+		t.Errorf("tracked devices = %v, want none", tracker.devices)
+	}
+}
@@ -1,7 +1,6 @@
 package uinput
 
 import (
-	"io"
 	"time"
 )
 
@@ -11,15 +10,21 @@ type MonitorEvent struct {
 	Type      EventType
 	Timestamp time.Time
 	Data      map[string]string
+	// Device is the device found by the monitor for the uinput device
+	// created and destroyed events.
+	Device *UinputDevice
 }
 
 // Enumerated event types
 const (
-	EventTypeInvalid           EventType = 0
-	EventTypeUdevDeviceAdded   EventType = 1
-	EventTypeUdevDeviceRemoved EventType = 2
-	EventTypeUdevDeviceOpened  EventType = 3
-	EventTypeUdevDeviceClosed  EventType = 4
+	EventTypeInvalid               EventType = 0
+	EventTypeUdevDeviceAdded       EventType = 1
+	EventTypeUdevDeviceRemoved     EventType = 2
+	EventTypeUdevDeviceOpened      EventType = 3
+	EventTypeUdevDeviceClosed      EventType = 4
+	EventTypeUinputDeviceCreated   EventType = 5
+	EventTypeUinputDeviceDestroyed EventType = 6
+	EventTypeContainerExited       EventType = 7
 )
 
 var (
@@ -29,18 +34,8 @@ var (
 		2: "EVENT_TYPE_UDEV_DEVICE_REMOVED",
 		3: "EVENT_TYPE_UDEV_DEVICE_OPENED",
 		4: "EVENT_TYPE_UDEV_DEVICE_CLOSED",
+		5: "EVENT_TYPE_UINPUT_DEVICE_CREATED",
+		6: "EVENT_TYPE_UINPUT_DEVICE_DESTROYED",
+		7: "EVENT_TYPE_CONTAINER_EXITED",
 	}
 )
-
-const udevEventPattern = `^KERNEL\[([0-9.]+)\] (add|remove)\s+.*?input[0-9]+(/.*[0-9]+) \(input\).*$`
-
-type UdevEvent struct {
-	Timestamp time.Time
-	Action    string
-	Path      string
-}
-
-type interceptor struct {
-	forward   io.Writer
-	intercept func(p []byte)
-}
@@ -1,13 +1,11 @@
 package uinput
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -15,64 +13,191 @@ import (
 	"github.com/golang/glog"
 )
 
-// Write will intercept the incoming stream, and forward
-// the contents to its `forward` Writer.
-func (i *interceptor) Write(p []byte) (n int, err error) {
-	if i.intercept != nil {
-		i.intercept(p)
-	}
+// Delay before reopening the uevent socket after it failed.
+const ueventReopenDelay = 5 * time.Second
+
+// udevMonitor turns the uevents of input device nodes into monitor events
+// and tracks the devices so that it can resync after lost events.
+type udevMonitor struct {
+	eventChan   chan<- MonitorEvent
+	sysFSPrefix string
+	openSource  func() (UeventSource, error)
+
+	// devices maps the DEVPATH of each known device node to its uevent.
+	devices map[string]*Uevent
+
+	// scanned is set once devices was filled by a scan, after which a
+	// remove uevent of an unknown device was already sent by a resync.
+	scanned bool
+}
 
-	return i.forward.Write(p)
+// StartUdevMon listens for uevents of the input subsystem on a netlink
+// socket and sends an event for each device node added or removed. When
+// uevents are lost, the devices in sysfs are rescanned and the differences
+// are sent as events.
+func StartUdevMon(eventChan chan<- MonitorEvent, sysFSPrefix string) error {
+	return startUdevMon(eventChan, sysFSPrefix, NewNetlinkUeventSource)
 }
 
-func StartUdevMon(eventChan chan<- MonitorEvent) error {
-	reEvent := regexp.MustCompile(udevEventPattern)
-	logFile, err := os.Create("/var/log/udevmon.log")
+func startUdevMon(eventChan chan<- MonitorEvent, sysFSPrefix string, openSource func() (UeventSource, error)) error {
+	source, err := openSource()
 	if err != nil {
 		return err
 	}
+	mon := &udevMonitor{
+		eventChan:   eventChan,
+		sysFSPrefix: sysFSPrefix,
+		openSource:  openSource,
+		devices:     make(map[string]*Uevent),
+	}
+	devices, err := mon.scan()
+	if err != nil {
+		glog.Warningf("failed to scan input devices: %v", err)
+	}
+	mon.devices = devices
+	mon.scanned = err == nil
+	go mon.run(source)
+	return nil
+}
 
-	cmd := exec.Command("udevadm", "monitor", "--subsystem-match", "input")
-	cmd.Stderr = &interceptor{forward: logFile}
-	stdout, _ := cmd.StdoutPipe()
-	scanner := bufio.NewScanner(stdout)
-	go func() {
-		for scanner.Scan() {
-			res := reEvent.FindSubmatch(scanner.Bytes())
-			if len(res) > 0 {
-				udevAction := string(res[2])
-				udevPath := string(res[3])
-
-				var monitorEventType EventType
-				if udevAction == "add" {
-					monitorEventType = EventTypeUdevDeviceAdded
-				} else if udevAction == "remove" {
-					monitorEventType = EventTypeUdevDeviceRemoved
-				} else {
-					glog.Warningf("unsupported udev monitor event type: %s", udevAction)
-					return
-				}
-
-				event := MonitorEvent{
-					Timestamp: time.Now(),
-					Type:      monitorEventType,
-					Data: map[string]string{
-						"path": udevPath,
-					},
-				}
-
-				// Send the event to the channel
-				eventChan <- event
+func (mon *udevMonitor) run(source UeventSource) {
+	for {
+		err := mon.readEvents(source)
+		glog.Errorf("failed to read uevent socket: %v", err)
+
+		// Reopen the socket and catch up on the devices changed meanwhile.
+		source.Close()
+		for {
+			time.Sleep(ueventReopenDelay)
+			var err error
+			if source, err = mon.openSource(); err == nil {
+				break
 			}
+			glog.Errorf("failed to reopen uevent socket: %v", err)
+		}
+		mon.resync()
+	}
+}
+
+// readEvents handles the uevents of source until reading fails, and resyncs
+// when uevents were lost.
+func (mon *udevMonitor) readEvents(source UeventSource) error {
+	reader := &UeventReader{Source: source, Subsystem: "input"}
+	for {
+		event, err := reader.Next()
+		if err == ErrUeventOverrun {
+			glog.Warningf("%v, rescanning input devices", err)
+			mon.resync()
+			continue
+		}
+		if gapErr, ok := err.(*UeventGapError); ok {
+			glog.V(1).Infof("%v, rescanning input devices", gapErr)
+			mon.resync()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		mon.handle(event)
+	}
+}
+
+// handle sends the event for a device node added or removed. Uevents of
+// input devices without a node, like the parent inputN device, and other
+// actions are ignored. Uevents that a resync already reported, like the one
+// that revealed a gap or those queued while rescanning, are ignored too.
+func (mon *udevMonitor) handle(event *Uevent) {
+	if len(event.DevName) == 0 {
+		return
+	}
+	known, ok := mon.devices[event.DevPath]
+	switch event.Action {
+	case "add":
+		if ok && known.DevName == event.DevName && known.Major == event.Major && known.Minor == event.Minor {
+			glog.V(2).Infof("ignoring uevent add %s, already known", event.DevPath)
+			return
+		}
+		mon.devices[event.DevPath] = event
+		mon.send(EventTypeUdevDeviceAdded, event)
+	case "remove":
+		if !ok && mon.scanned {
+			glog.V(2).Infof("ignoring uevent remove %s, already removed", event.DevPath)
+			return
+		}
+		if ok && event.Major == 0 {
+			event.Major, event.Minor = known.Major, known.Minor
+		}
+		delete(mon.devices, event.DevPath)
+		mon.send(EventTypeUdevDeviceRemoved, event)
+	default:
+		glog.V(2).Infof("ignoring uevent %s %s", event.Action, event.DevPath)
+	}
+}
+
+// resync rescans the devices and sends events for the differences with the
+// known devices.
+func (mon *udevMonitor) resync() {
+	devices, err := mon.scan()
+	if err != nil {
+		glog.Errorf("failed to rescan input devices: %v", err)
+		return
+	}
+	mon.scanned = true
+	for devPath, event := range mon.devices {
+		if _, ok := devices[devPath]; !ok {
+			removed := *event
+			removed.Action = "remove"
+			mon.send(EventTypeUdevDeviceRemoved, &removed)
 		}
-	}()
+	}
+	for devPath, event := range devices {
+		if _, ok := mon.devices[devPath]; !ok {
+			mon.send(EventTypeUdevDeviceAdded, event)
+		}
+	}
+	mon.devices = devices
+}
 
-	err = cmd.Start()
+// scan reads the uevent files of the virtual input device nodes in sysfs.
+func (mon *udevMonitor) scan() (map[string]*Uevent, error) {
+	devices := make(map[string]*Uevent)
+	sysPrefix := path.Join(mon.sysFSPrefix, "sys")
+	pattern := path.Join(sysPrefix, "devices/virtual/input/input*/*/uevent")
+	files, err := filepath.Glob(pattern)
 	if err != nil {
-		return fmt.Errorf("Failed to tail udevadm output: %v", err)
+		return devices, fmt.Errorf("failed to glob uevent files in pattern '%s': %v", pattern, err)
+	}
+	for _, f := range files {
+		dat, err := ioutil.ReadFile(f)
+		if err != nil {
+			// The device was removed meanwhile.
+			continue
+		}
+		event, err := parseUeventEnv(bytes.Split(dat, []byte("\n")))
+		if err != nil || len(event.DevName) == 0 {
+			continue
+		}
+		event.Action = "add"
+		event.DevPath = strings.TrimPrefix(path.Dir(f), sysPrefix)
+		event.Subsystem = "input"
+		devices[event.DevPath] = event
 	}
+	return devices, nil
+}
 
-	return nil
+func (mon *udevMonitor) send(eventType EventType, event *Uevent) {
+	mon.eventChan <- MonitorEvent{
+		Timestamp: time.Now(),
+		Type:      eventType,
+		Data: map[string]string{
+			"path":    event.DevPath,
+			"devname": event.DevName,
+			"action":  event.Action,
+			"major":   strconv.Itoa(event.Major),
+			"minor":   strconv.Itoa(event.Minor),
+			"seqnum":  strconv.FormatUint(event.SeqNum, 10),
+		},
+	}
 }
 
 func getDeviceInfo(eventDevice, sysFSPrefix string) (int, int, error) {
@@ -0,0 +1,171 @@
+package uinput
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Size of the uevent socket receive buffer, large enough for the bursts of
+// events when many devices are created at once.
+const ueventBufferSize = 4 * 1024 * 1024
+
+// ErrUeventOverrun is returned when the kernel dropped uevents because the
+// socket receive buffer was full. Reading can continue after it, but devices
+// may have changed without an event.
+var ErrUeventOverrun = errors.New("uevent socket overrun, events were dropped")
+
+// errLibudevMessage is returned by ParseUevent for messages from udevd
+// instead of the kernel.
+var errLibudevMessage = errors.New("libudev message")
+
+// UeventSource returns raw uevent messages, one per call. The netlink socket
+// implements it, and recorded uevent buffers can be replayed through it.
+type UeventSource interface {
+	ReadUevent() ([]byte, error)
+	Close() error
+}
+
+// Uevent is a decoded kernel uevent.
+type Uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevName   string
+	SeqNum    uint64
+	Major     int
+	Minor     int
+
+	// Env holds all key/value pairs of the uevent.
+	Env map[string]string
+}
+
+// ParseUevent decodes a kernel uevent message, a header in the form
+// action@devpath followed by NUL separated KEY=value pairs.
+func ParseUevent(msg []byte) (*Uevent, error) {
+	fields := bytes.Split(bytes.TrimRight(msg, "\x00"), []byte{0})
+	if len(fields) == 0 || len(fields[0]) == 0 {
+		return nil, fmt.Errorf("empty uevent")
+	}
+	if bytes.Equal(fields[0], []byte("libudev")) {
+		return nil, errLibudevMessage
+	}
+	if !bytes.Contains(fields[0], []byte("@")) {
+		return nil, fmt.Errorf("invalid uevent header %q", fields[0])
+	}
+
+	event, err := parseUeventEnv(fields[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(event.Action) == 0 || len(event.DevPath) == 0 {
+		return nil, fmt.Errorf("uevent %q is missing ACTION or DEVPATH", fields[0])
+	}
+	return event, nil
+}
+
+// parseUeventEnv decodes KEY=value pairs, from a uevent message or from a
+// uevent file in sysfs.
+func parseUeventEnv(fields [][]byte) (*Uevent, error) {
+	event := &Uevent{Env: make(map[string]string)}
+	for _, field := range fields {
+		if len(field) == 0 {
+			continue
+		}
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid uevent field %q", field)
+		}
+		event.Env[kv[0]] = kv[1]
+	}
+
+	event.Action = event.Env["ACTION"]
+	event.DevPath = event.Env["DEVPATH"]
+	event.Subsystem = event.Env["SUBSYSTEM"]
+	event.DevName = event.Env["DEVNAME"]
+	var err error
+	if v, ok := event.Env["SEQNUM"]; ok {
+		if event.SeqNum, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid SEQNUM %q", v)
+		}
+	}
+	if v, ok := event.Env["MAJOR"]; ok {
+		if event.Major, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid MAJOR %q", v)
+		}
+	}
+	if v, ok := event.Env["MINOR"]; ok {
+		if event.Minor, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid MINOR %q", v)
+		}
+	}
+	return event, nil
+}
+
+// UeventGapError is returned when SEQNUM skipped numbers, which means that
+// uevents were lost. Uevents of objects in other network namespaces also
+// leave gaps, so a gap is a hint to resync rather than proof of an overrun.
+type UeventGapError struct {
+	Last uint64
+	Next uint64
+}
+
+func (e *UeventGapError) Error() string {
+	return fmt.Sprintf("uevent SEQNUM jumped from %d to %d", e.Last, e.Next)
+}
+
+// UeventReader decodes the uevents of a source and keeps those of a
+// subsystem.
+type UeventReader struct {
+	Source UeventSource
+
+	// Subsystem of the returned uevents, all uevents if empty.
+	Subsystem string
+
+	lastSeq uint64
+	pending *Uevent
+}
+
+// Next returns the next uevent of the subsystem. It returns ErrUeventOverrun
+// from the source, or a *UeventGapError before the uevent that revealed the
+// gap, after which reading can continue. Messages that cannot be decoded are
+// skipped.
+func (r *UeventReader) Next() (*Uevent, error) {
+	if event := r.pending; event != nil {
+		r.pending = nil
+		return event, nil
+	}
+	for {
+		msg, err := r.Source.ReadUevent()
+		if err != nil {
+			if err == ErrUeventOverrun {
+				// Do not report the gap again at the next event.
+				r.lastSeq = 0
+			}
+			return nil, err
+		}
+		event, err := ParseUevent(msg)
+		if err != nil {
+			continue
+		}
+
+		// Sequence numbers cover all subsystems, so check them before filtering.
+		last := r.lastSeq
+		if event.SeqNum != 0 {
+			r.lastSeq = event.SeqNum
+		}
+		if len(r.Subsystem) > 0 && event.Subsystem != r.Subsystem {
+			if last != 0 && event.SeqNum > last+1 {
+				return nil, &UeventGapError{Last: last, Next: event.SeqNum}
+			}
+			continue
+		}
+		if last != 0 && event.SeqNum > last+1 {
+			r.pending = event
+			return nil, &UeventGapError{Last: last, Next: event.SeqNum}
+		}
+		return event, nil
+	}
+}
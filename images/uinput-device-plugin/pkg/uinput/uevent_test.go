@@ -0,0 +1,365 @@
+package uinput
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Uevents recorded from a NETLINK_KOBJECT_UEVENT socket while a virtual
+// joystick was created and destroyed through uinput.
+var (
+	recordedInputAdd = []byte("add@/devices/virtual/input/input25\x00" +
+		"ACTION=add\x00DEVPATH=/devices/virtual/input/input25\x00SUBSYSTEM=input\x00" +
+		"PRODUCT=3/45e/28e/110\x00NAME=\"Microsoft X-Box 360 pad\"\x00PROP=0\x00EV=20000b\x00" +
+		"KEY=7cdb000000000000 0 0 0 0\x00ABS=3003f\x00FF=107030000 0\x00MODALIAS=input:b0003v045Ep028Ee0110-e0,1,3,15,k130,ram4,lsfw\x00" +
+		"SEQNUM=4811\x00")
+	recordedEventAdd = []byte("add@/devices/virtual/input/input25/event21\x00" +
+		"ACTION=add\x00DEVPATH=/devices/virtual/input/input25/event21\x00SUBSYSTEM=input\x00" +
+		"MAJOR=13\x00MINOR=85\x00DEVNAME=input/event21\x00SEQNUM=4813\x00")
+	recordedJsAdd = []byte("add@/devices/virtual/input/input25/js0\x00" +
+		"ACTION=add\x00DEVPATH=/devices/virtual/input/input25/js0\x00SUBSYSTEM=input\x00" +
+		"MAJOR=13\x00MINOR=0\x00DEVNAME=input/js0\x00SEQNUM=4812\x00")
+	recordedEventRemove = []byte("remove@/devices/virtual/input/input25/event21\x00" +
+		"ACTION=remove\x00DEVPATH=/devices/virtual/input/input25/event21\x00SUBSYSTEM=input\x00" +
+		"MAJOR=13\x00MINOR=85\x00DEVNAME=input/event21\x00SEQNUM=4815\x00")
+	recordedInputRemove = []byte("remove@/devices/virtual/input/input25\x00" +
+		"ACTION=remove\x00DEVPATH=/devices/virtual/input/input25\x00SUBSYSTEM=input\x00" +
+		"PRODUCT=3/45e/28e/110\x00NAME=\"Microsoft X-Box 360 pad\"\x00SEQNUM=4816\x00")
+	recordedMiscAdd = []byte("add@/devices/virtual/misc/uinput\x00" +
+		"ACTION=add\x00DEVPATH=/devices/virtual/misc/uinput\x00SUBSYSTEM=misc\x00" +
+		"MAJOR=10\x00MINOR=223\x00DEVNAME=uinput\x00SEQNUM=4814\x00")
+	recordedLibudev = []byte("libudev\x00\xfe\xed\xca\xfe\x28\x00\x00\x00\x28\x00\x00\x00\x8c\x01\x00\x00")
+)
+
+func TestParseUevent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want *Uevent
+		err  string
+	}{
+		{
+			name: "input add",
+			msg:  recordedInputAdd,
+			want: &Uevent{Action: "add", DevPath: "/devices/virtual/input/input25", Subsystem: "input", SeqNum: 4811},
+		},
+		{
+			name: "event add",
+			msg:  recordedEventAdd,
+			want: &Uevent{Action: "add", DevPath: "/devices/virtual/input/input25/event21", Subsystem: "input", DevName: "input/event21", SeqNum: 4813, Major: 13, Minor: 85},
+		},
+		{
+			name: "event remove",
+			msg:  recordedEventRemove,
+			want: &Uevent{Action: "remove", DevPath: "/devices/virtual/input/input25/event21", Subsystem: "input", DevName: "input/event21", SeqNum: 4815, Major: 13, Minor: 85},
+		},
+		{
+			name: "input remove",
+			msg:  recordedInputRemove,
+			want: &Uevent{Action: "remove", DevPath: "/devices/virtual/input/input25", Subsystem: "input", SeqNum: 4816},
+		},
+		{
+			name: "without trailing NUL",
+			msg:  recordedEventAdd[:len(recordedEventAdd)-1],
+			want: &Uevent{Action: "add", DevPath: "/devices/virtual/input/input25/event21", Subsystem: "input", DevName: "input/event21", SeqNum: 4813, Major: 13, Minor: 85},
+		},
+		{
+			name: "libudev",
+			msg:  recordedLibudev,
+			err:  errLibudevMessage.Error(),
+		},
+		{
+			name: "empty",
+			msg:  []byte("\x00\x00"),
+			err:  "empty uevent",
+		},
+		{
+			name: "header without devpath",
+			msg:  []byte("add\x00ACTION=add\x00DEVPATH=/devices/virtual/input/input25\x00"),
+			err:  "invalid uevent header",
+		},
+		{
+			name: "field without value",
+			msg:  []byte("add@/devices/virtual/input/input25\x00ACTION=add\x00DEVPATH\x00"),
+			err:  "invalid uevent field",
+		},
+		{
+			name: "invalid major",
+			msg:  []byte("add@/devices/virtual/input/input25/event21\x00ACTION=add\x00DEVPATH=/devices/virtual/input/input25/event21\x00MAJOR=x\x00"),
+			err:  "invalid MAJOR",
+		},
+		{
+			name: "invalid seqnum",
+			msg:  []byte("add@/devices/virtual/input/input25/event21\x00ACTION=add\x00DEVPATH=/devices/virtual/input/input25/event21\x00SEQNUM=-1\x00"),
+			err:  "invalid SEQNUM",
+		},
+		{
+			name: "truncated in header",
+			msg:  recordedEventAdd[:3],
+			err:  "invalid uevent header",
+		},
+		{
+			name: "truncated before DEVPATH",
+			msg:  recordedEventAdd[:strings.Index(string(recordedEventAdd), "DEVPATH")],
+			err:  "missing ACTION or DEVPATH",
+		},
+		{
+			name: "truncated in key",
+			msg:  recordedEventAdd[:strings.Index(string(recordedEventAdd), "MAJOR")+3],
+			err:  "invalid uevent field",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := ParseUevent(tc.msg)
+			if len(tc.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("ParseUevent() returned %v, want error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseUevent() failed: %v", err)
+			}
+			if event.Action != tc.want.Action || event.DevPath != tc.want.DevPath || event.Subsystem != tc.want.Subsystem ||
+				event.DevName != tc.want.DevName || event.SeqNum != tc.want.SeqNum || event.Major != tc.want.Major || event.Minor != tc.want.Minor {
+				t.Errorf("ParseUevent() = %+v, want %+v", event, tc.want)
+			}
+			if event.Env["ACTION"] != tc.want.Action {
+				t.Errorf("ParseUevent() Env[ACTION] = %q, want %q", event.Env["ACTION"], tc.want.Action)
+			}
+		})
+	}
+}
+
+// recordedSource replays recorded messages and errors, then returns io.EOF.
+type recordedSource struct {
+	msgs [][]byte
+	errs map[int]error
+	n    int
+}
+
+func (s *recordedSource) ReadUevent() ([]byte, error) {
+	defer func() { s.n++ }()
+	if err, ok := s.errs[s.n]; ok {
+		return nil, err
+	}
+	if s.n >= len(s.msgs) {
+		return nil, io.EOF
+	}
+	return s.msgs[s.n], nil
+}
+
+func (s *recordedSource) Close() error {
+	return nil
+}
+
+func TestUeventReader(t *testing.T) {
+	truncated := recordedJsAdd[:20]
+	source := &recordedSource{
+		msgs: [][]byte{
+			recordedInputAdd,
+			recordedLibudev,
+			recordedJsAdd,
+			truncated,
+			recordedEventAdd,
+			recordedMiscAdd,
+			// The uevent of SEQNUM 4814 was the misc one, no gap.
+			recordedEventRemove,
+			nil,
+			// SEQNUM 4816 is skipped by the overrun and not reported again.
+			[]byte("add@/devices/virtual/input/input26\x00ACTION=add\x00DEVPATH=/devices/virtual/input/input26\x00SUBSYSTEM=input\x00SEQNUM=4817\x00"),
+			// SEQNUM 4818 and 4819 were lost.
+			[]byte("add@/devices/virtual/input/input26/event22\x00ACTION=add\x00DEVPATH=/devices/virtual/input/input26/event22\x00SUBSYSTEM=input\x00SEQNUM=4820\x00"),
+			// A gap revealed by a uevent of another subsystem.
+			[]byte("add@/devices/virtual/misc/foo\x00ACTION=add\x00DEVPATH=/devices/virtual/misc/foo\x00SUBSYSTEM=misc\x00SEQNUM=4830\x00"),
+		},
+		errs: map[int]error{7: ErrUeventOverrun},
+	}
+	reader := &UeventReader{Source: source, Subsystem: "input"}
+
+	type result struct {
+		seq uint64
+		err string
+	}
+	var got []result
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			got = append(got, result{err: err.Error()})
+			continue
+		}
+		got = append(got, result{seq: event.SeqNum})
+	}
+	want := []result{
+		{seq: 4811},
+		{seq: 4812},
+		{seq: 4813},
+		{seq: 4815},
+		{err: ErrUeventOverrun.Error()},
+		{seq: 4817},
+		{err: (&UeventGapError{Last: 4817, Next: 4820}).Error()},
+		{seq: 4820},
+		{err: (&UeventGapError{Last: 4820, Next: 4830}).Error()},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("UeventReader.Next() returned %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("UeventReader.Next() result %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestUdevMonitorHandle(t *testing.T) {
+	events := make(chan MonitorEvent, 10)
+	mon := &udevMonitor{eventChan: events, devices: make(map[string]*Uevent)}
+
+	// The remove uevent of an event device without its numbers takes them
+	// from the add uevent.
+	remove := append([]byte(nil), recordedEventRemove[:strings.Index(string(recordedEventRemove), "MAJOR")]...)
+	remove = append(remove, "DEVNAME=input/event21\x00SEQNUM=4815\x00"...)
+
+	for _, msg := range [][]byte{recordedInputAdd, recordedEventAdd, recordedJsAdd, remove, recordedInputRemove} {
+		event, err := ParseUevent(msg)
+		if err != nil {
+			t.Fatalf("ParseUevent() failed: %v", err)
+		}
+		mon.handle(event)
+	}
+	close(events)
+
+	want := []struct {
+		eventType EventType
+		devName   string
+		major     string
+		minor     string
+	}{
+		{EventTypeUdevDeviceAdded, "input/event21", "13", "85"},
+		{EventTypeUdevDeviceAdded, "input/js0", "13", "0"},
+		{EventTypeUdevDeviceRemoved, "input/event21", "13", "85"},
+	}
+	var i int
+	for event := range events {
+		if i >= len(want) {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		if event.Type != want[i].eventType || event.Data["devname"] != want[i].devName || event.Data["major"] != want[i].major || event.Data["minor"] != want[i].minor {
+			t.Errorf("event %d = %v %v, want %+v", i, event.Type, event.Data, want[i])
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("got %d events, want %d", i, len(want))
+	}
+	if _, ok := mon.devices["/devices/virtual/input/input25/js0"]; !ok || len(mon.devices) != 1 {
+		t.Errorf("known devices %v, want js0 only", mon.devices)
+	}
+}
+
+func TestUdevMonitorResync(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	writeUevent := func(devPath, content string) {
+		dir := filepath.Join(sysFSPrefix, "sys", devPath)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "uevent"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeUevent("devices/virtual/input/input25/event21", "MAJOR=13\nMINOR=85\nDEVNAME=input/event21\n")
+	writeUevent("devices/virtual/input/input25/js0", "MAJOR=13\nMINOR=0\nDEVNAME=input/js0\n")
+	// Malformed files are skipped.
+	writeUevent("devices/virtual/input/input26/event22", "MAJOR=13\nMINOR\n")
+
+	events := make(chan MonitorEvent, 10)
+	mon := &udevMonitor{eventChan: events, sysFSPrefix: sysFSPrefix, devices: make(map[string]*Uevent)}
+	mon.devices["/devices/virtual/input/input25/js0"] = &Uevent{DevPath: "/devices/virtual/input/input25/js0", DevName: "input/js0"}
+	mon.devices["/devices/virtual/input/input24/event20"] = &Uevent{DevPath: "/devices/virtual/input/input24/event20", DevName: "input/event20", Major: 13, Minor: 84}
+
+	mon.resync()
+	close(events)
+
+	got := make(map[string]EventType)
+	for event := range events {
+		got[event.Data["devname"]] = event.Type
+	}
+	want := map[string]EventType{
+		"input/event20": EventTypeUdevDeviceRemoved,
+		"input/event21": EventTypeUdevDeviceAdded,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("resync() sent %v, want %v", got, want)
+	}
+	for devName, eventType := range want {
+		if got[devName] != eventType {
+			t.Errorf("resync() sent %v for %s, want %v", got[devName], devName, eventType)
+		}
+	}
+	if len(mon.devices) != 2 {
+		t.Errorf("known devices %v, want event21 and js0", mon.devices)
+	}
+}
+
+func TestUdevMonitorGap(t *testing.T) {
+	sysFSPrefix := t.TempDir()
+	for devPath, content := range map[string]string{
+		"devices/virtual/input/input25/event21": "MAJOR=13\nMINOR=85\nDEVNAME=input/event21\n",
+		"devices/virtual/input/input25/js0":     "MAJOR=13\nMINOR=0\nDEVNAME=input/js0\n",
+	} {
+		dir := filepath.Join(sysFSPrefix, "sys", devPath)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "uevent"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := make(chan MonitorEvent, 10)
+	mon := &udevMonitor{eventChan: events, sysFSPrefix: sysFSPrefix, devices: make(map[string]*Uevent), scanned: true}
+	mon.devices["/devices/virtual/input/input25/js0"] = &Uevent{DevPath: "/devices/virtual/input/input25/js0", DevName: "input/js0", Major: 13}
+	source := &recordedSource{
+		msgs: [][]byte{
+			recordedInputAdd,
+			// SEQNUM 4812 was lost, the resync reports event21 before its
+			// add uevent, which is then ignored.
+			recordedEventAdd,
+			// Removed before the resync, which reported nothing for it.
+			[]byte("remove@/devices/virtual/input/input24/event20\x00ACTION=remove\x00DEVPATH=/devices/virtual/input/input24/event20\x00SUBSYSTEM=input\x00MAJOR=13\x00MINOR=84\x00DEVNAME=input/event20\x00SEQNUM=4814\x00"),
+			recordedEventRemove,
+		},
+	}
+	if err := mon.readEvents(source); err != io.EOF {
+		t.Fatalf("readEvents() returned %v, want %v", err, io.EOF)
+	}
+	close(events)
+
+	want := []struct {
+		eventType EventType
+		devName   string
+	}{
+		{EventTypeUdevDeviceAdded, "input/event21"},
+		{EventTypeUdevDeviceRemoved, "input/event21"},
+	}
+	var got []MonitorEvent
+	for event := range events {
+		got = append(got, event)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("readEvents() sent %d events %v, want %+v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i].Type != want[i].eventType || got[i].Data["devname"] != want[i].devName {
+			t.Errorf("event %d = %v %v, want %+v", i, got[i].Type, got[i].Data, want[i])
+		}
+	}
+}